@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"gen/go/todo"
+	"log"
+	"net/http"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/utilities"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// 監査ログのエクスポート
+// GET /audit-events:exportはGET /audit-eventsと同じクエリパラメーターで絞り込み、
+// 条件に合う記録をすべてJSON Lines(1行に1件のAuditEvent、新しい順)で返す。
+// todoからはページごとに受け取って書き出すので、件数が多くてもbffのメモリには溜めない
+//
+// 始まる前のエラーはgatewayと同じJSONとステータスで返す。
+// 書き始めた後のエラーはステータスを変えられないので、接続を切って途中で終わったことをクライアントに知らせる
+
+// todoのListAuditEventsで1回に受け取る件数。todoの上限と同じ
+const exportPageSize = 1000
+
+// newAuditExportHandler ctxが終わると途中でも切る。http.Server.Shutdownが長いエクスポートを待ち続けないようにする
+func newAuditExportHandler(ctx context.Context, conn grpc.ClientConnInterface, mux *runtime.ServeMux) http.HandlerFunc {
+	client := todo.NewTodoApiClient(conn)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		req := &todo.ListAuditEventsRequest{}
+		if err := runtime.PopulateQueryParameters(req, r.URL.Query(), utilities.NewDoubleArray(nil)); err != nil {
+			errorHandler(r.Context(), mux, &runtime.JSONPb{}, w, r, status.Error(codes.InvalidArgument, err.Error()))
+			return
+		}
+		req.PageSize = exportPageSize
+
+		exportCtx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		stop := context.AfterFunc(ctx, cancel)
+		defer stop()
+
+		res, err := client.ListAuditEvents(exportCtx, req)
+		if err != nil {
+			errorHandler(r.Context(), mux, &runtime.JSONPb{}, w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit-events.jsonl"`)
+		w.WriteHeader(http.StatusOK)
+		bw := bufio.NewWriter(w)
+
+		n := 0
+		for {
+			if err := writeAuditEvents(bw, res.GetAuditEvents()); err != nil {
+				log.Printf("failed to write audit events: %v", err)
+				return
+			}
+			n += len(res.GetAuditEvents())
+			if res.GetNextPageToken() == "" {
+				break
+			}
+			req.PageToken = res.GetNextPageToken()
+			if res, err = client.ListAuditEvents(exportCtx, req); err != nil {
+				log.Printf("failed to export audit events after %d events: %v", n, err)
+				// 終わりのチャンクを送らずに切るので、クライアントは読み込みのエラーで途中までだと分かる
+				bw.Flush()
+				panic(http.ErrAbortHandler)
+			}
+		}
+		if err := bw.Flush(); err != nil {
+			log.Printf("failed to write audit events: %v", err)
+		}
+	}
+}
+
+func writeAuditEvents(w *bufio.Writer, events []*todo.AuditEvent) error {
+	for _, e := range events {
+		b, err := protojson.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
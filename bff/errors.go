@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+)
+
+// gRPCのエラーをHTTPのレスポンスに変換する
+// 本文はgrpc-gatewayのデフォルトと同じで、google.rpcのエラー詳細がdetailsに入る。
+// errdetailsをimportしておくと型が登録され、detailsの中身がJSONで展開される。
+// RetryInfoがあればRetry-Afterヘッダー、RequestInfoがあればX-Request-Idヘッダーにも出す。
+// etagの不一致はgrpc-gatewayのデフォルトでは400なので、412にする
+func errorHandler(ctx context.Context, mux *runtime.ServeMux, m runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	st := status.Convert(err)
+	for _, d := range st.Details() {
+		switch d := d.(type) {
+		case *errdetails.RetryInfo:
+			secs := math.Ceil(d.GetRetryDelay().AsDuration().Seconds())
+			w.Header().Set("Retry-After", strconv.Itoa(int(secs)))
+		case *errdetails.RequestInfo:
+			w.Header().Set("X-Request-Id", d.GetRequestId())
+		}
+	}
+	if isEtagMismatch(st) {
+		err = &runtime.HTTPStatusError{HTTPStatus: http.StatusPreconditionFailed, Err: err}
+	}
+	runtime.DefaultHTTPErrorHandler(ctx, mux, m, w, r, err)
+}
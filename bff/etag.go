@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"gen/go/todo"
+	"net/http"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Todoのetagと、HTTPのETag/If-Matchヘッダーの対応
+//   - レスポンスがTodoならetagをETagヘッダーにする
+//   - 更新と削除のIf-Matchヘッダーはリクエストのetagにする
+//   - todoがETAG_MISMATCHで断ったら412 Precondition Failedにする
+
+// todoがetagの不一致で返すErrorInfoのreason
+const reasonEtagMismatch = "ETAG_MISMATCH"
+
+// setETag WithForwardResponseOptionで、成功したレスポンスを書く前に呼ばれる
+func setETag(_ context.Context, w http.ResponseWriter, m proto.Message) error {
+	if t, ok := m.(*todo.Todo); ok && t.GetEtag() != "" {
+		w.Header().Set("ETag", `"`+t.GetEtag()+`"`)
+	}
+	return nil
+}
+
+// ifMatchInterceptor grpc-gatewayはIf-Matchヘッダーをgrpcgateway-if-matchメタデータで渡すので、
+// それを更新と削除のリクエストのetagに入れる。本文のetagよりヘッダーを優先する
+func ifMatchInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	values := md.Get(runtime.MetadataPrefix + "if-match")
+	if len(values) == 0 {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	etag, err := parseIfMatch(values[0])
+	if err != nil {
+		return err
+	}
+	switch r := req.(type) {
+	case *todo.UpdateTodoRequest:
+		if r.Todo == nil {
+			r.Todo = &todo.Todo{}
+		}
+		r.Todo.Etag = etag
+	case *todo.DeleteTodoRequest:
+		r.Etag = etag
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// parseIfMatch "*"は条件なしとして空を返す。etagは1つだけ受け付け、弱いetagは強い比較で一致しないので断る
+func parseIfMatch(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if v == "*" {
+		return "", nil
+	}
+	if len(v) < 2 || !strings.HasPrefix(v, `"`) || !strings.HasSuffix(v, `"`) || strings.Contains(v[1:len(v)-1], `"`) {
+		return "", status.Errorf(codes.InvalidArgument, "If-Match must be a single strong entity tag: %q", v)
+	}
+	return v[1 : len(v)-1], nil
+}
+
+// isEtagMismatch todoがetagの不一致で断ったエラーか
+func isEtagMismatch(st *status.Status) bool {
+	if st.Code() != codes.FailedPrecondition {
+		return false
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.GetReason() == reasonEtagMismatch {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// ヘルスチェック
+// todoのHealth/Checkを呼び、todo自身とtodoから見た依存先の状態をまとめて返す。
+// どこかがSERVINGでなければ503を返すので、readinessとして使える
+
+const healthCheckTimeout = time.Second
+
+// 確認する状態。後ろほど呼び出しの奥にある
+var healthChecks = []struct {
+	name    string
+	service string
+	via     string
+}{
+	{name: "todo", service: "todo_service.TodoApi"},
+	// todoが依存先の状態を返すときのサービス名 (todo/health.go)
+	{name: "greet", service: "dependency/greet", via: "todo"},
+}
+
+type healthCheckResponse struct {
+	// 全部SERVINGならok、そうでなければdegraded
+	Status       string             `json:"status"`
+	Dependencies []dependencyStatus `json:"dependencies"`
+}
+
+type dependencyStatus struct {
+	Name    string `json:"name"`
+	Service string `json:"service"`
+	Via     string `json:"via,omitempty"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+func newHealthCheckHandler(conn grpc.ClientConnInterface) http.HandlerFunc {
+	client := healthpb.NewHealthClient(conn)
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+		defer cancel()
+
+		res := healthCheckResponse{Status: "ok"}
+		for _, c := range healthChecks {
+			d := dependencyStatus{Name: c.name, Service: c.service, Via: c.via}
+			hres, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: c.service})
+			if err != nil {
+				d.Status = healthpb.HealthCheckResponse_UNKNOWN.String()
+				d.Error = err.Error()
+			} else {
+				d.Status = hres.GetStatus().String()
+			}
+			if d.Status != healthpb.HealthCheckResponse_SERVING.String() {
+				res.Status = "degraded"
+			}
+			res.Dependencies = append(res.Dependencies, d)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if res.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(res)
+	}
+}
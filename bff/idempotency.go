@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/textproto"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+)
+
+// Idempotency-Keyヘッダーをtodoに渡す
+// todoは最初のレスポンスを保存していて、同じキーで来たPOSTには同じレスポンスを返す。
+// 保存したレスポンスを返したときはIdempotent-Replayed: trueヘッダーをつける
+
+// incomingHeaderMatcher Idempotency-Keyをメタデータidempotency-keyにする。他はgrpc-gatewayのデフォルトどおり
+// テナントとアクターはtenantAuthが決めるので、クライアントがGrpc-Metadata-で送っても渡さない
+func incomingHeaderMatcher(key string) (string, bool) {
+	switch textproto.CanonicalMIMEHeaderKey(key) {
+	case "Idempotency-Key":
+		return "idempotency-key", true
+	case runtime.MetadataHeaderPrefix + tenantHeader, runtime.MetadataHeaderPrefix + "X-Actor-Id":
+		return "", false
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+// outgoingHeaderMatcher todoのメタデータidempotent-replayedをそのままのヘッダーにする
+// 他はgrpc-gatewayのデフォルトどおりGrpc-Metadata-をつける
+func outgoingHeaderMatcher(key string) (string, bool) {
+	if key == "idempotent-replayed" {
+		return "Idempotent-Replayed", true
+	}
+	return runtime.MetadataHeaderPrefix + key, true
+}
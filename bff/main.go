@@ -2,16 +2,21 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"os"
 	"os/signal"
+	"pkg/grpcserver"
 	"pkg/otel"
+	"pkg/resilience"
+	"syscall"
+	"time"
 
 	"gen/go/todo"
 	"net/http"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"golang.org/x/sync/errgroup"
 
@@ -26,13 +31,24 @@ func main() {
 	}
 }
 
-func run() error {
-	close := otel.NewTracerProvider("bff")
-	defer close()
+func run() (err error) {
+	shutdown, err := otel.Setup(context.Background(), "bff")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, shutdown(context.Background()))
+	}()
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	// gRPCのサーバーと同じGRPC_SHUTDOWN_TIMEOUTで処理中のリクエストを待つ
+	shutdownConfig, err := grpcserver.ShutdownConfigFromEnv()
+	if err != nil {
+		return err
+	}
+
 	l, err := net.Listen("tcp", fmt.Sprintf(":%s", "8080"))
 	if err != nil {
 		return err
@@ -44,40 +60,94 @@ func run() error {
 		return err
 	}
 
-	s := newServer(l, mux)
+	s := newServer(l, mux, shutdownConfig.Timeout)
 	return s.run(ctx)
 }
 
 func newHandler(ctx context.Context) (http.Handler, error) {
-	grpcGateway := runtime.NewServeMux()
+	grpcGateway := runtime.NewServeMux(
+		runtime.WithErrorHandler(errorHandler),
+		runtime.WithForwardResponseOption(setETag),
+		runtime.WithIncomingHeaderMatcher(incomingHeaderMatcher),
+		runtime.WithOutgoingHeaderMatcher(outgoingHeaderMatcher),
+	)
+	// todoが不調なときにbffのリクエストが溜まらないように、すぐに失敗させる
+	resilienceConfig, err := resilience.ConfigFromEnv("TODO")
+	if err != nil {
+		return nil, err
+	}
+	guard, err := resilience.New("todo", resilienceConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// テナントはメタデータとbaggageで、アクターはメタデータで渡す。baggageとトレースコンテキストはotelgrpcが載せる
 	opts := []grpc.DialOption{
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithChainUnaryInterceptor(identityUnaryInterceptor, ifMatchInterceptor, guard.UnaryClientInterceptor()),
+		grpc.WithChainStreamInterceptor(identityStreamInterceptor, guard.StreamClientInterceptor()),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+	}
+
+	// 監査ログのエクスポートもgatewayと同じ接続で呼ぶ
+	conn, err := grpc.NewClient("todo:8081", opts...)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	if err := todo.RegisterTodoApiHandler(ctx, grpcGateway, conn); err != nil {
+		return nil, err
 	}
+	tenants := newTenantAuth(grpcGateway)
+	otelHandler := otelhttp.NewHandler(tenants.handler(grpcGateway), "helloHandler")
 
-	if err := todo.RegisterTodoApiHandlerFromEndpoint(ctx, grpcGateway, "todo:8081", opts); err != nil {
+	// ヘルスチェックはトレースせず、サーキットブレーカーも通さない
+	healthConn, err := grpc.NewClient("todo:8081", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
 		return nil, err
 	}
-	otelHandler := otelhttp.NewHandler(grpcGateway, "helloHandler")
+	go func() {
+		<-ctx.Done()
+		healthConn.Close()
+	}()
+
+	// WatchTodosは長く続くので、バルクヘッドの枠を占めないようにguardを通さない
+	watchConn, err := grpc.NewClient("todo:8081",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithStreamInterceptor(identityStreamInterceptor),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		watchConn.Close()
+	}()
 
 	mux := http.NewServeMux()
-	mux.Handle("/helthcheck", http.HandlerFunc(healthCheckHandler))
+	mux.Handle("/helthcheck", newHealthCheckHandler(healthConn))
+	mux.Handle("/todos:watch", otelhttp.NewHandler(tenants.handler(newWatchHandler(ctx, watchConn, grpcGateway)), "watchHandler"))
+	mux.Handle("/audit-events:export", otelhttp.NewHandler(tenants.handler(newAuditExportHandler(ctx, conn, grpcGateway)), "auditExportHandler"))
 	mux.Handle("/", otelHandler)
 	return mux, nil
 }
 
-func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-}
-
 type Server struct {
 	srv *http.Server
 	l   net.Listener
+	// Shutdownで処理中のリクエストを待つ最大の時間。過ぎたらCloseで強制的に止める
+	shutdownTimeout time.Duration
 }
 
-func newServer(l net.Listener, mux http.Handler) *Server {
+func newServer(l net.Listener, mux http.Handler, shutdownTimeout time.Duration) *Server {
 	return &Server{
-		srv: &http.Server{Handler: mux},
-		l:   l,
+		srv:             &http.Server{Handler: mux},
+		l:               l,
+		shutdownTimeout: shutdownTimeout,
 	}
 }
 
@@ -93,8 +163,14 @@ func (s *Server) run(ctx context.Context) error {
 	})
 
 	<-ctx.Done()
-	if err := s.srv.Shutdown(context.Background()); err != nil {
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+	if err := s.srv.Shutdown(shutdownCtx); err != nil {
 		log.Printf("failed to shutdown: %+v", err)
+		// 待ちきれなかった接続(watchのストリームなど)を切る
+		if err := s.srv.Close(); err != nil {
+			log.Printf("failed to close: %+v", err)
+		}
 	}
 
 	return eg.Wait()
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// テナント
+// リクエストのテナントを次の順に決め、todoにはメタデータx-tenant-idとbaggageのtenant.idで渡す。
+//   - Authorization: Bearerのトークン。BFF_JWT_SECRETで署名を確かめたHS256のJWTの、BFF_TENANT_CLAIMのクレーム
+//   - X-Tenant-Idヘッダー。トークンと一緒に送られたら、同じテナントでなければ断る
+//
+// どちらもなければtodoのデフォルトのテナントになる。
+// クライアントが送ったbaggageやGrpc-Metadata-X-Tenant-Idヘッダーは、ここで決めたもので上書きするか消す
+//
+// todoの監査ログに残す変更した人(アクター)は、署名を確かめたトークンのsubクレームだけから決め、メタデータx-actor-idで渡す。
+// クライアントが名乗ったものは監査ログに残せないので、ヘッダーでは受け付けない。subがなければtodoはanonymousとして残す
+
+const (
+	tenantHeader     = "X-Tenant-Id"
+	tenantMetadata   = "x-tenant-id"
+	tenantBaggageKey = "tenant.id"
+	actorMetadata    = "x-actor-id"
+
+	jwtSecretEnv   = "BFF_JWT_SECRET"
+	tenantClaimEnv = "BFF_TENANT_CLAIM"
+
+	defaultTenantClaim = "tenant_id"
+)
+
+// todoと同じ形。メタデータとbaggageにそのまま入れられるものだけ
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// subはログやCSVに出しても崩れないように、空白と制御文字を含まない256文字までにする
+var actorIDPattern = regexp.MustCompile(`^[\x21-\x7e]{1,256}$`)
+
+var errInvalidToken = errors.New("invalid bearer token")
+
+type (
+	tenantKey struct{}
+	actorKey  struct{}
+)
+
+func tenantFromContext(ctx context.Context) string {
+	t, _ := ctx.Value(tenantKey{}).(string)
+	return t
+}
+
+func actorFromContext(ctx context.Context) string {
+	a, _ := ctx.Value(actorKey{}).(string)
+	return a
+}
+
+// identity リクエストから決めたテナントとアクター。決まらなければ空文字列
+type identity struct {
+	tenant string
+	actor  string
+}
+
+type tenantAuth struct {
+	// 空ならトークンを受け付けない
+	secret []byte
+	claim  string
+	mux    *runtime.ServeMux
+	now    func() time.Time
+}
+
+// newTenantAuth エラーはmuxと同じ形で返す
+func newTenantAuth(mux *runtime.ServeMux) *tenantAuth {
+	a := &tenantAuth{secret: []byte(os.Getenv(jwtSecretEnv)), claim: os.Getenv(tenantClaimEnv), mux: mux, now: time.Now}
+	if a.claim == "" {
+		a.claim = defaultTenantClaim
+	}
+	return a
+}
+
+// handler otelhttpの内側に置き、リクエストのspanとメトリクスにもテナントを付ける
+func (a *tenantAuth) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		id, err := a.resolve(r)
+		if err != nil {
+			errorHandler(ctx, a.mux, &runtime.JSONPb{}, w, r, err)
+			return
+		}
+		if id.actor != "" {
+			ctx = context.WithValue(ctx, actorKey{}, id.actor)
+		}
+
+		b := baggage.FromContext(ctx).DeleteMember(tenantBaggageKey)
+		if tenant := id.tenant; tenant != "" {
+			ctx = context.WithValue(ctx, tenantKey{}, tenant)
+			if m, err := baggage.NewMemberRaw(tenantBaggageKey, tenant); err == nil {
+				b, _ = b.SetMember(m)
+			}
+			trace.SpanFromContext(ctx).SetAttributes(attribute.String(tenantBaggageKey, tenant))
+			if l, ok := otelhttp.LabelerFromContext(ctx); ok {
+				l.Add(attribute.String(tenantBaggageKey, tenant))
+			}
+		}
+		ctx = baggage.ContextWithBaggage(ctx, b)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// resolve テナントとアクターを決める
+func (a *tenantAuth) resolve(r *http.Request) (identity, error) {
+	header := r.Header.Get(tenantHeader)
+	if header != "" && !tenantIDPattern.MatchString(header) {
+		return identity{}, status.Errorf(codes.InvalidArgument, "%s: invalid tenant id", tenantHeader)
+	}
+
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return identity{tenant: header}, nil
+	}
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok {
+		return identity{}, status.Error(codes.Unauthenticated, "authorization must be a bearer token")
+	}
+	claimed, err := a.verify(token)
+	if err != nil {
+		return identity{}, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if header != "" && header != claimed.tenant {
+		return identity{}, status.Errorf(codes.PermissionDenied, "%s does not match the authenticated tenant", tenantHeader)
+	}
+	return claimed, nil
+}
+
+// verify HS256のJWTを確かめ、テナントのクレームとsubを返す
+func (a *tenantAuth) verify(token string) (identity, error) {
+	if len(a.secret) == 0 {
+		return identity{}, errors.New("bearer tokens are not accepted")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return identity{}, errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return identity{}, errInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return identity{}, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return identity{}, errInvalidToken
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return identity{}, errInvalidToken
+	}
+	// 漏れたトークンがいつまでも使えないように、expのないトークンは受け付けない
+	now := a.now()
+	rawExp, ok := claims["exp"]
+	if !ok {
+		return identity{}, errors.New("bearer token has no exp")
+	}
+	exp, ok := rawExp.(float64)
+	if !ok {
+		return identity{}, errors.New("bearer token has an invalid exp claim")
+	}
+	if !now.Before(time.Unix(int64(exp), 0)) {
+		return identity{}, errors.New("bearer token has expired")
+	}
+	if rawNbf, ok := claims["nbf"]; ok {
+		nbf, ok := rawNbf.(float64)
+		if !ok {
+			return identity{}, errors.New("bearer token has an invalid nbf claim")
+		}
+		if now.Before(time.Unix(int64(nbf), 0)) {
+			return identity{}, errors.New("bearer token is not valid yet")
+		}
+	}
+	tenant, _ := claims[a.claim].(string)
+	if !tenantIDPattern.MatchString(tenant) {
+		return identity{}, fmt.Errorf("bearer token has no valid %s claim", a.claim)
+	}
+	sub, _ := claims["sub"].(string)
+	if sub != "" && !actorIDPattern.MatchString(sub) {
+		return identity{}, errors.New("bearer token has an invalid sub claim")
+	}
+	return identity{tenant: tenant, actor: sub}, nil
+}
+
+func decodeJWTPart(s string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// identityUnaryInterceptor メタデータx-tenant-idとx-actor-idを決めたもので置き換える。クライアントが送ったものは使わない
+func identityUnaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(outgoingIdentity(ctx), method, req, reply, cc, opts...)
+}
+
+func identityStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(outgoingIdentity(ctx), desc, cc, method, opts...)
+}
+
+func outgoingIdentity(ctx context.Context) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	md.Delete(tenantMetadata)
+	md.Delete(actorMetadata)
+	if tenant := tenantFromContext(ctx); tenant != "" {
+		md.Set(tenantMetadata, tenant)
+	}
+	if actor := actorFromContext(ctx); actor != "" {
+		md.Set(actorMetadata, actor)
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
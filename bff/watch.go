@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gen/go/todo"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// todoの変更をServer-Sent Eventsで返す
+// todoのWatchTodosを呼び、受け取ったイベントをそのまま書き出す。
+//   - イベントのidはresume_tokenなので、EventSourceが自動で繋ぎ直すとLast-Event-IDヘッダーで続きから受け取れる
+//   - heartbeatはSSEのコメントにして、途中のプロキシに接続を切られないようにする
+//   - 始まる前のエラーはgatewayと同じJSONとステータスで返し、始まった後のエラーはerrorイベントで知らせて閉じる
+//
+// 書き出しが遅いとtodoからの受信も止まり、todoで溜まりすぎると切られる。
+// その場合もerrorイベントの後に閉じるので、EventSourceは最後のidから繋ぎ直す
+
+// EventSourceが切れた後に繋ぎ直すまでの時間
+const sseRetry = 3 * time.Second
+
+var sseEventNames = map[todo.TodoEvent_Type]string{
+	todo.TodoEvent_CREATED: "created",
+	todo.TodoEvent_UPDATED: "updated",
+	todo.TodoEvent_DELETED: "deleted",
+}
+
+// newWatchHandler ctxが終わるとストリームを閉じる。http.Server.Shutdownは終わらないリクエストを待ち続けるため
+func newWatchHandler(ctx context.Context, conn grpc.ClientConnInterface, mux *runtime.ServeMux) http.HandlerFunc {
+	client := todo.NewTodoApiClient(conn)
+	marshaler := &protojson.MarshalOptions{}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := r.Header.Get("Last-Event-ID")
+		if token == "" {
+			token = r.URL.Query().Get("resume_token")
+		}
+
+		streamCtx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		stop := context.AfterFunc(ctx, cancel)
+		defer stop()
+
+		stream, err := client.WatchTodos(streamCtx, &todo.WatchTodosRequest{ResumeToken: token})
+		if err != nil {
+			errorHandler(r.Context(), mux, &runtime.JSONPb{}, w, r, err)
+			return
+		}
+		// todoは見始めるとすぐheartbeatを送るので、最初のメッセージを受け取ってからヘッダーを書く
+		first, err := stream.Recv()
+		if err != nil {
+			errorHandler(r.Context(), mux, &runtime.JSONPb{}, w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+
+		for res := first; ; {
+			if err := writeSSE(w, marshaler, res); err != nil {
+				log.Printf("failed to write event: %v", err)
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+
+			res, err = stream.Recv()
+			if err != nil {
+				if streamCtx.Err() == nil {
+					b, _ := marshaler.Marshal(status.Convert(err).Proto())
+					fmt.Fprintf(w, "event: error\ndata: %s\n\n", b)
+					rc.Flush()
+				}
+				return
+			}
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, m *protojson.MarshalOptions, res *todo.WatchTodosResponse) error {
+	if hb := res.GetHeartbeat(); hb != nil {
+		_, err := fmt.Fprintf(w, ": heartbeat %s\n\n", hb.AsTime().Format(time.RFC3339))
+		return err
+	}
+	e := res.GetEvent()
+	b, err := m.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.GetResumeToken(), sseEventNames[e.GetType()], b)
+	return err
+}
@@ -19,14 +19,23 @@ import (
 const _ = grpc.SupportPackageIsVersion7
 
 const (
-	GreetService_SayHello_FullMethodName = "/greet_service.GreetService/SayHello"
+	GreetService_SayHello_FullMethodName        = "/greet_service.GreetService/SayHello"
+	GreetService_StreamGreetings_FullMethodName = "/greet_service.GreetService/StreamGreetings"
+	GreetService_CollectNames_FullMethodName    = "/greet_service.GreetService/CollectNames"
+	GreetService_Chat_FullMethodName            = "/greet_service.GreetService/Chat"
 )
 
 // GreetServiceClient is the client API for GreetService service.
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type GreetServiceClient interface {
-	SayHello(ctx context.Context, in *NoParam, opts ...grpc.CallOption) (*HelloResponse, error)
+	SayHello(ctx context.Context, in *HelloRequest, opts ...grpc.CallOption) (*HelloResponse, error)
+	// count件の挨拶をinterval_msごとに送る。クライアントがキャンセルした時点で止まる
+	StreamGreetings(ctx context.Context, in *StreamGreetingsRequest, opts ...grpc.CallOption) (GreetService_StreamGreetingsClient, error)
+	// 送られてきた名前を集め、ストリームが閉じられたらまとめて挨拶を返す
+	CollectNames(ctx context.Context, opts ...grpc.CallOption) (GreetService_CollectNamesClient, error)
+	// 送られてきたメッセージにその都度挨拶を返す
+	Chat(ctx context.Context, opts ...grpc.CallOption) (GreetService_ChatClient, error)
 }
 
 type greetServiceClient struct {
@@ -37,7 +46,7 @@ func NewGreetServiceClient(cc grpc.ClientConnInterface) GreetServiceClient {
 	return &greetServiceClient{cc}
 }
 
-func (c *greetServiceClient) SayHello(ctx context.Context, in *NoParam, opts ...grpc.CallOption) (*HelloResponse, error) {
+func (c *greetServiceClient) SayHello(ctx context.Context, in *HelloRequest, opts ...grpc.CallOption) (*HelloResponse, error) {
 	out := new(HelloResponse)
 	err := c.cc.Invoke(ctx, GreetService_SayHello_FullMethodName, in, out, opts...)
 	if err != nil {
@@ -46,11 +55,114 @@ func (c *greetServiceClient) SayHello(ctx context.Context, in *NoParam, opts ...
 	return out, nil
 }
 
+func (c *greetServiceClient) StreamGreetings(ctx context.Context, in *StreamGreetingsRequest, opts ...grpc.CallOption) (GreetService_StreamGreetingsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &GreetService_ServiceDesc.Streams[0], GreetService_StreamGreetings_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &greetServiceStreamGreetingsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type GreetService_StreamGreetingsClient interface {
+	Recv() (*HelloResponse, error)
+	grpc.ClientStream
+}
+
+type greetServiceStreamGreetingsClient struct {
+	grpc.ClientStream
+}
+
+func (x *greetServiceStreamGreetingsClient) Recv() (*HelloResponse, error) {
+	m := new(HelloResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *greetServiceClient) CollectNames(ctx context.Context, opts ...grpc.CallOption) (GreetService_CollectNamesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &GreetService_ServiceDesc.Streams[1], GreetService_CollectNames_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &greetServiceCollectNamesClient{stream}
+	return x, nil
+}
+
+type GreetService_CollectNamesClient interface {
+	Send(*HelloRequest) error
+	CloseAndRecv() (*CollectNamesResponse, error)
+	grpc.ClientStream
+}
+
+type greetServiceCollectNamesClient struct {
+	grpc.ClientStream
+}
+
+func (x *greetServiceCollectNamesClient) Send(m *HelloRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *greetServiceCollectNamesClient) CloseAndRecv() (*CollectNamesResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(CollectNamesResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *greetServiceClient) Chat(ctx context.Context, opts ...grpc.CallOption) (GreetService_ChatClient, error) {
+	stream, err := c.cc.NewStream(ctx, &GreetService_ServiceDesc.Streams[2], GreetService_Chat_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &greetServiceChatClient{stream}
+	return x, nil
+}
+
+type GreetService_ChatClient interface {
+	Send(*ChatMessage) error
+	Recv() (*ChatMessage, error)
+	grpc.ClientStream
+}
+
+type greetServiceChatClient struct {
+	grpc.ClientStream
+}
+
+func (x *greetServiceChatClient) Send(m *ChatMessage) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *greetServiceChatClient) Recv() (*ChatMessage, error) {
+	m := new(ChatMessage)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // GreetServiceServer is the server API for GreetService service.
 // All implementations must embed UnimplementedGreetServiceServer
 // for forward compatibility
 type GreetServiceServer interface {
-	SayHello(context.Context, *NoParam) (*HelloResponse, error)
+	SayHello(context.Context, *HelloRequest) (*HelloResponse, error)
+	// count件の挨拶をinterval_msごとに送る。クライアントがキャンセルした時点で止まる
+	StreamGreetings(*StreamGreetingsRequest, GreetService_StreamGreetingsServer) error
+	// 送られてきた名前を集め、ストリームが閉じられたらまとめて挨拶を返す
+	CollectNames(GreetService_CollectNamesServer) error
+	// 送られてきたメッセージにその都度挨拶を返す
+	Chat(GreetService_ChatServer) error
 	mustEmbedUnimplementedGreetServiceServer()
 }
 
@@ -58,9 +170,18 @@ type GreetServiceServer interface {
 type UnimplementedGreetServiceServer struct {
 }
 
-func (UnimplementedGreetServiceServer) SayHello(context.Context, *NoParam) (*HelloResponse, error) {
+func (UnimplementedGreetServiceServer) SayHello(context.Context, *HelloRequest) (*HelloResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SayHello not implemented")
 }
+func (UnimplementedGreetServiceServer) StreamGreetings(*StreamGreetingsRequest, GreetService_StreamGreetingsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamGreetings not implemented")
+}
+func (UnimplementedGreetServiceServer) CollectNames(GreetService_CollectNamesServer) error {
+	return status.Errorf(codes.Unimplemented, "method CollectNames not implemented")
+}
+func (UnimplementedGreetServiceServer) Chat(GreetService_ChatServer) error {
+	return status.Errorf(codes.Unimplemented, "method Chat not implemented")
+}
 func (UnimplementedGreetServiceServer) mustEmbedUnimplementedGreetServiceServer() {}
 
 // UnsafeGreetServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -75,7 +196,7 @@ func RegisterGreetServiceServer(s grpc.ServiceRegistrar, srv GreetServiceServer)
 }
 
 func _GreetService_SayHello_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(NoParam)
+	in := new(HelloRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
@@ -87,11 +208,84 @@ func _GreetService_SayHello_Handler(srv interface{}, ctx context.Context, dec fu
 		FullMethod: GreetService_SayHello_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(GreetServiceServer).SayHello(ctx, req.(*NoParam))
+		return srv.(GreetServiceServer).SayHello(ctx, req.(*HelloRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
+func _GreetService_StreamGreetings_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamGreetingsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(GreetServiceServer).StreamGreetings(m, &greetServiceStreamGreetingsServer{stream})
+}
+
+type GreetService_StreamGreetingsServer interface {
+	Send(*HelloResponse) error
+	grpc.ServerStream
+}
+
+type greetServiceStreamGreetingsServer struct {
+	grpc.ServerStream
+}
+
+func (x *greetServiceStreamGreetingsServer) Send(m *HelloResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _GreetService_CollectNames_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(GreetServiceServer).CollectNames(&greetServiceCollectNamesServer{stream})
+}
+
+type GreetService_CollectNamesServer interface {
+	SendAndClose(*CollectNamesResponse) error
+	Recv() (*HelloRequest, error)
+	grpc.ServerStream
+}
+
+type greetServiceCollectNamesServer struct {
+	grpc.ServerStream
+}
+
+func (x *greetServiceCollectNamesServer) SendAndClose(m *CollectNamesResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *greetServiceCollectNamesServer) Recv() (*HelloRequest, error) {
+	m := new(HelloRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _GreetService_Chat_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(GreetServiceServer).Chat(&greetServiceChatServer{stream})
+}
+
+type GreetService_ChatServer interface {
+	Send(*ChatMessage) error
+	Recv() (*ChatMessage, error)
+	grpc.ServerStream
+}
+
+type greetServiceChatServer struct {
+	grpc.ServerStream
+}
+
+func (x *greetServiceChatServer) Send(m *ChatMessage) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *greetServiceChatServer) Recv() (*ChatMessage, error) {
+	m := new(ChatMessage)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // GreetService_ServiceDesc is the grpc.ServiceDesc for GreetService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -104,6 +298,23 @@ var GreetService_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _GreetService_SayHello_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamGreetings",
+			Handler:       _GreetService_StreamGreetings_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "CollectNames",
+			Handler:       _GreetService_CollectNames_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Chat",
+			Handler:       _GreetService_Chat_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
 	Metadata: "greet/greet.proto",
 }
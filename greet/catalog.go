@@ -0,0 +1,86 @@
+package main
+
+import (
+	pb "gen/go/greet"
+
+	"golang.org/x/text/language"
+)
+
+// 挨拶文のカタログ
+// ロケールごとにカジュアルと丁寧な言い回しを持つ。%sには名前が入る
+
+// 見つからない場合に最後に使うロケール
+var defaultLocale = language.English
+
+type greeting struct {
+	casual string
+	formal string
+	// 丁寧さを指定しなかった場合に使う言い回し
+	defaultFormality pb.Formality
+}
+
+var catalog = map[language.Tag]greeting{
+	language.English: {
+		casual:           "Hi, %s!",
+		formal:           "Hello, %s.",
+		defaultFormality: pb.Formality_FORMALITY_CASUAL,
+	},
+	language.Japanese: {
+		casual:           "やあ、%s！",
+		formal:           "こんにちは、%sさん。",
+		defaultFormality: pb.Formality_FORMALITY_FORMAL,
+	},
+	language.French: {
+		casual:           "Salut, %s !",
+		formal:           "Bonjour, %s.",
+		defaultFormality: pb.Formality_FORMALITY_FORMAL,
+	},
+	language.German: {
+		casual:           "Hallo, %s!",
+		formal:           "Guten Tag, %s.",
+		defaultFormality: pb.Formality_FORMALITY_FORMAL,
+	},
+	language.Spanish: {
+		casual:           "¡Hola, %s!",
+		formal:           "Buenos días, %s.",
+		defaultFormality: pb.Formality_FORMALITY_CASUAL,
+	},
+	language.Korean: {
+		casual:           "안녕, %s!",
+		formal:           "안녕하세요, %s님.",
+		defaultFormality: pb.Formality_FORMALITY_FORMAL,
+	},
+	language.Portuguese: {
+		casual:           "Oi, %s!",
+		formal:           "Olá, %s.",
+		defaultFormality: pb.Formality_FORMALITY_CASUAL,
+	},
+}
+
+// lookupGreeting 指定されたロケールから親のロケールへ順に辿り、最初に見つかった挨拶を返す
+// 例: ja-JP -> ja, pt-BR -> pt, zh-Hant-TW -> zh-Hant -> (en)
+// 辿ったロケールの一覧も返すので、spanの属性に使える
+func lookupGreeting(tag language.Tag) (language.Tag, greeting, []string) {
+	var chain []string
+	for t := tag; ; t = t.Parent() {
+		chain = append(chain, t.String())
+		if g, ok := catalog[t]; ok {
+			return t, g, chain
+		}
+		if t.IsRoot() {
+			break
+		}
+	}
+	chain = append(chain, defaultLocale.String())
+	return defaultLocale, catalog[defaultLocale], chain
+}
+
+func (g greeting) template(f pb.Formality) string {
+	if f == pb.Formality_FORMALITY_UNSPECIFIED {
+		f = g.defaultFormality
+	}
+	if f == pb.Formality_FORMALITY_FORMAL {
+		return g.formal
+	}
+	return g.casual
+}
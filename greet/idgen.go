@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 挨拶のIDの生成
+// snowflakeと同じく64bitを次のように分ける。上位から並べるのでIDはおおよそ時刻順になる
+//
+//	| 0 (1bit) | 経過ミリ秒 (41bit) | ノードID (10bit) | 連番 (12bit) |
+//
+// 経過ミリ秒はidEpochからで、約69年分使える
+
+const (
+	nodeIDBits   = 10
+	sequenceBits = 12
+
+	maxNodeID   = 1<<nodeIDBits - 1
+	maxSequence = 1<<sequenceBits - 1
+	maxElapsed  = 1<<41 - 1
+
+	// ノードIDを指定する環境変数。プロセスごとに別の値にすること
+	nodeIDEnv = "GREET_NODE_ID"
+
+	// 連番を使い切ったときに、時計が次のミリ秒に進んだか確かめる間隔
+	sequenceWait = 100 * time.Microsecond
+)
+
+var idEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type idGenerator struct {
+	mu     sync.Mutex
+	nodeID int64
+	// 最後にIDを作った経過ミリ秒と、そのミリ秒の中での連番
+	lastMs   int64
+	sequence int64
+	// 時計が戻っていて、lastMsに追いつくのを待っている間はtrue。戻ったときに1回だけログを出す
+	behind bool
+
+	now func() time.Time
+}
+
+func newIDGenerator(nodeID int64) (*idGenerator, error) {
+	if nodeID < 0 || nodeID > maxNodeID {
+		return nil, fmt.Errorf("node id must be between 0 and %d: %d", maxNodeID, nodeID)
+	}
+	return &idGenerator{nodeID: nodeID, now: time.Now}, nil
+}
+
+// nodeIDFromEnv GREET_NODE_IDからノードIDを読む。未設定なら0
+func nodeIDFromEnv() (int64, error) {
+	v := os.Getenv(nodeIDEnv)
+	if v == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", nodeIDEnv, err)
+	}
+	return id, nil
+}
+
+// Next 新しいIDを返す
+// 時計が戻った場合は最後に使った時刻のまま連番を進める。
+// 同じミリ秒の連番を使い切った場合は時計が次のミリ秒に進むまで待つので、
+// IDが重複したり小さくなったりせず、IDの時刻が実際の時刻より先に進むこともない
+func (g *idGenerator) Next() (uint64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := g.elapsed()
+	if ms < 0 {
+		return 0, errors.New("clock is before the id epoch")
+	}
+	if ms < g.lastMs {
+		if !g.behind {
+			log.Printf("idgen: clock moved backwards by %dms, reusing the last timestamp", g.lastMs-ms)
+			g.behind = true
+		}
+		ms = g.lastMs
+	} else {
+		g.behind = false
+	}
+
+	if ms == g.lastMs {
+		g.sequence++
+		if g.sequence > maxSequence {
+			for ms <= g.lastMs {
+				time.Sleep(sequenceWait)
+				ms = g.elapsed()
+			}
+			g.sequence = 0
+		}
+	} else {
+		g.sequence = 0
+	}
+	if ms > maxElapsed {
+		return 0, errors.New("id timestamp overflow")
+	}
+	g.lastMs = ms
+
+	return uint64(ms)<<(nodeIDBits+sequenceBits) | uint64(g.nodeID)<<sequenceBits | uint64(g.sequence), nil
+}
+
+// elapsed idEpochからの経過ミリ秒
+func (g *idGenerator) elapsed() int64 {
+	return g.now().Sub(idEpoch).Milliseconds()
+}
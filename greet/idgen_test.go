@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLog テスト中のlogの出力を返す
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(prev) })
+	return &buf
+}
+
+// splitID IDを経過ミリ秒と連番に分ける
+func splitID(id uint64) (ms, sequence int64) {
+	return int64(id >> (nodeIDBits + sequenceBits)), int64(id & maxSequence)
+}
+
+func newTestIDGenerator(t *testing.T, now func() time.Time) *idGenerator {
+	t.Helper()
+	g, err := newIDGenerator(1)
+	if err != nil {
+		t.Fatalf("newIDGenerator: %v", err)
+	}
+	g.now = now
+	return g
+}
+
+func TestIDGeneratorSequenceOverflow(t *testing.T) {
+	logs := captureLog(t)
+	base := idEpoch.Add(time.Hour)
+	// 連番を使い切った後、何回か確かめてから時計が次のミリ秒に進む
+	calls := 0
+	g := newTestIDGenerator(t, func() time.Time {
+		calls++
+		if calls > maxSequence+1+5 {
+			return base.Add(time.Millisecond)
+		}
+		return base
+	})
+
+	var last uint64
+	for i := 0; i <= maxSequence+1; i++ {
+		id, err := g.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if id <= last {
+			t.Fatalf("id %d is not greater than the previous id %d", id, last)
+		}
+		last = id
+	}
+	ms, sequence := splitID(last)
+	if want := base.Sub(idEpoch).Milliseconds() + 1; ms != want || sequence != 0 {
+		t.Errorf("id after overflow = ms %d sequence %d, want ms %d sequence 0", ms, sequence, want)
+	}
+
+	// 同じミリ秒の次のIDは連番が進むだけで、時計が戻ったことにはならない
+	id, err := g.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if ms2, sequence := splitID(id); ms2 != ms || sequence != 1 {
+		t.Errorf("next id = ms %d sequence %d, want ms %d sequence 1", ms2, sequence, ms)
+	}
+	if strings.Contains(logs.String(), "clock moved backwards") {
+		t.Errorf("unexpected log: %s", logs)
+	}
+}
+
+func TestIDGeneratorClockRollback(t *testing.T) {
+	logs := captureLog(t)
+	base := idEpoch.Add(time.Hour)
+	now := base.Add(5 * time.Millisecond)
+	g := newTestIDGenerator(t, func() time.Time { return now })
+
+	first, err := g.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	wantMs, _ := splitID(first)
+
+	// 時計が戻っている間は最後の時刻のまま連番を進め、ログは1回だけ出す
+	now = base
+	last := first
+	for i := 1; i <= 3; i++ {
+		id, err := g.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if ms, sequence := splitID(id); ms != wantMs || sequence != int64(i) {
+			t.Errorf("id during rollback = ms %d sequence %d, want ms %d sequence %d", ms, sequence, wantMs, i)
+		}
+		if id <= last {
+			t.Fatalf("id %d is not greater than the previous id %d", id, last)
+		}
+		last = id
+	}
+	if n := strings.Count(logs.String(), "clock moved backwards"); n != 1 {
+		t.Errorf("logged %d times, want 1: %s", n, logs)
+	}
+
+	// 追い越したら新しい時刻で連番を0からにする
+	now = base.Add(6 * time.Millisecond)
+	id, err := g.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if ms, sequence := splitID(id); ms != wantMs+1 || sequence != 0 {
+		t.Errorf("id after catching up = ms %d sequence %d, want ms %d sequence 0", ms, sequence, wantMs+1)
+	}
+}
@@ -2,19 +2,33 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	pb "gen/go/greet"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"pkg/grpcserver"
 	"pkg/otel"
+	"strings"
 	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	otelapi "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/text/language"
 	"google.golang.org/grpc"
+	grpcCodes "google.golang.org/grpc/codes"
 	"google.golang.org/grpc/health"
-	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 )
 
 func main() {
@@ -23,55 +37,156 @@ func main() {
 	}
 }
 
-func run() error {
-	close := otel.NewTracerProvider("greet")
-	defer close()
+func run() (err error) {
+	shutdown, err := otel.Setup(context.Background(), "greet")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, shutdown(context.Background()))
+	}()
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGKILL)
 	defer cancel()
 
+	shutdownConfig, err := grpcserver.ShutdownConfigFromEnv()
+	if err != nil {
+		return err
+	}
+
 	ln, err := net.Listen("tcp", ":8082")
 	if err != nil {
-		log.Fatalf("Failed to start server %v", err)
+		return err
 	}
 	log.Printf("Server started at %v", ln.Addr())
 
-	srv := setupServer()
-	go func() {
-		<-ctx.Done()
-		srv.GracefulStop()
-		log.Println("gRPC server stopped")
-	}()
+	nodeID, err := nodeIDFromEnv()
+	if err != nil {
+		return err
+	}
+	ids, err := newIDGenerator(nodeID)
+	if err != nil {
+		return err
+	}
+	log.Printf("ID generator started with node id %d", nodeID)
 
-	return srv.Serve(ln)
+	srv, hs := setupServer(ids)
+	return grpcserver.Serve(ctx, srv, hs, ln, shutdownConfig)
 }
 
 type helloServer struct {
 	pb.GreetServiceServer
+	ids *idGenerator
 }
 
-func setupServer() *grpc.Server {
+func setupServer(ids *idGenerator) (*grpc.Server, *health.Server) {
 	srv := grpc.NewServer(
 		// grpc.ChainUnaryInterceptor(),
-		grpc.StatsHandler(otelgrpc.NewServerHandler()), // 分散トレーシングとメトリクスを有効にするためのgrpc.StatsHandlerを追加
+		// todoは使われていない接続にも30秒ごとにpingを送るので、デフォルト(5分)より短い間隔を許可する
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+		// 分散トレーシングとメトリクスを有効にするためのgrpc.StatsHandlerを追加
+		// ストリーミングのRPCでは送受信したメッセージごとにspanのイベントを残す
+		grpc.StatsHandler(otelgrpc.NewServerHandler(
+			otelgrpc.WithMessageEvents(otelgrpc.ReceivedEvents, otelgrpc.SentEvents),
+		)),
 	)
 
-	pb.RegisterGreetServiceServer(srv, &helloServer{})
+	pb.RegisterGreetServiceServer(srv, &helloServer{ids: ids})
 
-	healthSrv := health.NewServer()
-	healthpb.RegisterHealthServer(srv, healthSrv)
+	hs := grpcserver.NewHealthServer(srv)
 
 	reflection.Register(srv)
-	return srv
+	return srv, hs
+}
+
+// 名前の最大長(文字数)
+const maxNameLength = 100
+
+var tracer = otelapi.Tracer("greet")
+
+func (s *helloServer) SayHello(ctx context.Context, req *pb.HelloRequest) (*pb.HelloResponse, error) {
+	return s.greet(ctx, req)
 }
 
-func (s *helloServer) SayHello(ctx context.Context, req *pb.NoParam) (*pb.HelloResponse, error) {
-	// span := trace.SpanFromContext(ctx)
-	// span.SetAttributes(
-	// 	attribute.String("app.product.id", req.Id),
-	// )
+// greet 1件の挨拶を作る。ストリーミングのRPCからも使う
+func (s *helloServer) greet(ctx context.Context, req *pb.HelloRequest) (*pb.HelloResponse, error) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("greet.locale.requested", req.GetLocale()),
+		attribute.String("greet.formality", req.GetFormality().String()),
+	)
+
+	if err := validateHelloRequest(req); err != nil {
+		return nil, invalidArgument(span, err)
+	}
+
+	tag := defaultLocale
+	if req.GetLocale() != "" {
+		tag = language.Make(req.GetLocale())
+	}
+	message, locale := render(ctx, tag, req.GetName(), req.GetFormality())
+	span.SetAttributes(attribute.String("greet.locale", locale.String()))
+
+	id, err := s.ids.Next()
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, status.Error(grpcCodes.Internal, err.Error())
+	}
+	// IDでtodoのspanと突き合わせられるように、spanとログの両方に残す
+	// 最上位bitは常に0なのでint64にしても負にならない
+	span.SetAttributes(attribute.Int64("greet.id", int64(id)))
+	log.Printf("greeting id=%d locale=%s trace_id=%s", id, locale, span.SpanContext().TraceID())
 
 	return &pb.HelloResponse{
-		Id: 1,
+		Id:      id,
+		Message: message,
+		Locale:  locale.String(),
 	}, nil
 }
+
+func validateHelloRequest(req *pb.HelloRequest) error {
+	name := req.GetName()
+	switch {
+	case strings.TrimSpace(name) == "":
+		return errors.New("name is required")
+	case !utf8.ValidString(name):
+		return errors.New("name must be valid UTF-8")
+	case utf8.RuneCountInString(name) > maxNameLength:
+		return fmt.Errorf("name must be at most %d characters", maxNameLength)
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		return errors.New("name must not contain control characters")
+	}
+	if l := req.GetLocale(); l != "" {
+		if _, err := language.Parse(l); err != nil {
+			return fmt.Errorf("invalid locale %q: %v", l, err)
+		}
+	}
+	if _, ok := pb.Formality_name[int32(req.GetFormality())]; !ok {
+		return fmt.Errorf("unknown formality %d", req.GetFormality())
+	}
+	return nil
+}
+
+// invalidArgument バリデーションのエラーをspanに記録し、InvalidArgumentのstatusにする
+func invalidArgument(span trace.Span, err error) error {
+	span.SetStatus(codes.Error, err.Error())
+	return status.Error(grpcCodes.InvalidArgument, err.Error())
+}
+
+// render カタログから挨拶文を組み立てる。フォールバックの経路はspanに残す
+func render(ctx context.Context, tag language.Tag, name string, formality pb.Formality) (string, language.Tag) {
+	_, span := tracer.Start(ctx, "greet.render")
+	defer span.End()
+
+	locale, g, chain := lookupGreeting(tag)
+	span.SetAttributes(
+		attribute.String("greet.locale.requested", tag.String()),
+		attribute.String("greet.locale", locale.String()),
+		attribute.StringSlice("greet.locale.fallback_chain", chain),
+		attribute.Bool("greet.locale.fallback", locale != tag),
+	)
+	return fmt.Sprintf(g.template(formality), name), locale
+}
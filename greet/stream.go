@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	pb "gen/go/greet"
+	"io"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/text/language"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// StreamGreetingsでcountを省略した場合の件数
+	defaultStreamCount = 3
+	// 1回のストリームで送れる最大の件数
+	maxStreamCount = 100
+	// StreamGreetingsでinterval_msを省略した場合の間隔
+	defaultStreamInterval = time.Second
+	// 指定できる最大の間隔
+	maxStreamInterval = 10 * time.Second
+	// CollectNamesで受け取れる最大の名前の数
+	maxCollectNames = 1000
+)
+
+// StreamGreetings count件の挨拶を間隔をあけて送る
+// クライアントがキャンセルするかデッドラインを過ぎた時点で止める
+func (s *helloServer) StreamGreetings(req *pb.StreamGreetingsRequest, stream pb.GreetService_StreamGreetingsServer) error {
+	ctx := stream.Context()
+	span := trace.SpanFromContext(ctx)
+
+	count := req.GetCount()
+	if count == 0 {
+		count = defaultStreamCount
+	}
+	interval := defaultStreamInterval
+	if req.GetIntervalMs() > 0 {
+		interval = time.Duration(req.GetIntervalMs()) * time.Millisecond
+	}
+	span.SetAttributes(
+		attribute.Int("greet.stream.count", int(count)),
+		attribute.Int64("greet.stream.interval_ms", interval.Milliseconds()),
+	)
+	if count > maxStreamCount {
+		return invalidArgument(span, fmt.Errorf("count must be at most %d", maxStreamCount))
+	}
+	if interval > maxStreamInterval {
+		return invalidArgument(span, fmt.Errorf("interval_ms must be at most %d", maxStreamInterval.Milliseconds()))
+	}
+	if req.GetHello() == nil {
+		return invalidArgument(span, errors.New("hello is required"))
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var sent uint32
+	defer func() { span.SetAttributes(attribute.Int("greet.stream.sent", int(sent))) }()
+	for {
+		res, err := s.greet(ctx, req.GetHello())
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+		sent++
+		if sent == count {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			span.AddEvent("greet.stream.cancelled")
+			return status.FromContextError(ctx.Err()).Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// CollectNames 送られてきた名前を集め、ストリームが閉じられたら全員への挨拶を返す
+// ロケールと丁寧さは最初のメッセージのものを使う
+func (s *helloServer) CollectNames(stream pb.GreetService_CollectNamesServer) error {
+	ctx := stream.Context()
+	span := trace.SpanFromContext(ctx)
+
+	var (
+		first *pb.HelloRequest
+		count uint32
+		names []string
+		seen  = map[string]bool{}
+	)
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := validateHelloRequest(req); err != nil {
+			return invalidArgument(span, fmt.Errorf("message %d: %w", count+1, err))
+		}
+		count++
+		if count > maxCollectNames {
+			return invalidArgument(span, fmt.Errorf("at most %d names can be sent", maxCollectNames))
+		}
+		if first == nil {
+			first = req
+		}
+		if !seen[req.GetName()] {
+			seen[req.GetName()] = true
+			names = append(names, req.GetName())
+		}
+	}
+	span.SetAttributes(
+		attribute.Int("greet.collect.count", int(count)),
+		attribute.Int("greet.collect.unique", len(names)),
+	)
+	if first == nil {
+		return invalidArgument(span, errors.New("at least one name is required"))
+	}
+
+	tag := defaultLocale
+	if first.GetLocale() != "" {
+		tag = language.Make(first.GetLocale())
+	}
+	message, locale := render(ctx, tag, strings.Join(names, ", "), first.GetFormality())
+	return stream.SendAndClose(&pb.CollectNamesResponse{
+		Count:   count,
+		Names:   names,
+		Message: message,
+		Locale:  locale.String(),
+	})
+}
+
+// Chat 受け取ったメッセージごとに送り主への挨拶を返す
+// クライアントが送信を閉じるまで続ける
+func (s *helloServer) Chat(stream pb.GreetService_ChatServer) error {
+	ctx := stream.Context()
+	span := trace.SpanFromContext(ctx)
+
+	var received int
+	defer func() { span.SetAttributes(attribute.Int("greet.chat.messages", received)) }()
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		received++
+
+		res, err := s.greet(ctx, &pb.HelloRequest{Name: msg.GetName(), Locale: msg.GetLocale()})
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&pb.ChatMessage{
+			Name:   "greet",
+			Locale: res.GetLocale(),
+			Text:   res.GetMessage(),
+		}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package broker
+
+import (
+	"context"
+	"errors"
+)
+
+// サービスの間でイベントを非同期に受け渡すメッセージブローカー
+// Brokerを実装すれば置き換えられる。今はプロセスの中で配るInProcだけがある。
+// WithTracingで包むと、トレースコンテキストをメッセージのヘッダーで運ぶ
+
+type Message struct {
+	// 送る側が決める一意なID。同じメッセージが2回届いたら見分けるのに使う
+	ID    string
+	Topic string
+	// 同じキーのメッセージは送った順に届く
+	Key     string
+	Headers map[string]string
+	Payload []byte
+}
+
+// Handler 届いたメッセージを処理する。エラーを返すとブローカーがやり直す
+// やり直しても変わらないエラーはPermanentで包むと、やり直さずに記録だけする
+type Handler func(ctx context.Context, m *Message) error
+
+// permanentError やり直さないエラー
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent 壊れたメッセージなど、やり直しても処理できないことを示す
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent Permanentで包んだエラーか
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+type Broker interface {
+	// Publish topicを購読している全員に送る。受け取る側が詰まっていれば、空くかctxが終わるまで待つ
+	Publish(ctx context.Context, m *Message) error
+	// Subscribe topicのメッセージを届いた順にhに渡す。返した関数で購読をやめる
+	Subscribe(topic string, h Handler) (unsubscribe func(), err error)
+	// Close 購読をすべてやめ、処理中のメッセージが終わるのを待つ
+	Close() error
+}
@@ -0,0 +1,177 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// InProc プロセスの中だけで配るBroker。外のサービスはいらない
+// 購読ごとにキューとgoroutineを1つ持ち、送った順に1件ずつ処理する。
+// キューが一杯ならPublishを待たせるので、送る側に処理の遅れが伝わる。
+//
+// ハンドラーがエラーを返したら、Retryの回数まで間隔を空けてやり直す。やり直している間は同じ購読の次のメッセージを処理しないので、順番は変わらない。
+// 次の場合はメッセージをログに残して捨てるので、その購読には届かない。
+//   - Retryの回数やり直しても失敗したか、Permanentのエラーを返した
+//   - 止めている途中にやり直すことになった
+//   - 処理する前にプロセスが止まった。メッセージはメモリにしかない
+
+var ErrClosed = errors.New("broker: closed")
+
+// Retry ハンドラーが失敗したときのやり直し方
+type Retry struct {
+	// 最初の1回も含めた回数。1以下ならやり直さない
+	MaxAttempts int
+	// 待つ時間はBaseDelayから倍々にMaxDelayまで延ばし、その半分から全部の間で揺らす
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// backoff attempts回失敗した後に待つ時間
+func (r Retry) backoff(attempts int) time.Duration {
+	d := r.BaseDelay
+	for i := 1; i < attempts && d < r.MaxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, r.MaxDelay)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+type InProc struct {
+	queueSize int
+	retry     Retry
+
+	mu     sync.RWMutex
+	subs   map[string][]*subscription
+	closed bool
+	// Closeの最初に閉じ、キューが空くのを待っているPublishを抜けさせる
+	closing   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+type subscription struct {
+	queue chan *Message
+	// 購読をやめたら閉じる
+	done chan struct{}
+	once sync.Once
+}
+
+// NewInProc queueSizeは購読ごとに溜められるメッセージの数
+func NewInProc(queueSize int, retry Retry) *InProc {
+	return &InProc{queueSize: queueSize, retry: retry, subs: map[string][]*subscription{}, closing: make(chan struct{})}
+}
+
+func (b *InProc) Publish(ctx context.Context, m *Message) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrClosed
+	}
+	for _, s := range b.subs[m.Topic] {
+		select {
+		case s.queue <- m:
+		case <-s.done:
+		case <-b.closing:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (b *InProc) Subscribe(topic string, h Handler) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	s := &subscription{queue: make(chan *Message, b.queueSize), done: make(chan struct{})}
+	b.subs[topic] = append(b.subs[topic], s)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			// 止めるときはキューに残っているものを処理してから終わる
+			select {
+			case m := <-s.queue:
+				b.handle(h, m)
+			case <-s.done:
+				for {
+					select {
+					case m := <-s.queue:
+						b.handle(h, m)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return func() { b.unsubscribe(topic, s) }, nil
+}
+
+// handle 成功するまでやり直す。諦めたらログに残して捨てる
+func (b *InProc) handle(h Handler, m *Message) {
+	for attempts := 1; ; attempts++ {
+		err := h(context.Background(), m)
+		if err == nil {
+			return
+		}
+		if IsPermanent(err) || attempts >= b.retry.MaxAttempts {
+			log.Printf("broker: dropped message %s on %s after %d attempts: %v", m.ID, m.Topic, attempts, err)
+			return
+		}
+		t := time.NewTimer(b.retry.backoff(attempts))
+		select {
+		case <-t.C:
+		case <-b.closing:
+			t.Stop()
+			log.Printf("broker: dropped message %s on %s while closing: %v", m.ID, m.Topic, err)
+			return
+		}
+	}
+}
+
+func (b *InProc) unsubscribe(topic string, s *subscription) {
+	// 先にdoneを閉じ、このキューで待っているPublishを抜けさせてからロックを取る
+	s.once.Do(func() { close(s.done) })
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subs := b.subs[topic]
+	for i, v := range subs {
+		if v == s {
+			b.subs[topic] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+}
+
+func (b *InProc) Close() error {
+	b.closeOnce.Do(func() { close(b.closing) })
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	for _, subs := range b.subs {
+		for _, s := range subs {
+			s.once.Do(func() { close(s.done) })
+		}
+	}
+	b.subs = map[string][]*subscription{}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+	return nil
+}
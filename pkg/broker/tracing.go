@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"context"
+
+	otelapi "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// メッセージのトレース
+// Publishはspan kindがPRODUCERのspanを作り、そのコンテキストをヘッダー(traceparent, tracestate)に入れる。
+// 受け取る側はヘッダーからコンテキストを取り出し、その子としてCONSUMERのspanを作ってHandlerを呼ぶ。
+// 送ってから処理するまでが1つのトレースになる
+
+// HeaderCarrier メッセージのヘッダーをTextMapPropagatorで読み書きする
+type HeaderCarrier map[string]string
+
+func (c HeaderCarrier) Get(key string) string { return c[key] }
+
+func (c HeaderCarrier) Set(key, value string) { c[key] = value }
+
+func (c HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+type tracedBroker struct {
+	Broker
+	system string
+	tracer trace.Tracer
+}
+
+// WithTracing bのPublishとHandlerをトレースする。systemはspanの属性messaging.systemになる
+func WithTracing(b Broker, system string) Broker {
+	return &tracedBroker{Broker: b, system: system, tracer: otelapi.Tracer("pkg/broker")}
+}
+
+func (b *tracedBroker) attrs(operation string, m *Message) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("messaging.system", b.system),
+		attribute.String("messaging.operation.type", operation),
+		attribute.String("messaging.destination.name", m.Topic),
+		attribute.String("messaging.message.id", m.ID),
+		attribute.String("messaging.message.key", m.Key),
+		attribute.Int("messaging.message.body.size", len(m.Payload)),
+	}
+}
+
+func (b *tracedBroker) Publish(ctx context.Context, m *Message) error {
+	ctx, span := b.tracer.Start(ctx, "publish "+m.Topic,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(b.attrs("publish", m)...),
+	)
+	defer span.End()
+
+	// 呼び出し元のメッセージは書き換えない
+	out := *m
+	out.Headers = make(HeaderCarrier, len(m.Headers)+2)
+	for k, v := range m.Headers {
+		out.Headers[k] = v
+	}
+	otelapi.GetTextMapPropagator().Inject(ctx, HeaderCarrier(out.Headers))
+
+	err := b.Broker.Publish(ctx, &out)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+func (b *tracedBroker) Subscribe(topic string, h Handler) (func(), error) {
+	return b.Broker.Subscribe(topic, func(ctx context.Context, m *Message) error {
+		ctx = otelapi.GetTextMapPropagator().Extract(ctx, HeaderCarrier(m.Headers))
+		ctx, span := b.tracer.Start(ctx, "process "+m.Topic,
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(b.attrs("process", m)...),
+		)
+		defer span.End()
+
+		err := h(ctx, m)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return err
+	})
+}
+
+var _ propagation.TextMapCarrier = HeaderCarrier(nil)
@@ -0,0 +1,118 @@
+package grpcserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// gRPCサーバーの起動と段階的な停止
+// 停止するときは次の順に進める
+//  1. ヘルスチェックをNOT_SERVINGにする
+//  2. ロードバランサーやオーケストレーターが切り離すまでDrainDelayだけ待つ
+//  3. GracefulStopで処理中のリクエストを待つ。Timeoutを過ぎたらStopで強制的に止める
+
+const (
+	drainDelayEnv      = "GRPC_DRAIN_DELAY"
+	shutdownTimeoutEnv = "GRPC_SHUTDOWN_TIMEOUT"
+
+	defaultShutdownTimeout = 10 * time.Second
+)
+
+type ShutdownConfig struct {
+	// NOT_SERVINGにしてからGracefulStopを呼ぶまでの待ち時間
+	DrainDelay time.Duration
+	// GracefulStopを待つ最大の時間。0なら待たずにStopする
+	Timeout time.Duration
+}
+
+// ShutdownConfigFromEnv GRPC_DRAIN_DELAYとGRPC_SHUTDOWN_TIMEOUT(ミリ秒)から停止の設定を読む
+func ShutdownConfigFromEnv() (ShutdownConfig, error) {
+	c := ShutdownConfig{Timeout: defaultShutdownTimeout}
+	if v := os.Getenv(drainDelayEnv); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			return c, fmt.Errorf("%s: invalid milliseconds %q", drainDelayEnv, v)
+		}
+		c.DrainDelay = time.Duration(ms) * time.Millisecond
+	}
+	if v := os.Getenv(shutdownTimeoutEnv); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			return c, fmt.Errorf("%s: invalid milliseconds %q", shutdownTimeoutEnv, v)
+		}
+		c.Timeout = time.Duration(ms) * time.Millisecond
+	}
+	return c, nil
+}
+
+// NewHealthServer ヘルスチェックのサーバーをsrvに登録する
+// サービスごとの状態はServeで登録済みのサービスから設定する
+func NewHealthServer(srv *grpc.Server) *health.Server {
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	return hs
+}
+
+// Services srvに登録されたアプリケーションのサービス名を返す
+// ヘルスチェックやリフレクションなどgrpc.で始まるものは除く
+func Services(srv *grpc.Server) []string {
+	var names []string
+	for name := range srv.GetServiceInfo() {
+		if !strings.HasPrefix(name, "grpc.") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Serve lnでsrvを動かし、ctxが終わったら段階的に止める
+// サーバー全体("")と登録済みのサービスごとのヘルスチェックをSERVINGにしてから受け付けを始める
+func Serve(ctx context.Context, srv *grpc.Server, hs *health.Server, ln net.Listener, c ShutdownConfig) error {
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	for _, name := range Services(srv) {
+		hs.SetServingStatus(name, healthpb.HealthCheckResponse_SERVING)
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Serve(ln) }()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	// 以降の状態の更新は無視され、Watchしているクライアントにも通知される
+	hs.Shutdown()
+	if c.DrainDelay > 0 {
+		log.Printf("Health status set to NOT_SERVING, draining for %v", c.DrainDelay)
+		time.Sleep(c.DrainDelay)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(c.Timeout):
+		// 終わらないストリームがあるとGracefulStopはいつまでも返らない
+		log.Printf("Graceful stop did not finish within %v, closing remaining connections", c.Timeout)
+		srv.Stop()
+		<-stopped
+	}
+	log.Println("gRPC server stopped")
+
+	return <-errCh
+}
@@ -0,0 +1,37 @@
+package otel
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Baggageのspan属性
+// 親のcontextのbaggageから決められたキーの値を取り出し、同じ名前の属性として始まったspanに付ける。
+// サービスをまたいで伝播したtenant.idなどを、それぞれのspanで属性を付け直さなくても検索に使える
+
+// 値がない場合に付けるキー
+var defaultBaggageSpanAttributes = []string{"tenant.id"}
+
+type baggageProcessor struct {
+	keys []string
+}
+
+func newBaggageProcessor(keys []string) *baggageProcessor {
+	return &baggageProcessor{keys: keys}
+}
+
+func (p *baggageProcessor) OnStart(parent context.Context, s trace.ReadWriteSpan) {
+	b := baggage.FromContext(parent)
+	for _, k := range p.keys {
+		if m := b.Member(k); m.Key() != "" {
+			s.SetAttributes(attribute.String(k, m.Value()))
+		}
+	}
+}
+
+func (p *baggageProcessor) OnEnd(trace.ReadOnlySpan)         {}
+func (p *baggageProcessor) Shutdown(context.Context) error   { return nil }
+func (p *baggageProcessor) ForceFlush(context.Context) error { return nil }
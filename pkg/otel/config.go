@@ -0,0 +1,559 @@
+package otel
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config
+// OpenTelemetryの宣言的設定(opentelemetry-configuration)のスキーマをモデルにした設定ファイル
+// https://github.com/open-telemetry/opentelemetry-configuration
+// resource, propagator, tracer_provider, meter_provider, logger_providerを1つのYAMLにまとめる。
+// 値には${ENV}や${ENV:-default}の形式で環境変数を埋め込める。
+
+// サポートしている設定ファイルのバージョン
+const supportedFileFormat = "0.3"
+
+type Config struct {
+	FileFormat      string                `yaml:"file_format"`
+	Disabled        bool                  `yaml:"disabled"`
+	Resource        *ResourceConfig       `yaml:"resource"`
+	Propagator      *PropagatorConfig     `yaml:"propagator"`
+	AttributeLimits *AttributeLimits      `yaml:"attribute_limits"`
+	TracerProvider  *TracerProviderConfig `yaml:"tracer_provider"`
+	MeterProvider   *MeterProviderConfig  `yaml:"meter_provider"`
+	LoggerProvider  *LoggerProviderConfig `yaml:"logger_provider"`
+
+	// 仕様にはない独自の拡張
+	Profiling *ProfilingConfig `yaml:"profiling"`
+	// spanの属性にするbaggageのキー。省略するとtenant.id
+	BaggageSpanAttributes []string `yaml:"baggage_span_attributes"`
+}
+
+type ResourceConfig struct {
+	Attributes []AttributeNameValue `yaml:"attributes"`
+	SchemaURL  string               `yaml:"schema_url"`
+}
+
+// typeはstring(省略時), bool, int, doubleのいずれか
+type AttributeNameValue struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+	Type  string `yaml:"type"`
+}
+
+type NameStringValuePair struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+type PropagatorConfig struct {
+	Composite []string `yaml:"composite"`
+}
+
+type AttributeLimits struct {
+	AttributeValueLengthLimit *int `yaml:"attribute_value_length_limit"`
+	AttributeCountLimit       *int `yaml:"attribute_count_limit"`
+}
+
+type TracerProviderConfig struct {
+	Processors []SpanProcessorConfig `yaml:"processors"`
+	Limits     *SpanLimitsConfig     `yaml:"limits"`
+	Sampler    *SamplerConfig        `yaml:"sampler"`
+}
+
+type SpanProcessorConfig struct {
+	Batch  *BatchProcessorConfig  `yaml:"batch"`
+	Simple *SimpleProcessorConfig `yaml:"simple"`
+}
+
+// ミリ秒単位の値は仕様に合わせてintで持つ
+type BatchProcessorConfig struct {
+	ScheduleDelay      *int           `yaml:"schedule_delay"`
+	ExportTimeout      *int           `yaml:"export_timeout"`
+	MaxQueueSize       *int           `yaml:"max_queue_size"`
+	MaxExportBatchSize *int           `yaml:"max_export_batch_size"`
+	Exporter           ExporterConfig `yaml:"exporter"`
+}
+
+type SimpleProcessorConfig struct {
+	Exporter ExporterConfig `yaml:"exporter"`
+}
+
+// Jaegerは仕様にはないが、ローカルのcompose環境で使うので独自に追加している
+type ExporterConfig struct {
+	OTLP    *OTLPExporterConfig   `yaml:"otlp"`
+	Console *ConsoleConfig        `yaml:"console"`
+	Jaeger  *JaegerExporterConfig `yaml:"jaeger"`
+}
+
+type OTLPExporterConfig struct {
+	Protocol    string                `yaml:"protocol"`
+	Endpoint    string                `yaml:"endpoint"`
+	Headers     []NameStringValuePair `yaml:"headers"`
+	Compression string                `yaml:"compression"`
+	Timeout     *int                  `yaml:"timeout"`
+	Insecure    bool                  `yaml:"insecure"`
+}
+
+type ConsoleConfig struct{}
+
+type JaegerExporterConfig struct {
+	Endpoint string `yaml:"endpoint"`
+}
+
+// 省略した値はattribute_limits、それもなければSDKのデフォルト(値の長さは無制限、個数は128)になる
+type SpanLimitsConfig struct {
+	AttributeValueLengthLimit *int `yaml:"attribute_value_length_limit"`
+	AttributeCountLimit       *int `yaml:"attribute_count_limit"`
+	EventCountLimit           *int `yaml:"event_count_limit"`
+	LinkCountLimit            *int `yaml:"link_count_limit"`
+	EventAttributeCountLimit  *int `yaml:"event_attribute_count_limit"`
+	LinkAttributeCountLimit   *int `yaml:"link_attribute_count_limit"`
+}
+
+type SamplerConfig struct {
+	AlwaysOn          *struct{}                `yaml:"always_on"`
+	AlwaysOff         *struct{}                `yaml:"always_off"`
+	TraceIDRatioBased *TraceIDRatioBasedConfig `yaml:"trace_id_ratio_based"`
+	ParentBased       *ParentBasedConfig       `yaml:"parent_based"`
+}
+
+type TraceIDRatioBasedConfig struct {
+	Ratio *float64 `yaml:"ratio"`
+}
+
+type ParentBasedConfig struct {
+	Root                   *SamplerConfig `yaml:"root"`
+	RemoteParentSampled    *SamplerConfig `yaml:"remote_parent_sampled"`
+	RemoteParentNotSampled *SamplerConfig `yaml:"remote_parent_not_sampled"`
+	LocalParentSampled     *SamplerConfig `yaml:"local_parent_sampled"`
+	LocalParentNotSampled  *SamplerConfig `yaml:"local_parent_not_sampled"`
+}
+
+type MeterProviderConfig struct {
+	Readers []MetricReaderConfig `yaml:"readers"`
+	Views   []ViewConfig         `yaml:"views"`
+}
+
+type MetricReaderConfig struct {
+	Periodic *PeriodicReaderConfig `yaml:"periodic"`
+	Pull     *PullReaderConfig     `yaml:"pull"`
+}
+
+type PeriodicReaderConfig struct {
+	Interval *int           `yaml:"interval"`
+	Timeout  *int           `yaml:"timeout"`
+	Exporter ExporterConfig `yaml:"exporter"`
+}
+
+type PullReaderConfig struct {
+	Exporter PullExporterConfig `yaml:"exporter"`
+}
+
+type PullExporterConfig struct {
+	Prometheus *PrometheusExporterConfig `yaml:"prometheus"`
+}
+
+type PrometheusExporterConfig struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+}
+
+type ViewConfig struct {
+	Selector ViewSelectorConfig `yaml:"selector"`
+	Stream   ViewStreamConfig   `yaml:"stream"`
+}
+
+type ViewSelectorConfig struct {
+	InstrumentName string `yaml:"instrument_name"`
+	InstrumentType string `yaml:"instrument_type"`
+	Unit           string `yaml:"unit"`
+	MeterName      string `yaml:"meter_name"`
+	MeterVersion   string `yaml:"meter_version"`
+	MeterSchemaURL string `yaml:"meter_schema_url"`
+}
+
+type ViewStreamConfig struct {
+	Name          string               `yaml:"name"`
+	Description   string               `yaml:"description"`
+	Aggregation   *AggregationConfig   `yaml:"aggregation"`
+	AttributeKeys *AttributeKeysConfig `yaml:"attribute_keys"`
+}
+
+type AggregationConfig struct {
+	Default                 *struct{}                      `yaml:"default"`
+	Drop                    *struct{}                      `yaml:"drop"`
+	Sum                     *struct{}                      `yaml:"sum"`
+	LastValue               *struct{}                      `yaml:"last_value"`
+	ExplicitBucketHistogram *ExplicitBucketHistogramConfig `yaml:"explicit_bucket_histogram"`
+}
+
+type ExplicitBucketHistogramConfig struct {
+	Boundaries   []float64 `yaml:"boundaries"`
+	RecordMinMax *bool     `yaml:"record_min_max"`
+}
+
+type AttributeKeysConfig struct {
+	Included []string `yaml:"included"`
+	Excluded []string `yaml:"excluded"`
+}
+
+type LoggerProviderConfig struct {
+	Processors []LogRecordProcessorConfig `yaml:"processors"`
+	Limits     *LogRecordLimitsConfig     `yaml:"limits"`
+}
+
+type LogRecordProcessorConfig struct {
+	Batch  *BatchProcessorConfig  `yaml:"batch"`
+	Simple *SimpleProcessorConfig `yaml:"simple"`
+}
+
+type LogRecordLimitsConfig struct {
+	AttributeValueLengthLimit *int `yaml:"attribute_value_length_limit"`
+	AttributeCountLimit       *int `yaml:"attribute_count_limit"`
+}
+
+// ProfilingConfig
+// 設定するとspanの間goroutineにpprofのラベルを付ける
+type ProfilingConfig struct {
+	// 管理用のpprofエンドポイントのアドレス。省略すると立てない
+	AdminEndpoint string `yaml:"admin_endpoint"`
+	// spanがこのミリ秒を超えたらCPUプロファイルを取る。省略すると取らない
+	SlowSpanThreshold  *int   `yaml:"slow_span_threshold"`
+	CPUProfileDuration *int   `yaml:"cpu_profile_duration"`
+	Directory          string `yaml:"directory"`
+}
+
+// ConfigError
+// 設定ファイルのどこが悪いのかをファイル名と行番号で示すエラー
+type ConfigError struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+}
+
+func nodeError(n *yaml.Node, format string, args ...any) *ConfigError {
+	return &ConfigError{Line: n.Line, Column: n.Column, Msg: fmt.Sprintf(format, args...)}
+}
+
+// LoadConfig 設定ファイルを読み込み、環境変数の置換とスキーマの検証を行う
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseConfig(b)
+	if err != nil {
+		var cerr *ConfigError
+		if errors.As(err, &cerr) {
+			cerr.File = path
+			return nil, cerr
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ParseConfig YAMLをConfigに変換する
+// 返すエラーの*ConfigErrorにはファイル名が入らないので、必要なら呼び出し側で埋める
+func ParseConfig(b []byte) (*Config, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, &ConfigError{Line: 1, Column: 1, Msg: "empty configuration"}
+	}
+	root := doc.Content[0]
+
+	// 置換はスカラー値に対してだけ行う。YAMLの構造そのものを環境変数で差し込めないようにするため
+	if err := substituteEnv(root); err != nil {
+		return nil, err
+	}
+	if err := checkFields(root, reflect.TypeOf(Config{})); err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := root.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateConfig(root, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// ${VAR}, ${env:VAR}, ${VAR:-default} を置換する。$$はエスケープとして$になる
+var envRef = regexp.MustCompile(`\$\$|\$\{(?:env:)?([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+func substituteEnv(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		if !strings.Contains(n.Value, "$") {
+			return nil
+		}
+		// 置換できる参照と$$を除いても${が残れば、閉じていないなど不正な参照
+		if strings.Contains(envRef.ReplaceAllString(n.Value, ""), "${") {
+			return nodeError(n, "invalid environment variable reference %q", n.Value)
+		}
+		replaced := envRef.ReplaceAllStringFunc(n.Value, func(m string) string {
+			if m == "$$" {
+				return "$"
+			}
+			sub := envRef.FindStringSubmatch(m)
+			if v, ok := os.LookupEnv(sub[1]); ok && v != "" {
+				return v
+			}
+			return sub[2]
+		})
+		n.Value = replaced
+		// 置換後の値でboolや数値として解釈し直せるよう、タグをリセットする
+		if n.Style == 0 {
+			n.Tag = ""
+		}
+		return nil
+	}
+	for _, c := range n.Content {
+		if err := substituteEnv(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFields 構造体に存在しないキーを行番号付きで報告する
+func checkFields(n *yaml.Node, t reflect.Type) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		// `console:`や`always_on:`のように値を省略した場合も設定されたものとして扱う
+		if n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+			n.Kind, n.Tag, n.Value = yaml.MappingNode, "!!map", ""
+		}
+		if n.Kind != yaml.MappingNode {
+			return nodeError(n, "expected a mapping")
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			fields[name] = f.Type
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			ft, ok := fields[k.Value]
+			if !ok {
+				return nodeError(k, "unknown field %q", k.Value)
+			}
+			if err := checkFields(v, ft); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			if n.Tag == "!!null" {
+				return nil
+			}
+			return nodeError(n, "expected a sequence")
+		}
+		for _, c := range n.Content {
+			if err := checkFields(c, t.Elem()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lookup マッピングノードからキーのノードを探す。見つからなければnを返す
+func lookup(n *yaml.Node, path ...any) *yaml.Node {
+	cur := n
+	for _, p := range path {
+		switch key := p.(type) {
+		case string:
+			if cur.Kind != yaml.MappingNode {
+				return cur
+			}
+			found := false
+			for i := 0; i+1 < len(cur.Content); i += 2 {
+				if cur.Content[i].Value == key {
+					cur = cur.Content[i+1]
+					found = true
+					break
+				}
+			}
+			if !found {
+				return cur
+			}
+		case int:
+			if cur.Kind != yaml.SequenceNode || key >= len(cur.Content) {
+				return cur
+			}
+			cur = cur.Content[key]
+		}
+	}
+	return cur
+}
+
+func validateConfig(root *yaml.Node, cfg *Config) error {
+	if cfg.FileFormat == "" {
+		return nodeError(root, "file_format is required")
+	}
+	if cfg.FileFormat != supportedFileFormat {
+		return nodeError(lookup(root, "file_format"), "unsupported file_format %q (supported: %q)", cfg.FileFormat, supportedFileFormat)
+	}
+	if cfg.Resource != nil {
+		for i, a := range cfg.Resource.Attributes {
+			an := lookup(root, "resource", "attributes", i)
+			if a.Name == "" {
+				return nodeError(an, "attribute name is required")
+			}
+			if _, err := attributeValue(a); err != nil {
+				return nodeError(lookup(an, "value"), "%v", err)
+			}
+		}
+	}
+	if cfg.Propagator != nil {
+		for i, p := range cfg.Propagator.Composite {
+			switch p {
+			case "tracecontext", "baggage":
+			default:
+				return nodeError(lookup(root, "propagator", "composite", i), "unsupported propagator %q", p)
+			}
+		}
+	}
+	if tp := cfg.TracerProvider; tp != nil {
+		n := lookup(root, "tracer_provider")
+		for i, p := range tp.Processors {
+			pn := lookup(n, "processors", i)
+			if err := validateProcessor(pn, "traces", p.Batch, p.Simple); err != nil {
+				return err
+			}
+		}
+		if tp.Sampler != nil {
+			if err := validateSampler(lookup(n, "sampler"), tp.Sampler); err != nil {
+				return err
+			}
+		}
+	}
+	if mp := cfg.MeterProvider; mp != nil {
+		n := lookup(root, "meter_provider")
+		for i, r := range mp.Readers {
+			rn := lookup(n, "readers", i)
+			switch {
+			case r.Periodic != nil && r.Pull != nil, r.Periodic == nil && r.Pull == nil:
+				return nodeError(rn, "reader must have exactly one of periodic or pull")
+			case r.Periodic != nil:
+				if err := validateExporter(lookup(rn, "periodic", "exporter"), "metrics", &r.Periodic.Exporter); err != nil {
+					return err
+				}
+			case r.Pull.Exporter.Prometheus == nil:
+				return nodeError(lookup(rn, "pull", "exporter"), "pull reader requires a prometheus exporter")
+			}
+		}
+		for i, v := range mp.Views {
+			vn := lookup(n, "views", i)
+			switch v.Selector.InstrumentType {
+			case "", "counter", "histogram", "observable_counter", "observable_gauge", "observable_up_down_counter", "up_down_counter", "gauge":
+			default:
+				return nodeError(lookup(vn, "selector", "instrument_type"), "unknown instrument_type %q", v.Selector.InstrumentType)
+			}
+			if a := v.Stream.Aggregation; a != nil && countSet(a.Default, a.Drop, a.Sum, a.LastValue, a.ExplicitBucketHistogram) != 1 {
+				return nodeError(lookup(vn, "stream", "aggregation"), "aggregation must have exactly one type")
+			}
+		}
+	}
+	if lp := cfg.LoggerProvider; lp != nil {
+		n := lookup(root, "logger_provider")
+		for i, p := range lp.Processors {
+			if err := validateProcessor(lookup(n, "processors", i), "logs", p.Batch, p.Simple); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateProcessor(n *yaml.Node, signal string, batch *BatchProcessorConfig, simple *SimpleProcessorConfig) error {
+	switch {
+	case batch != nil && simple != nil, batch == nil && simple == nil:
+		return nodeError(n, "processor must have exactly one of batch or simple")
+	case batch != nil:
+		return validateExporter(lookup(n, "batch", "exporter"), signal, &batch.Exporter)
+	default:
+		return validateExporter(lookup(n, "simple", "exporter"), signal, &simple.Exporter)
+	}
+}
+
+func validateExporter(n *yaml.Node, signal string, e *ExporterConfig) error {
+	if countSet(e.OTLP, e.Console, e.Jaeger) != 1 {
+		return nodeError(n, "exporter must have exactly one of otlp, console or jaeger")
+	}
+	if e.Jaeger != nil && signal != "traces" {
+		return nodeError(lookup(n, "jaeger"), "jaeger exporter does not support %s", signal)
+	}
+	if e.OTLP != nil {
+		switch e.OTLP.Protocol {
+		case "grpc", "http/protobuf":
+		default:
+			return nodeError(lookup(n, "otlp", "protocol"), "unsupported otlp protocol %q (grpc or http/protobuf)", e.OTLP.Protocol)
+		}
+		switch e.OTLP.Compression {
+		case "", "none", "gzip":
+		default:
+			return nodeError(lookup(n, "otlp", "compression"), "unsupported compression %q", e.OTLP.Compression)
+		}
+	}
+	return nil
+}
+
+func validateSampler(n *yaml.Node, s *SamplerConfig) error {
+	if countSet(s.AlwaysOn, s.AlwaysOff, s.TraceIDRatioBased, s.ParentBased) != 1 {
+		return nodeError(n, "sampler must have exactly one of always_on, always_off, trace_id_ratio_based or parent_based")
+	}
+	if r := s.TraceIDRatioBased; r != nil && r.Ratio != nil && (*r.Ratio < 0 || *r.Ratio > 1) {
+		return nodeError(lookup(n, "trace_id_ratio_based", "ratio"), "ratio must be between 0 and 1")
+	}
+	if pb := s.ParentBased; pb != nil {
+		children := map[string]*SamplerConfig{
+			"root":                      pb.Root,
+			"remote_parent_sampled":     pb.RemoteParentSampled,
+			"remote_parent_not_sampled": pb.RemoteParentNotSampled,
+			"local_parent_sampled":      pb.LocalParentSampled,
+			"local_parent_not_sampled":  pb.LocalParentNotSampled,
+		}
+		for key, c := range children {
+			if c == nil {
+				continue
+			}
+			if err := validateSampler(lookup(n, "parent_based", key), c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func countSet(vs ...any) int {
+	n := 0
+	for _, v := range vs {
+		if !reflect.ValueOf(v).IsNil() {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,132 @@
+package otel
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseConfigErrorPosition(t *testing.T) {
+	tests := []struct {
+		name   string
+		yaml   string
+		line   int
+		column int
+		msg    string
+	}{
+		{
+			name: "unknown top-level field",
+			yaml: `file_format: "0.3"
+tracer_provder:
+  processors: []
+`,
+			line: 2, column: 1,
+			msg: `unknown field "tracer_provder"`,
+		},
+		{
+			name: "unknown nested field",
+			yaml: `file_format: "0.3"
+tracer_provider:
+  processors:
+    - batch:
+        exportr:
+          console:
+`,
+			line: 5, column: 9,
+			msg: `unknown field "exportr"`,
+		},
+		{
+			name: "unterminated environment variable reference",
+			yaml: `file_format: "0.3"
+resource:
+  attributes:
+    - name: environment
+      value: ${ENVIRONMENT
+`,
+			line: 5, column: 14,
+			msg: `invalid environment variable reference "${ENVIRONMENT"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(tt.yaml))
+			var cerr *ConfigError
+			if !errors.As(err, &cerr) {
+				t.Fatalf("ParseConfig error = %v, want *ConfigError", err)
+			}
+			if cerr.Line != tt.line || cerr.Column != tt.column || cerr.Msg != tt.msg {
+				t.Errorf("ParseConfig error = %d:%d: %s, want %d:%d: %s",
+					cerr.Line, cerr.Column, cerr.Msg, tt.line, tt.column, tt.msg)
+			}
+		})
+	}
+}
+
+func TestParseConfigSubstituteEnv(t *testing.T) {
+	const yaml = `file_format: "0.3"
+resource:
+  attributes:
+    - name: environment
+      value: ${OTEL_TEST_ENVIRONMENT:-local}
+    - name: region
+      value: ${env:OTEL_TEST_REGION}
+    - name: price
+      value: $${NOT_SUBSTITUTED}
+attribute_limits:
+  attribute_count_limit: ${OTEL_TEST_COUNT_LIMIT:-64}
+`
+	tests := []struct {
+		name        string
+		env         map[string]string
+		environment string
+		region      string
+		countLimit  int
+	}{
+		{
+			name:        "defaults",
+			environment: "local",
+			countLimit:  64,
+		},
+		{
+			name: "from env",
+			env: map[string]string{
+				"OTEL_TEST_ENVIRONMENT": "production",
+				"OTEL_TEST_REGION":      "ap-northeast-1",
+				"OTEL_TEST_COUNT_LIMIT": "128",
+			},
+			environment: "production",
+			region:      "ap-northeast-1",
+			countLimit:  128,
+		},
+		{
+			// 空の値は未設定と同じく扱う
+			name:        "empty env",
+			env:         map[string]string{"OTEL_TEST_ENVIRONMENT": ""},
+			environment: "local",
+			countLimit:  64,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"OTEL_TEST_ENVIRONMENT", "OTEL_TEST_REGION", "OTEL_TEST_COUNT_LIMIT"} {
+				t.Setenv(k, tt.env[k])
+			}
+			cfg, err := ParseConfig([]byte(yaml))
+			if err != nil {
+				t.Fatalf("ParseConfig: %v", err)
+			}
+			got := map[string]string{}
+			for _, a := range cfg.Resource.Attributes {
+				got[a.Name] = a.Value
+			}
+			if got["environment"] != tt.environment || got["region"] != tt.region {
+				t.Errorf("environment = %q, region = %q, want %q, %q", got["environment"], got["region"], tt.environment, tt.region)
+			}
+			if got["price"] != "${NOT_SUBSTITUTED}" {
+				t.Errorf("price = %q, want the escaped reference", got["price"])
+			}
+			if l := cfg.AttributeLimits.AttributeCountLimit; l == nil || *l != tt.countLimit {
+				t.Errorf("attribute_count_limit = %v, want %d", l, tt.countLimit)
+			}
+		})
+	}
+}
@@ -0,0 +1,378 @@
+package otel
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 環境変数による設定
+// https://opentelemetry.io/docs/specs/otel/configuration/sdk-environment-variables/
+// 設定ファイルがない場合は、仕様で定められたOTEL_*の環境変数からConfigを組み立てる。
+// 不正な値は仕様どおり警告を出して無視する。
+
+// 以前使っていた独自の環境変数。互換性のために残しているが非推奨
+const (
+	deprecatedExporterProtocolEnv = "OTEL_EXPORTER_PROTOCOL"
+	deprecatedOTLPEndpointEnv     = "OTLP_ENDPOINT"
+)
+
+// ConfigFromEnv 環境変数からConfigを組み立てる
+func ConfigFromEnv() *Config {
+	cfg := &Config{
+		FileFormat: supportedFileFormat,
+		Disabled:   envBool("OTEL_SDK_DISABLED"),
+		Resource:   resourceFromEnv(),
+		Propagator: propagatorFromEnv(),
+		AttributeLimits: &AttributeLimits{
+			AttributeValueLengthLimit: envInt("OTEL_ATTRIBUTE_VALUE_LENGTH_LIMIT"),
+			AttributeCountLimit:       envInt("OTEL_ATTRIBUTE_COUNT_LIMIT"),
+		},
+		Profiling:             profilingFromEnv(),
+		BaggageSpanAttributes: baggageSpanAttributesFromEnv(),
+	}
+
+	tracesExporter, legacyProtocol := tracesExporterFromEnv()
+	if exporters := exportersFromEnv("traces", tracesExporter, legacyProtocol); len(exporters) > 0 {
+		cfg.TracerProvider = &TracerProviderConfig{
+			Sampler: samplerFromEnv(),
+			Limits: &SpanLimitsConfig{
+				AttributeValueLengthLimit: envInt("OTEL_SPAN_ATTRIBUTE_VALUE_LENGTH_LIMIT"),
+				AttributeCountLimit:       envInt("OTEL_SPAN_ATTRIBUTE_COUNT_LIMIT"),
+				EventCountLimit:           envInt("OTEL_SPAN_EVENT_COUNT_LIMIT"),
+				LinkCountLimit:            envInt("OTEL_SPAN_LINK_COUNT_LIMIT"),
+				EventAttributeCountLimit:  envInt("OTEL_EVENT_ATTRIBUTE_COUNT_LIMIT"),
+				LinkAttributeCountLimit:   envInt("OTEL_LINK_ATTRIBUTE_COUNT_LIMIT"),
+			},
+		}
+		for _, e := range exporters {
+			cfg.TracerProvider.Processors = append(cfg.TracerProvider.Processors, SpanProcessorConfig{
+				Batch: batchFromEnv("OTEL_BSP", e),
+			})
+		}
+	}
+
+	if exporters := exportersFromEnv("metrics", envOr("OTEL_METRICS_EXPORTER", "otlp"), ""); len(exporters) > 0 {
+		cfg.MeterProvider = &MeterProviderConfig{}
+		for _, e := range exporters {
+			cfg.MeterProvider.Readers = append(cfg.MeterProvider.Readers, metricReaderFromEnv(e))
+		}
+	}
+
+	if exporters := exportersFromEnv("logs", envOr("OTEL_LOGS_EXPORTER", "otlp"), ""); len(exporters) > 0 {
+		cfg.LoggerProvider = &LoggerProviderConfig{}
+		for _, e := range exporters {
+			cfg.LoggerProvider.Processors = append(cfg.LoggerProvider.Processors, LogRecordProcessorConfig{
+				Batch: batchFromEnv("OTEL_BLRP", e),
+			})
+		}
+	}
+	return cfg
+}
+
+// 以前のOTEL_EXPORTER_PROTOCOLはOTEL_TRACES_EXPORTERがない場合だけ使う
+func tracesExporterFromEnv() (exporter, protocol string) {
+	if v := os.Getenv("OTEL_TRACES_EXPORTER"); v != "" {
+		return v, ""
+	}
+	legacy := os.Getenv(deprecatedExporterProtocolEnv)
+	if legacy == "" {
+		return "otlp", ""
+	}
+	log.Printf("%s is deprecated, use OTEL_TRACES_EXPORTER and OTEL_EXPORTER_OTLP_PROTOCOL instead", deprecatedExporterProtocolEnv)
+	switch legacy {
+	case "http":
+		return "otlp", "http/protobuf"
+	case "grpc":
+		return "otlp", "grpc"
+	case "jaeger":
+		return "jaeger", ""
+	default:
+		return "console", ""
+	}
+}
+
+// OTEL_{TRACES,METRICS,LOGS}_EXPORTERはカンマ区切りで複数指定できる
+func exportersFromEnv(signal, names, legacyProtocol string) []ExporterConfig {
+	var exporters []ExporterConfig
+	for _, name := range strings.Split(names, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "none":
+			return nil
+		case "otlp":
+			exporters = append(exporters, ExporterConfig{OTLP: otlpFromEnv(signal, legacyProtocol)})
+		case "console":
+			exporters = append(exporters, ExporterConfig{Console: &ConsoleConfig{}})
+		case "jaeger":
+			if signal != "traces" {
+				log.Printf("OTEL_%s_EXPORTER: jaeger is not supported, ignored", strings.ToUpper(signal))
+				continue
+			}
+			exporters = append(exporters, ExporterConfig{Jaeger: &JaegerExporterConfig{}})
+		case "prometheus":
+			if signal != "metrics" {
+				log.Printf("OTEL_%s_EXPORTER: prometheus is not supported, ignored", strings.ToUpper(signal))
+				continue
+			}
+			// pull型なのでmetricReaderFromEnvで扱う
+			exporters = append(exporters, ExporterConfig{})
+		default:
+			log.Printf("OTEL_%s_EXPORTER: unknown exporter %q, ignored", strings.ToUpper(signal), name)
+		}
+	}
+	return exporters
+}
+
+// シグナル固有の変数(OTEL_EXPORTER_OTLP_TRACES_*)があればそちらを優先する
+func otlpFromEnv(signal, legacyProtocol string) *OTLPExporterConfig {
+	s := strings.ToUpper(signal)
+	get := func(name string) string {
+		if v := os.Getenv("OTEL_EXPORTER_OTLP_" + s + "_" + name); v != "" {
+			return v
+		}
+		return os.Getenv("OTEL_EXPORTER_OTLP_" + name)
+	}
+
+	protocol := get("PROTOCOL")
+	if protocol == "" {
+		protocol = legacyProtocol
+	}
+	switch protocol {
+	case "":
+		protocol = "http/protobuf"
+	case "grpc", "http/protobuf":
+	default:
+		log.Printf("OTEL_EXPORTER_OTLP_PROTOCOL: unsupported protocol %q, using http/protobuf", protocol)
+		protocol = "http/protobuf"
+	}
+
+	c := &OTLPExporterConfig{
+		Protocol:    protocol,
+		Compression: get("COMPRESSION"),
+		Headers:     headersFromEnv(get("HEADERS")),
+		Timeout:     envInt("OTEL_EXPORTER_OTLP_" + s + "_TIMEOUT"),
+		Insecure:    strings.EqualFold(get("INSECURE"), "true"),
+	}
+	if c.Timeout == nil {
+		c.Timeout = envInt("OTEL_EXPORTER_OTLP_TIMEOUT")
+	}
+	if c.Compression != "" && c.Compression != "gzip" && c.Compression != "none" {
+		log.Printf("OTEL_EXPORTER_OTLP_COMPRESSION: unsupported compression %q, ignored", c.Compression)
+		c.Compression = ""
+	}
+
+	// シグナル固有のエンドポイントはそのまま使い、共通のエンドポイントにはHTTPの場合だけパスを足す
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_" + s + "_ENDPOINT"); v != "" {
+		c.Endpoint = v
+		return c
+	}
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if endpoint == "" {
+		if endpoint = os.Getenv(deprecatedOTLPEndpointEnv); endpoint != "" {
+			log.Printf("%s is deprecated, use OTEL_EXPORTER_OTLP_ENDPOINT instead", deprecatedOTLPEndpointEnv)
+			if !strings.Contains(endpoint, "://") {
+				endpoint = "http://" + endpoint
+			}
+		}
+	}
+	if endpoint != "" && protocol == "http/protobuf" {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/" + signal
+	}
+	c.Endpoint = endpoint
+	return c
+}
+
+func batchFromEnv(prefix string, e ExporterConfig) *BatchProcessorConfig {
+	return &BatchProcessorConfig{
+		ScheduleDelay:      envInt(prefix + "_SCHEDULE_DELAY"),
+		ExportTimeout:      envInt(prefix + "_EXPORT_TIMEOUT"),
+		MaxQueueSize:       envInt(prefix + "_MAX_QUEUE_SIZE"),
+		MaxExportBatchSize: envInt(prefix + "_MAX_EXPORT_BATCH_SIZE"),
+		Exporter:           e,
+	}
+}
+
+func metricReaderFromEnv(e ExporterConfig) MetricReaderConfig {
+	if e.OTLP == nil && e.Console == nil {
+		port := 9464
+		if p := envInt("OTEL_EXPORTER_PROMETHEUS_PORT"); p != nil {
+			port = *p
+		}
+		return MetricReaderConfig{Pull: &PullReaderConfig{Exporter: PullExporterConfig{
+			Prometheus: &PrometheusExporterConfig{
+				Host: envOr("OTEL_EXPORTER_PROMETHEUS_HOST", "localhost"),
+				Port: port,
+			},
+		}}}
+	}
+	return MetricReaderConfig{Periodic: &PeriodicReaderConfig{
+		Interval: envInt("OTEL_METRIC_EXPORT_INTERVAL"),
+		Timeout:  envInt("OTEL_METRIC_EXPORT_TIMEOUT"),
+		Exporter: e,
+	}}
+}
+
+// OTEL_SERVICE_NAMEはOTEL_RESOURCE_ATTRIBUTESのservice.nameより優先される
+func resourceFromEnv() *ResourceConfig {
+	attrs := []AttributeNameValue{
+		{Name: "service.version", Value: "1.0.0"},
+		{Name: "environment", Value: "local"},
+	}
+	set := func(name, value string) {
+		for i := range attrs {
+			if attrs[i].Name == name {
+				attrs[i].Value = value
+				return
+			}
+		}
+		attrs = append(attrs, AttributeNameValue{Name: name, Value: value})
+	}
+
+	for _, kv := range splitList(os.Getenv("OTEL_RESOURCE_ATTRIBUTES")) {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			log.Printf("OTEL_RESOURCE_ATTRIBUTES: invalid entry %q, ignored", kv)
+			continue
+		}
+		if dv, err := url.PathUnescape(strings.TrimSpace(v)); err == nil {
+			v = dv
+		}
+		set(strings.TrimSpace(k), v)
+	}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		set("service.name", name)
+	}
+	return &ResourceConfig{Attributes: attrs}
+}
+
+func propagatorFromEnv() *PropagatorConfig {
+	c := &PropagatorConfig{}
+	for _, p := range splitList(os.Getenv("OTEL_PROPAGATORS")) {
+		switch p {
+		case "tracecontext", "baggage":
+			c.Composite = append(c.Composite, p)
+		case "none":
+			return &PropagatorConfig{Composite: []string{}}
+		default:
+			log.Printf("OTEL_PROPAGATORS: unsupported propagator %q, ignored", p)
+		}
+	}
+	return c
+}
+
+func samplerFromEnv() *SamplerConfig {
+	ratio := func() *TraceIDRatioBasedConfig {
+		v := os.Getenv("OTEL_TRACES_SAMPLER_ARG")
+		if v == "" {
+			return &TraceIDRatioBasedConfig{}
+		}
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r < 0 || r > 1 {
+			log.Printf("OTEL_TRACES_SAMPLER_ARG: invalid ratio %q, ignored", v)
+			return &TraceIDRatioBasedConfig{}
+		}
+		return &TraceIDRatioBasedConfig{Ratio: &r}
+	}
+	switch v := os.Getenv("OTEL_TRACES_SAMPLER"); v {
+	case "":
+		return nil
+	case "always_on":
+		return &SamplerConfig{AlwaysOn: &struct{}{}}
+	case "always_off":
+		return &SamplerConfig{AlwaysOff: &struct{}{}}
+	case "traceidratio":
+		return &SamplerConfig{TraceIDRatioBased: ratio()}
+	case "parentbased_always_on":
+		return &SamplerConfig{ParentBased: &ParentBasedConfig{Root: &SamplerConfig{AlwaysOn: &struct{}{}}}}
+	case "parentbased_always_off":
+		return &SamplerConfig{ParentBased: &ParentBasedConfig{Root: &SamplerConfig{AlwaysOff: &struct{}{}}}}
+	case "parentbased_traceidratio":
+		return &SamplerConfig{ParentBased: &ParentBasedConfig{Root: &SamplerConfig{TraceIDRatioBased: ratio()}}}
+	default:
+		log.Printf("OTEL_TRACES_SAMPLER: unsupported sampler %q, ignored", v)
+		return nil
+	}
+}
+
+// プロファイリングは仕様外なので独自のPPROF_*で設定する
+func profilingFromEnv() *ProfilingConfig {
+	if !envBool("PPROF_ENABLED") {
+		return nil
+	}
+	return &ProfilingConfig{
+		AdminEndpoint:      os.Getenv("PPROF_ADDR"),
+		SlowSpanThreshold:  envInt("PPROF_SLOW_SPAN_THRESHOLD"),
+		CPUProfileDuration: envInt("PPROF_CPU_PROFILE_DURATION"),
+		Directory:          os.Getenv("PPROF_PROFILE_DIR"),
+	}
+}
+
+// 仕様外なので独自のBAGGAGE_SPAN_ATTRIBUTESで設定する。カンマ区切りのキー
+func baggageSpanAttributesFromEnv() []string {
+	return splitList(os.Getenv("BAGGAGE_SPAN_ATTRIBUTES"))
+}
+
+// key1=value1,key2=value2 の形式。値はURLエンコードされている
+func headersFromEnv(v string) []NameStringValuePair {
+	var hs []NameStringValuePair
+	for _, kv := range splitList(v) {
+		k, val, ok := strings.Cut(kv, "=")
+		if !ok {
+			log.Printf("OTEL_EXPORTER_OTLP_HEADERS: invalid entry %q, ignored", kv)
+			continue
+		}
+		if dk, err := url.PathUnescape(strings.TrimSpace(k)); err == nil {
+			k = dk
+		}
+		if dv, err := url.PathUnescape(strings.TrimSpace(val)); err == nil {
+			val = dv
+		}
+		hs = append(hs, NameStringValuePair{Name: k, Value: val})
+	}
+	return hs
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envBool(key string) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("%s: invalid boolean %q, ignored", key, v)
+		return false
+	}
+	return b
+}
+
+func envInt(key string) *int {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Printf("%s: invalid integer %q, ignored", key, v)
+		return nil
+	}
+	return &n
+}
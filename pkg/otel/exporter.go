@@ -3,14 +3,20 @@ package otel
 import (
 	"context"
 	"io"
+	"os"
+	"time"
 
 	"go.opentelemetry.io/otel/exporters/jaeger"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
-	"go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutlog"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
 	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
 	"go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/trace"
 )
@@ -20,24 +26,7 @@ import (
 // OTLPエンドポイントに送信するには、エンドポイントに送信するエクスポータを設定する必要がある。
 // バイナリprotobufペイロードを持つHTTPを使用するOTLPメトリクス・エクスポーターの実装が含まれている。
 
-// トレースのエクスポーター(http)
-func newTracesHttpExporter(ctx context.Context) (trace.SpanExporter, error) {
-	// endpointOpt := otlptracehttp.WithEndpoint(otlpEndpoint) // エンドポイントがデフォルト(localhost:4318)の場合は不要
-	return otlptracehttp.New(ctx, otlptracehttp.WithInsecure())
-}
-
-// トレースのエクスポーター(grpc)
-func newTracesGrpcExporter(ctx context.Context) (trace.SpanExporter, error) {
-	// endpointOpt := otlptracegrpc.WithEndpoint(otlpEndpoint) // エンドポイントがデフォルト(localhost:4317)の場合は不要
-	return otlptracegrpc.New(ctx, otlptracegrpc.WithInsecure())
-}
-
-// トレースのエクスポーター(jaeger)
-func newTracesJaegerExporter() (trace.SpanExporter, error) {
-	return jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint("http://jaeger:14268/api/traces")))
-}
-
-// トレースのエクスポーター(jaeger)
+// トレースのエクスポーター(stdout)
 func newTracesWriterExporter(w io.Writer) (trace.SpanExporter, error) {
 	return stdouttrace.New(
 		stdouttrace.WithWriter(w),
@@ -45,19 +34,152 @@ func newTracesWriterExporter(w io.Writer) (trace.SpanExporter, error) {
 	)
 }
 
-// メトリクスのエクスポーター(http)
-func newMetricHttpExporter(ctx context.Context) (metric.Exporter, error) {
-	return otlpmetrichttp.New(ctx)
+// 設定ファイルのexporterからトレースのエクスポーターを作る
+func newSpanExporterFromConfig(ctx context.Context, c ExporterConfig) (trace.SpanExporter, error) {
+	switch {
+	case c.OTLP != nil && c.OTLP.Protocol == "grpc":
+		opts := []otlptracegrpc.Option{}
+		if c.OTLP.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpointURL(c.OTLP.Endpoint))
+		}
+		if c.OTLP.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		if len(c.OTLP.Headers) > 0 {
+			opts = append(opts, otlptracegrpc.WithHeaders(headerMap(c.OTLP.Headers)))
+		}
+		if c.OTLP.Compression == "gzip" {
+			opts = append(opts, otlptracegrpc.WithCompressor("gzip"))
+		}
+		if c.OTLP.Timeout != nil {
+			opts = append(opts, otlptracegrpc.WithTimeout(millis(*c.OTLP.Timeout)))
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case c.OTLP != nil:
+		opts := []otlptracehttp.Option{}
+		if c.OTLP.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(c.OTLP.Endpoint))
+		}
+		if c.OTLP.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(c.OTLP.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(headerMap(c.OTLP.Headers)))
+		}
+		if c.OTLP.Compression == "gzip" {
+			opts = append(opts, otlptracehttp.WithCompression(otlptracehttp.GzipCompression))
+		}
+		if c.OTLP.Timeout != nil {
+			opts = append(opts, otlptracehttp.WithTimeout(millis(*c.OTLP.Timeout)))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	case c.Jaeger != nil:
+		endpoint := c.Jaeger.Endpoint
+		if endpoint == "" {
+			endpoint = "http://jaeger:14268/api/traces"
+		}
+		return jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(endpoint)))
+	default:
+		return newTracesWriterExporter(os.Stdout)
+	}
+}
+
+// 設定ファイルのexporterからメトリクスのエクスポーターを作る
+func newMetricExporterFromConfig(ctx context.Context, c ExporterConfig) (metric.Exporter, error) {
+	switch {
+	case c.OTLP != nil && c.OTLP.Protocol == "grpc":
+		opts := []otlpmetricgrpc.Option{}
+		if c.OTLP.Endpoint != "" {
+			opts = append(opts, otlpmetricgrpc.WithEndpointURL(c.OTLP.Endpoint))
+		}
+		if c.OTLP.Insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		}
+		if len(c.OTLP.Headers) > 0 {
+			opts = append(opts, otlpmetricgrpc.WithHeaders(headerMap(c.OTLP.Headers)))
+		}
+		if c.OTLP.Compression == "gzip" {
+			opts = append(opts, otlpmetricgrpc.WithCompressor("gzip"))
+		}
+		if c.OTLP.Timeout != nil {
+			opts = append(opts, otlpmetricgrpc.WithTimeout(millis(*c.OTLP.Timeout)))
+		}
+		return otlpmetricgrpc.New(ctx, opts...)
+	case c.OTLP != nil:
+		opts := []otlpmetrichttp.Option{}
+		if c.OTLP.Endpoint != "" {
+			opts = append(opts, otlpmetrichttp.WithEndpointURL(c.OTLP.Endpoint))
+		}
+		if c.OTLP.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		if len(c.OTLP.Headers) > 0 {
+			opts = append(opts, otlpmetrichttp.WithHeaders(headerMap(c.OTLP.Headers)))
+		}
+		if c.OTLP.Compression == "gzip" {
+			opts = append(opts, otlpmetrichttp.WithCompression(otlpmetrichttp.GzipCompression))
+		}
+		if c.OTLP.Timeout != nil {
+			opts = append(opts, otlpmetrichttp.WithTimeout(millis(*c.OTLP.Timeout)))
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	default:
+		return stdoutmetric.New(stdoutmetric.WithWriter(os.Stdout))
+	}
+}
+
+// 設定ファイルのexporterからログのエクスポーターを作る
+func newLogExporterFromConfig(ctx context.Context, c ExporterConfig) (sdklog.Exporter, error) {
+	switch {
+	case c.OTLP != nil && c.OTLP.Protocol == "grpc":
+		opts := []otlploggrpc.Option{}
+		if c.OTLP.Endpoint != "" {
+			opts = append(opts, otlploggrpc.WithEndpointURL(c.OTLP.Endpoint))
+		}
+		if c.OTLP.Insecure {
+			opts = append(opts, otlploggrpc.WithInsecure())
+		}
+		if len(c.OTLP.Headers) > 0 {
+			opts = append(opts, otlploggrpc.WithHeaders(headerMap(c.OTLP.Headers)))
+		}
+		if c.OTLP.Compression == "gzip" {
+			opts = append(opts, otlploggrpc.WithCompressor("gzip"))
+		}
+		if c.OTLP.Timeout != nil {
+			opts = append(opts, otlploggrpc.WithTimeout(millis(*c.OTLP.Timeout)))
+		}
+		return otlploggrpc.New(ctx, opts...)
+	case c.OTLP != nil:
+		opts := []otlploghttp.Option{}
+		if c.OTLP.Endpoint != "" {
+			opts = append(opts, otlploghttp.WithEndpointURL(c.OTLP.Endpoint))
+		}
+		if c.OTLP.Insecure {
+			opts = append(opts, otlploghttp.WithInsecure())
+		}
+		if len(c.OTLP.Headers) > 0 {
+			opts = append(opts, otlploghttp.WithHeaders(headerMap(c.OTLP.Headers)))
+		}
+		if c.OTLP.Compression == "gzip" {
+			opts = append(opts, otlploghttp.WithCompression(otlploghttp.GzipCompression))
+		}
+		if c.OTLP.Timeout != nil {
+			opts = append(opts, otlploghttp.WithTimeout(millis(*c.OTLP.Timeout)))
+		}
+		return otlploghttp.New(ctx, opts...)
+	default:
+		return stdoutlog.New(stdoutlog.WithWriter(os.Stdout))
+	}
 }
 
-// メトリクスのエクスポーター(grpc)
-func newMetricGrpcExporter(ctx context.Context) (metric.Exporter, error) {
-	return otlpmetricgrpc.New(ctx)
+func headerMap(hs []NameStringValuePair) map[string]string {
+	m := make(map[string]string, len(hs))
+	for _, h := range hs {
+		m[h.Name] = h.Value
+	}
+	return m
 }
 
-// Prometheus メトリクスのエクスポーター
-// プロメテウス・エクスポーターの使い方については以下を参照
-// https://github.com/open-telemetry/opentelemetry-go/tree/main/example/prometheus
-func newMetricPrometheusExporter(ctx context.Context) (metric.Reader, error) {
-	return prometheus.New()
+func millis(ms int) time.Duration {
+	return time.Duration(ms) * time.Millisecond
 }
@@ -0,0 +1,58 @@
+package otel
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/sdk/trace"
+)
+
+// span limitsで切り捨てられた属性、イベント、リンクの数を数えるspan processor
+// 計装が上限を超えていることに気付けるよう、SDK自身のメトリクスとして出す
+type droppedCounter struct {
+	counter metric.Int64Counter
+}
+
+func newDroppedCounter(mp metric.MeterProvider) (*droppedCounter, error) {
+	counter, err := mp.Meter("pkg/otel").Int64Counter(
+		"otel.sdk.span.dropped",
+		metric.WithDescription("Number of span attributes, events and links dropped by span limits"),
+		metric.WithUnit("{item}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &droppedCounter{counter: counter}, nil
+}
+
+func (d *droppedCounter) OnStart(context.Context, trace.ReadWriteSpan) {}
+
+func (d *droppedCounter) OnEnd(s trace.ReadOnlySpan) {
+	ctx := context.Background()
+	scope := attribute.String("otel.scope.name", s.InstrumentationScope().Name)
+	add := func(kind string, n int) {
+		if n > 0 {
+			d.counter.Add(ctx, int64(n), metric.WithAttributes(scope, attribute.String("kind", kind)))
+		}
+	}
+
+	add("attribute", s.DroppedAttributes())
+	add("event", s.DroppedEvents())
+	add("link", s.DroppedLinks())
+
+	eventAttrs := 0
+	for _, e := range s.Events() {
+		eventAttrs += e.DroppedAttributeCount
+	}
+	add("event_attribute", eventAttrs)
+
+	linkAttrs := 0
+	for _, l := range s.Links() {
+		linkAttrs += l.DroppedAttributeCount
+	}
+	add("link_attribute", linkAttrs)
+}
+
+func (d *droppedCounter) Shutdown(context.Context) error   { return nil }
+func (d *droppedCounter) ForceFlush(context.Context) error { return nil }
@@ -0,0 +1,221 @@
+package otel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"regexp"
+	rpprof "runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// Profiling
+// spanが有効な間、goroutineにpprofのラベル(span_id, span_name)を付ける。
+// CPUプロファイルのサンプルにラベルが残るので、遅いspanで何が起きていたのかをプロファイルから辿れる。
+// ヒーププロファイルはGoのランタイムがラベルに対応していないので、ラベルは付かない。
+
+const (
+	profileLabelSpanID   = "span_id"
+	profileLabelSpanName = "span_name"
+	profileLabelTraceID  = "trace_id"
+
+	capturedPath = "/debug/pprof/captured/"
+)
+
+// 自動で取ったプロファイルのファイル名。/debug/pprof/captured/ はこの名前のファイルだけを配る
+var capturedProfilePattern = regexp.MustCompile(`^cpu-[0-9a-f]{32}-[0-9a-f]{16}\.pprof$`)
+
+type profilingProcessor struct {
+	threshold time.Duration
+	duration  time.Duration
+	dir       string
+
+	mu    sync.Mutex
+	spans map[[8]byte]*profiledSpan
+
+	// CPUプロファイルは同時に1つしか取れない
+	capturing sync.Mutex
+}
+
+type profiledSpan struct {
+	// span開始前のラベル。終了時に元に戻す
+	parent context.Context
+	timer  *time.Timer
+}
+
+// newProfilingProcessor dirはprofileDirで決めた保存先
+func newProfilingProcessor(c *ProfilingConfig, dir string) *profilingProcessor {
+	p := &profilingProcessor{
+		dir:   dir,
+		spans: map[[8]byte]*profiledSpan{},
+	}
+	if c.SlowSpanThreshold != nil {
+		p.threshold = millis(*c.SlowSpanThreshold)
+	}
+	p.duration = 2 * time.Second
+	if c.CPUProfileDuration != nil {
+		p.duration = millis(*c.CPUProfileDuration)
+	}
+	return p
+}
+
+// profileDir 自動で取ったプロファイルの保存先
+// PPROF_PROFILE_DIRがなければプロセスごとに専用のディレクトリを作り、/tmpの他のファイルと混ぜない。
+// 閾値がなければプロファイルを取らないので作らない
+func profileDir(c *ProfilingConfig) (string, error) {
+	if c.SlowSpanThreshold == nil || *c.SlowSpanThreshold <= 0 {
+		return "", nil
+	}
+	if c.Directory != "" {
+		return c.Directory, nil
+	}
+	return os.MkdirTemp("", "pprof-")
+}
+
+// OnStart spanを開始したgoroutineにラベルを付ける
+// spanをまたいでgoroutineを起動した場合、起動時点のラベルが引き継がれる
+func (p *profilingProcessor) OnStart(parent context.Context, s trace.ReadWriteSpan) {
+	sc := s.SpanContext()
+	labels := rpprof.Labels(
+		profileLabelSpanID, sc.SpanID().String(),
+		profileLabelSpanName, s.Name(),
+		profileLabelTraceID, sc.TraceID().String(),
+	)
+	rpprof.SetGoroutineLabels(rpprof.WithLabels(parent, labels))
+
+	ps := &profiledSpan{parent: parent}
+	// タイマーはリクエストの入り口のspanにだけ仕掛ける。子のspanはその間のプロファイルに含まれる
+	if p.threshold > 0 && isEntrySpan(s) {
+		ps.timer = time.AfterFunc(p.threshold, func() { p.captureCPUProfile(s, labels) })
+	}
+	p.mu.Lock()
+	p.spans[sc.SpanID()] = ps
+	p.mu.Unlock()
+}
+
+// isEntrySpan プロセスの中で最初のspanか、サーバーのspan
+func isEntrySpan(s trace.ReadWriteSpan) bool {
+	parent := s.Parent()
+	return !parent.IsValid() || parent.IsRemote() || s.SpanKind() == oteltrace.SpanKindServer
+}
+
+// OnEnd ラベルをspan開始前の状態に戻す
+// 別のgoroutineでspanを終了した場合はそのgoroutineのラベルが変わってしまうが、サンプル用途なので許容している
+func (p *profilingProcessor) OnEnd(s trace.ReadOnlySpan) {
+	p.mu.Lock()
+	ps, ok := p.spans[s.SpanContext().SpanID()]
+	delete(p.spans, s.SpanContext().SpanID())
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	if ps.timer != nil {
+		ps.timer.Stop()
+	}
+	rpprof.SetGoroutineLabels(ps.parent)
+}
+
+func (p *profilingProcessor) Shutdown(context.Context) error   { return nil }
+func (p *profilingProcessor) ForceFlush(context.Context) error { return nil }
+
+// captureCPUProfile 閾値を超えてもまだ終わらないspanの間、短いCPUプロファイルを取る
+// ファイルの場所はspanのイベントとして残す
+func (p *profilingProcessor) captureCPUProfile(s trace.ReadWriteSpan, labels rpprof.LabelSet) {
+	if !s.IsRecording() || !p.capturing.TryLock() {
+		return
+	}
+	defer p.capturing.Unlock()
+
+	// タイマーのgoroutineにも同じラベルを付けておく
+	rpprof.SetGoroutineLabels(rpprof.WithLabels(context.Background(), labels))
+
+	sc := s.SpanContext()
+	path := filepath.Join(p.dir, fmt.Sprintf("cpu-%s-%s.pprof", sc.TraceID(), sc.SpanID()))
+	f, err := os.Create(path)
+	if err != nil {
+		log.Printf("profiling: create %s: %v", path, err)
+		return
+	}
+	defer f.Close()
+
+	// 他でCPUプロファイルを取っている場合は諦める
+	if err := rpprof.StartCPUProfile(f); err != nil {
+		os.Remove(path)
+		return
+	}
+	s.AddEvent("pprof.cpu_profile", oteltrace.WithAttributes(
+		attribute.String("pprof.file", path),
+		attribute.Int64("pprof.duration_ms", p.duration.Milliseconds()),
+		attribute.Int64("pprof.threshold_ms", p.threshold.Milliseconds()),
+	))
+	time.Sleep(p.duration)
+	rpprof.StopCPUProfile()
+}
+
+// NewProfilingHandler プロファイルを取得する管理用のハンドラー
+// /debug/pprof/ 以下はnet/http/pprofと同じで、/debug/pprof/captured/ でdirに自動取得したプロファイルを配る。
+// dirの他のファイルは配らない。dirが空なら自動取得したものはない
+func NewProfilingHandler(dir string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc(capturedPath, func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, capturedPath)
+		if dir == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if name == "" {
+			listCapturedProfiles(w, dir)
+			return
+		}
+		if !capturedProfilePattern.MatchString(name) {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(dir, name))
+	})
+	return mux
+}
+
+// listCapturedProfiles 自動で取ったプロファイルのファイル名を1行に1つ返す
+func listCapturedProfiles(w http.ResponseWriter, dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		http.Error(w, "failed to read captured profiles", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, e := range entries {
+		if e.Type().IsRegular() && capturedProfilePattern.MatchString(e.Name()) {
+			fmt.Fprintln(w, e.Name())
+		}
+	}
+}
+
+// 管理用のエンドポイントはアプリケーションのポートとは分けて立てる
+func (s *SDK) serveProfiling(c *ProfilingConfig) error {
+	ln, err := net.Listen("tcp", c.AdminEndpoint)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: NewProfilingHandler(s.profileDir)}
+	go srv.Serve(ln)
+	log.Printf("Profiling endpoint started at %v", ln.Addr())
+	s.closers = append(s.closers, srv.Shutdown)
+	return nil
+}
@@ -0,0 +1,515 @@
+package otel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/log/global"
+	"go.opentelemetry.io/otel/propagation"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// SDK
+// 設定ファイルから組み立てたプロバイダー一式
+// 設定がないプロバイダーはnilのまま
+type SDK struct {
+	TracerProvider *trace.TracerProvider
+	MeterProvider  *metric.MeterProvider
+	LoggerProvider *sdklog.LoggerProvider
+	Propagator     propagation.TextMapPropagator
+
+	// prometheusのエンドポイントなど、プロバイダー以外に後始末が必要なもの
+	closers []func(context.Context) error
+	// 自動で取ったプロファイルの保存先。プロセスが終わった後も調べられるように消さない
+	profileDir string
+}
+
+// NewSDK 設定からプロバイダーを組み立てる
+// resourceにservice.nameがない場合はserviceNameを使う
+func NewSDK(ctx context.Context, cfg *Config, serviceName string) (*SDK, error) {
+	s := &SDK{Propagator: newPropagator(cfg.Propagator)}
+	if cfg.Disabled {
+		return s, nil
+	}
+
+	r, err := newResourceFromConfig(cfg.Resource, serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Profiling != nil {
+		if s.profileDir, err = profileDir(cfg.Profiling); err != nil {
+			return nil, err
+		}
+	}
+
+	// トレースのパイプライン自身のメトリクスを出すので、メーターを先に作る
+	if cfg.MeterProvider != nil {
+		if s.MeterProvider, err = s.newMeterProviderFromConfig(ctx, cfg.MeterProvider, r); err != nil {
+			return nil, errors.Join(err, s.Shutdown(ctx))
+		}
+	}
+	if cfg.TracerProvider != nil {
+		if s.TracerProvider, err = s.newTracerProviderFromConfig(ctx, cfg, r); err != nil {
+			return nil, errors.Join(err, s.Shutdown(ctx))
+		}
+	}
+	if c := cfg.Profiling; c != nil && c.AdminEndpoint != "" {
+		if err := s.serveProfiling(c); err != nil {
+			return nil, errors.Join(err, s.Shutdown(ctx))
+		}
+	}
+	if cfg.LoggerProvider != nil {
+		if s.LoggerProvider, err = newLoggerProviderFromConfig(ctx, cfg, r); err != nil {
+			return nil, errors.Join(err, s.Shutdown(ctx))
+		}
+	}
+	return s, nil
+}
+
+// SetGlobal 組み立てたプロバイダーをグローバルに登録する
+func (s *SDK) SetGlobal() {
+	otel.SetTextMapPropagator(s.Propagator)
+	if s.TracerProvider != nil {
+		otel.SetTracerProvider(s.TracerProvider)
+	}
+	if s.MeterProvider != nil {
+		otel.SetMeterProvider(s.MeterProvider)
+	}
+	if s.LoggerProvider != nil {
+		global.SetLoggerProvider(s.LoggerProvider)
+	}
+}
+
+// Shutdown 全てのプロバイダーを停止する
+// 止める前にForceFlushでバッファに残っているテレメトリを送る。
+// 途中で失敗しても残りのプロバイダーは止め、全てのエラーをまとめて返す
+func (s *SDK) Shutdown(ctx context.Context) error {
+	var errs []error
+	if s.TracerProvider != nil {
+		if err := s.TracerProvider.ForceFlush(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("tracer provider flush: %w", err))
+		}
+		if err := s.TracerProvider.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("tracer provider shutdown: %w", err))
+		}
+	}
+	// トレースのパイプラインがメトリクスを記録するので、メーターはトレースの後に止める
+	if s.MeterProvider != nil {
+		if err := s.MeterProvider.ForceFlush(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("meter provider flush: %w", err))
+		}
+		if err := s.MeterProvider.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("meter provider shutdown: %w", err))
+		}
+	}
+	if s.LoggerProvider != nil {
+		if err := s.LoggerProvider.ForceFlush(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("logger provider flush: %w", err))
+		}
+		if err := s.LoggerProvider.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("logger provider shutdown: %w", err))
+		}
+	}
+	for _, c := range s.closers {
+		errs = append(errs, c(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// shutdownAll プロバイダーに渡す前のエクスポーターを止める
+func shutdownAll(ctx context.Context, shutdowns []func(context.Context) error) error {
+	var errs []error
+	for _, shutdown := range shutdowns {
+		errs = append(errs, shutdown(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// compositeを省略した場合はtracecontextとbaggageを使い、空のリストなら伝播しない
+func newPropagator(c *PropagatorConfig) propagation.TextMapPropagator {
+	if c == nil || c.Composite == nil {
+		return propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+	}
+	ps := make([]propagation.TextMapPropagator, 0, len(c.Composite))
+	for _, name := range c.Composite {
+		switch name {
+		case "tracecontext":
+			ps = append(ps, propagation.TraceContext{})
+		case "baggage":
+			ps = append(ps, propagation.Baggage{})
+		}
+	}
+	return propagation.NewCompositeTextMapPropagator(ps...)
+}
+
+func newResourceFromConfig(c *ResourceConfig, serviceName string) (*resource.Resource, error) {
+	schemaURL := semconv.SchemaURL
+	attrs := []attribute.KeyValue{}
+	hasServiceName := false
+	if c != nil {
+		if c.SchemaURL != "" {
+			schemaURL = c.SchemaURL
+		}
+		for _, a := range c.Attributes {
+			kv, err := attributeValue(a)
+			if err != nil {
+				return nil, err
+			}
+			if a.Name == string(semconv.ServiceNameKey) {
+				hasServiceName = true
+			}
+			attrs = append(attrs, kv)
+		}
+	}
+	if !hasServiceName {
+		attrs = append(attrs, semconv.ServiceName(serviceName))
+	}
+	return resource.Merge(resource.Default(), resource.NewWithAttributes(schemaURL, attrs...))
+}
+
+func attributeValue(a AttributeNameValue) (attribute.KeyValue, error) {
+	switch a.Type {
+	case "", "string":
+		return attribute.String(a.Name, a.Value), nil
+	case "bool":
+		v, err := strconv.ParseBool(a.Value)
+		return attribute.Bool(a.Name, v), err
+	case "int":
+		v, err := strconv.ParseInt(a.Value, 10, 64)
+		return attribute.Int64(a.Name, v), err
+	case "double":
+		v, err := strconv.ParseFloat(a.Value, 64)
+		return attribute.Float64(a.Name, v), err
+	default:
+		return attribute.KeyValue{}, fmt.Errorf("unsupported attribute type %q", a.Type)
+	}
+}
+
+func (s *SDK) newTracerProviderFromConfig(ctx context.Context, cfg *Config, r *resource.Resource) (_ *trace.TracerProvider, err error) {
+	// プロバイダーを作る前に失敗したら、それまでに作ったエクスポーターはSDKのShutdownで止められないのでここで止める
+	var created []func(context.Context) error
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, shutdownAll(ctx, created))
+		}
+	}()
+
+	c := cfg.TracerProvider
+	opts := []trace.TracerProviderOption{
+		trace.WithResource(r),
+		trace.WithSpanLimits(newSpanLimits(cfg.AttributeLimits, c.Limits)),
+	}
+	if s.MeterProvider != nil {
+		dc, err := newDroppedCounter(s.MeterProvider)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, trace.WithSpanProcessor(dc))
+	}
+	if cfg.Profiling != nil {
+		opts = append(opts, trace.WithSpanProcessor(newProfilingProcessor(cfg.Profiling, s.profileDir)))
+	}
+	keys := cfg.BaggageSpanAttributes
+	if len(keys) == 0 {
+		keys = defaultBaggageSpanAttributes
+	}
+	opts = append(opts, trace.WithSpanProcessor(newBaggageProcessor(keys)))
+	if c.Sampler != nil {
+		opts = append(opts, trace.WithSampler(newSampler(c.Sampler)))
+	}
+	for _, p := range c.Processors {
+		if p.Batch != nil {
+			exporter, err := newSpanExporterFromConfig(ctx, p.Batch.Exporter)
+			if err != nil {
+				return nil, err
+			}
+			created = append(created, exporter.Shutdown)
+			bopts := []trace.BatchSpanProcessorOption{}
+			if v := p.Batch.ScheduleDelay; v != nil {
+				bopts = append(bopts, trace.WithBatchTimeout(millis(*v)))
+			}
+			if v := p.Batch.ExportTimeout; v != nil {
+				bopts = append(bopts, trace.WithExportTimeout(millis(*v)))
+			}
+			if v := p.Batch.MaxQueueSize; v != nil {
+				bopts = append(bopts, trace.WithMaxQueueSize(*v))
+			}
+			if v := p.Batch.MaxExportBatchSize; v != nil {
+				bopts = append(bopts, trace.WithMaxExportBatchSize(*v))
+			}
+			opts = append(opts, trace.WithBatcher(exporter, bopts...))
+			continue
+		}
+		exporter, err := newSpanExporterFromConfig(ctx, p.Simple.Exporter)
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, exporter.Shutdown)
+		opts = append(opts, trace.WithSyncer(exporter))
+	}
+	return trace.NewTracerProvider(opts...), nil
+}
+
+// span固有の上限がなければattribute_limitsの値を使う
+func newSpanLimits(general *AttributeLimits, c *SpanLimitsConfig) trace.SpanLimits {
+	l := trace.NewSpanLimits()
+	if general != nil {
+		setInt(&l.AttributeValueLengthLimit, general.AttributeValueLengthLimit)
+		setInt(&l.AttributeCountLimit, general.AttributeCountLimit)
+	}
+	if c != nil {
+		setInt(&l.AttributeValueLengthLimit, c.AttributeValueLengthLimit)
+		setInt(&l.AttributeCountLimit, c.AttributeCountLimit)
+		setInt(&l.EventCountLimit, c.EventCountLimit)
+		setInt(&l.LinkCountLimit, c.LinkCountLimit)
+		setInt(&l.AttributePerEventCountLimit, c.EventAttributeCountLimit)
+		setInt(&l.AttributePerLinkCountLimit, c.LinkAttributeCountLimit)
+	}
+	return l
+}
+
+func setInt(dst *int, v *int) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+func newSampler(c *SamplerConfig) trace.Sampler {
+	switch {
+	case c.AlwaysOff != nil:
+		return trace.NeverSample()
+	case c.TraceIDRatioBased != nil:
+		ratio := 1.0
+		if c.TraceIDRatioBased.Ratio != nil {
+			ratio = *c.TraceIDRatioBased.Ratio
+		}
+		return trace.TraceIDRatioBased(ratio)
+	case c.ParentBased != nil:
+		pb := c.ParentBased
+		root := trace.AlwaysSample()
+		if pb.Root != nil {
+			root = newSampler(pb.Root)
+		}
+		opts := []trace.ParentBasedSamplerOption{}
+		if pb.RemoteParentSampled != nil {
+			opts = append(opts, trace.WithRemoteParentSampled(newSampler(pb.RemoteParentSampled)))
+		}
+		if pb.RemoteParentNotSampled != nil {
+			opts = append(opts, trace.WithRemoteParentNotSampled(newSampler(pb.RemoteParentNotSampled)))
+		}
+		if pb.LocalParentSampled != nil {
+			opts = append(opts, trace.WithLocalParentSampled(newSampler(pb.LocalParentSampled)))
+		}
+		if pb.LocalParentNotSampled != nil {
+			opts = append(opts, trace.WithLocalParentNotSampled(newSampler(pb.LocalParentNotSampled)))
+		}
+		return trace.ParentBased(root, opts...)
+	default:
+		return trace.AlwaysSample()
+	}
+}
+
+func (s *SDK) newMeterProviderFromConfig(ctx context.Context, c *MeterProviderConfig, r *resource.Resource) (_ *metric.MeterProvider, err error) {
+	// トレースと同じく、途中で失敗したらそれまでに作ったものを止める
+	var created []func(context.Context) error
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, shutdownAll(ctx, created))
+		}
+	}()
+
+	opts := []metric.Option{metric.WithResource(r)}
+	for _, rc := range c.Readers {
+		if rc.Periodic != nil {
+			exporter, err := newMetricExporterFromConfig(ctx, rc.Periodic.Exporter)
+			if err != nil {
+				return nil, err
+			}
+			created = append(created, exporter.Shutdown)
+			ropts := []metric.PeriodicReaderOption{}
+			if v := rc.Periodic.Interval; v != nil {
+				ropts = append(ropts, metric.WithInterval(millis(*v)))
+			}
+			if v := rc.Periodic.Timeout; v != nil {
+				ropts = append(ropts, metric.WithTimeout(millis(*v)))
+			}
+			opts = append(opts, metric.WithReader(metric.NewPeriodicReader(exporter, ropts...)))
+			continue
+		}
+		reader, err := s.newPrometheusReader(rc.Pull.Exporter.Prometheus)
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, reader.Shutdown)
+		opts = append(opts, metric.WithReader(reader))
+	}
+	for _, v := range c.Views {
+		opts = append(opts, metric.WithView(newView(v)))
+	}
+	return metric.NewMeterProvider(opts...), nil
+}
+
+// prometheusのエクスポーターはpull型なので、/metricsを公開するHTTPサーバーも一緒に立てる
+func (s *SDK) newPrometheusReader(c *PrometheusExporterConfig) (metric.Reader, error) {
+	reader, err := prometheus.New()
+	if err != nil {
+		return nil, err
+	}
+	host, port := c.Host, c.Port
+	if host == "" {
+		host = "localhost"
+	}
+	if port == 0 {
+		port = 9464
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	s.closers = append(s.closers, srv.Shutdown)
+	return reader, nil
+}
+
+var instrumentKinds = map[string]metric.InstrumentKind{
+	"counter":                    metric.InstrumentKindCounter,
+	"up_down_counter":            metric.InstrumentKindUpDownCounter,
+	"histogram":                  metric.InstrumentKindHistogram,
+	"gauge":                      metric.InstrumentKindGauge,
+	"observable_counter":         metric.InstrumentKindObservableCounter,
+	"observable_up_down_counter": metric.InstrumentKindObservableUpDownCounter,
+	"observable_gauge":           metric.InstrumentKindObservableGauge,
+}
+
+func newView(c ViewConfig) metric.View {
+	inst := metric.Instrument{
+		Name: c.Selector.InstrumentName,
+		Kind: instrumentKinds[c.Selector.InstrumentType],
+		Unit: c.Selector.Unit,
+	}
+	inst.Scope.Name = c.Selector.MeterName
+	inst.Scope.Version = c.Selector.MeterVersion
+	inst.Scope.SchemaURL = c.Selector.MeterSchemaURL
+
+	stream := metric.Stream{
+		Name:        c.Stream.Name,
+		Description: c.Stream.Description,
+	}
+	if a := c.Stream.Aggregation; a != nil {
+		switch {
+		case a.Drop != nil:
+			stream.Aggregation = metric.AggregationDrop{}
+		case a.Sum != nil:
+			stream.Aggregation = metric.AggregationSum{}
+		case a.LastValue != nil:
+			stream.Aggregation = metric.AggregationLastValue{}
+		case a.ExplicitBucketHistogram != nil:
+			h := metric.AggregationExplicitBucketHistogram{
+				Boundaries: a.ExplicitBucketHistogram.Boundaries,
+			}
+			h.NoMinMax = a.ExplicitBucketHistogram.RecordMinMax != nil && !*a.ExplicitBucketHistogram.RecordMinMax
+			stream.Aggregation = h
+		}
+	}
+	if k := c.Stream.AttributeKeys; k != nil {
+		stream.AttributeFilter = newAttributeFilter(k)
+	}
+	return metric.NewView(inst, stream)
+}
+
+func newAttributeFilter(c *AttributeKeysConfig) attribute.Filter {
+	included := map[attribute.Key]bool{}
+	for _, k := range c.Included {
+		included[attribute.Key(k)] = true
+	}
+	excluded := map[attribute.Key]bool{}
+	for _, k := range c.Excluded {
+		excluded[attribute.Key(k)] = true
+	}
+	return func(kv attribute.KeyValue) bool {
+		if len(included) > 0 && !included[kv.Key] {
+			return false
+		}
+		return !excluded[kv.Key]
+	}
+}
+
+func newLoggerProviderFromConfig(ctx context.Context, cfg *Config, r *resource.Resource) (_ *sdklog.LoggerProvider, err error) {
+	// トレースと同じく、途中で失敗したらそれまでに作ったエクスポーターを止める
+	var created []func(context.Context) error
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, shutdownAll(ctx, created))
+		}
+	}()
+
+	c := cfg.LoggerProvider
+	opts := []sdklog.LoggerProviderOption{sdklog.WithResource(r)}
+
+	valueLength, count := (*int)(nil), (*int)(nil)
+	if cfg.AttributeLimits != nil {
+		valueLength, count = cfg.AttributeLimits.AttributeValueLengthLimit, cfg.AttributeLimits.AttributeCountLimit
+	}
+	if c.Limits != nil {
+		if c.Limits.AttributeValueLengthLimit != nil {
+			valueLength = c.Limits.AttributeValueLengthLimit
+		}
+		if c.Limits.AttributeCountLimit != nil {
+			count = c.Limits.AttributeCountLimit
+		}
+	}
+	if valueLength != nil {
+		opts = append(opts, sdklog.WithAttributeValueLengthLimit(*valueLength))
+	}
+	if count != nil {
+		opts = append(opts, sdklog.WithAttributeCountLimit(*count))
+	}
+
+	for _, p := range c.Processors {
+		if p.Batch != nil {
+			exporter, err := newLogExporterFromConfig(ctx, p.Batch.Exporter)
+			if err != nil {
+				return nil, err
+			}
+			created = append(created, exporter.Shutdown)
+			bopts := []sdklog.BatchProcessorOption{}
+			if v := p.Batch.ScheduleDelay; v != nil {
+				bopts = append(bopts, sdklog.WithExportInterval(millis(*v)))
+			}
+			if v := p.Batch.ExportTimeout; v != nil {
+				bopts = append(bopts, sdklog.WithExportTimeout(millis(*v)))
+			}
+			if v := p.Batch.MaxQueueSize; v != nil {
+				bopts = append(bopts, sdklog.WithMaxQueueSize(*v))
+			}
+			if v := p.Batch.MaxExportBatchSize; v != nil {
+				bopts = append(bopts, sdklog.WithExportMaxBatchSize(*v))
+			}
+			opts = append(opts, sdklog.WithProcessor(sdklog.NewBatchProcessor(exporter, bopts...)))
+			continue
+		}
+		exporter, err := newLogExporterFromConfig(ctx, p.Simple.Exporter)
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, exporter.Shutdown)
+		opts = append(opts, sdklog.WithProcessor(sdklog.NewSimpleProcessor(exporter)))
+	}
+	return sdklog.NewLoggerProvider(opts...), nil
+}
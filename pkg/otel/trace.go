@@ -2,77 +2,43 @@ package otel
 
 import (
 	"context"
-	"log"
 	"os"
-
-	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/propagation"
-	"go.opentelemetry.io/otel/sdk/resource"
-	"go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"time"
 )
 
-var otlpEndpoint string
+// 設定ファイルのパスを指定する環境変数。仕様に合わせてEXPERIMENTALの名前にしている
+const configFileEnv = "OTEL_EXPERIMENTAL_CONFIG_FILE"
 
-func init() {
-	otel.SetTextMapPropagator(
-		propagation.NewCompositeTextMapPropagator(
-			propagation.TraceContext{},
-			propagation.Baggage{},
-		),
-	)
-	// エンドポイントがHTTPはデフォルト(localhost:4318)の場合は不要 エンドポイントがgRPCはデフォルト(localhost:4317)の場合は不要
-	otlpEndpoint = os.Getenv("OTLP_ENDPOINT")
-	if otlpEndpoint == "" {
-		log.Fatalln("You MUST set OTLP_ENDPOINT env variable!")
-	}
-}
-
-func newResource(serviceName, version, env string) *resource.Resource {
-	resc, _ := resource.Merge(
-		resource.Default(),
-		resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceName(serviceName),
-			semconv.ServiceVersion(version),
-			attribute.String("environment", env),
-		),
-	)
-	return resc
-}
+// シャットダウンに使える最大の時間。エクスポート先が応答しなくてもプロセスが止まれるようにする
+const shutdownTimeout = 5 * time.Second
 
-func newExporter(ctx context.Context) (trace.SpanExporter, error) {
-	switch os.Getenv("OTEL_EXPORTER_PROTOCOL") {
-	case "http":
-		return newTracesHttpExporter(ctx)
-	case "grpc":
-		return newTracesGrpcExporter(ctx)
-	case "jaeger":
-		return newTracesJaegerExporter()
-	default:
-		return newTracesWriterExporter(os.Stdout)
+// 設定ファイルが指定されていればそれを使い、なければOTEL_*の環境変数から設定を組み立てる
+// 仕様どおり、設定ファイルを使う場合は${ENV}での置換以外で環境変数は参照しない
+func loadConfig() (*Config, error) {
+	if path := os.Getenv(configFileEnv); path != "" {
+		return LoadConfig(path)
 	}
+	return ConfigFromEnv(), nil
 }
 
-func NewTracerProvider(serviceName string) func() {
-	ctx := context.Background()
-	exporter, err := newExporter(ctx)
+// Setup トレース、メトリクス、ログのプロバイダーをまとめて作り、グローバルに登録する
+// propagatorもここで登録するので、後続のサービスへspanのContextが伝播される
+// 返り値のshutdownはバッファに残ったテレメトリを送ってから全てのプロバイダーを止め、エラーをまとめて返す。
+// エラーをどう扱うかは呼び出し側で決める
+func Setup(ctx context.Context, serviceName string) (shutdown func(context.Context) error, err error) {
+	cfg, err := loadConfig()
 	if err != nil {
-		log.Fatalf("OTLP Trace Creation: %v", err)
+		return nil, err
 	}
-
-	r := newResource(serviceName, "1.0.0", "local")
-	tp := trace.NewTracerProvider(
-		trace.WithBatcher(exporter),
-		trace.WithResource(r),
-	)
-	otel.SetTracerProvider(tp)
-
-	return func() {
-		if err := tp.Shutdown(ctx); err != nil {
-			log.Fatalf("Tracer Provider Shutdown: %v", err)
-		}
-		log.Println("Shutdown tracer provider")
+	sdk, err := NewSDK(ctx, cfg, serviceName)
+	if err != nil {
+		return nil, err
 	}
+	sdk.SetGlobal()
+
+	return func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+		defer cancel()
+		return sdk.Shutdown(ctx)
+	}, nil
 }
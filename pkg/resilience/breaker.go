@@ -0,0 +1,178 @@
+package resilience
+
+import (
+	"sync"
+	"time"
+)
+
+// サーキットブレーカー
+//   - closed: 呼び出しを通し、Windowごとに失敗の割合を数える。
+//     MinRequests以上の呼び出しのうちFailureRatio以上が失敗したらopenにする
+//   - open: 呼び出しをすぐにUnavailableで失敗させる。OpenTimeoutが過ぎたらhalf-openにする
+//   - half-open: HalfOpenRequests件までだけ通す。すべて成功したらclosed、1件でも失敗したらopenに戻す
+
+type State int
+
+const (
+	StateClosed State = iota
+	StateHalfOpen
+	StateOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateHalfOpen:
+		return "half_open"
+	case StateOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+type BreakerConfig struct {
+	// 失敗の割合を数える期間
+	Window time.Duration
+	// 判定に必要な最小の呼び出し数
+	MinRequests int
+	// openにする失敗の割合 (0 < FailureRatio <= 1)
+	FailureRatio float64
+	// openからhalf-openにするまでの時間
+	OpenTimeout time.Duration
+	// half-openで試す呼び出しの数
+	HalfOpenRequests int
+}
+
+type breaker struct {
+	cfg BreakerConfig
+	now func() time.Time
+
+	mu    sync.Mutex
+	state State
+	// 状態が変わるたびに増やす。前の状態で始まった呼び出しの結果を数えないようにする
+	generation uint64
+	// closedでは数え直す時刻、openではhalf-openにする時刻
+	expiry time.Time
+
+	requests  int
+	failures  int
+	successes int
+	// half-openで通している呼び出しの数
+	inFlight int
+}
+
+// 状態の変化。呼び出しのspanとメトリクスに残す
+type transition struct {
+	from, to State
+}
+
+func newBreaker(cfg BreakerConfig) *breaker {
+	b := &breaker{cfg: cfg, now: time.Now}
+	b.expiry = b.now().Add(cfg.Window)
+	return b
+}
+
+// allow 呼び出しを通すかどうかを決める。通した場合は結果をdoneで返すこと
+// 時間が経って状態が変わった場合はその変化も返す
+func (b *breaker) allow() (generation uint64, ok bool, t *transition) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t = b.refresh(b.now())
+	switch b.state {
+	case StateOpen:
+		return b.generation, false, t
+	case StateHalfOpen:
+		if b.inFlight >= b.cfg.HalfOpenRequests {
+			return b.generation, false, t
+		}
+		b.inFlight++
+	}
+	b.requests++
+	return b.generation, true, t
+}
+
+// done allowで通した呼び出しの結果を数え、状態が変わった場合はその変化を返す
+func (b *breaker) done(generation uint64, failure bool) *transition {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if t := b.refresh(now); t != nil || generation != b.generation {
+		return t
+	}
+
+	switch b.state {
+	case StateClosed:
+		if failure {
+			b.failures++
+		}
+		if b.requests >= b.cfg.MinRequests && float64(b.failures)/float64(b.requests) >= b.cfg.FailureRatio {
+			return b.setState(StateOpen, now)
+		}
+	case StateHalfOpen:
+		b.inFlight--
+		if failure {
+			return b.setState(StateOpen, now)
+		}
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenRequests {
+			return b.setState(StateClosed, now)
+		}
+	}
+	return nil
+}
+
+// cancel allowで通したが呼ばなかった呼び出しを、結果を数えずに取り消す
+// 状態が変わった後なら、数えたものはもう捨てているので何もしない
+func (b *breaker) cancel(generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+	b.requests--
+	if b.state == StateHalfOpen {
+		b.inFlight--
+	}
+}
+
+// currentState メトリクス用。時間の経過による変化は次の呼び出しで反映する
+func (b *breaker) currentState() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// refresh 時間の経過による変化を反映する
+// half-openは結果が出るまで変わらない
+func (b *breaker) refresh(now time.Time) *transition {
+	if b.state == StateHalfOpen || now.Before(b.expiry) {
+		return nil
+	}
+	if b.state == StateOpen {
+		return b.setState(StateHalfOpen, now)
+	}
+	b.reset(now)
+	return nil
+}
+
+func (b *breaker) setState(to State, now time.Time) *transition {
+	from := b.state
+	b.state = to
+	b.reset(now)
+	return &transition{from: from, to: to}
+}
+
+func (b *breaker) reset(now time.Time) {
+	b.generation++
+	b.requests, b.failures, b.successes, b.inFlight = 0, 0, 0, 0
+	switch b.state {
+	case StateClosed:
+		b.expiry = now.Add(b.cfg.Window)
+	case StateOpen:
+		b.expiry = now.Add(b.cfg.OpenTimeout)
+	}
+}
@@ -0,0 +1,60 @@
+package resilience
+
+import (
+	"context"
+	"time"
+)
+
+// バルクヘッド
+// 接続先ごとに同時に処理中の呼び出しの数を制限する。
+// 依存先が遅くなっても、待っている呼び出しがMaxConcurrentより増えないので、呼び出し元のgoroutineが溜まり続けない
+
+type BulkheadConfig struct {
+	// 同時に処理中にできる呼び出しの数
+	MaxConcurrent int
+	// 空きを待つ最大の時間。0なら待たずに断る
+	MaxWait time.Duration
+}
+
+type bulkhead struct {
+	slots   chan struct{}
+	maxWait time.Duration
+}
+
+func newBulkhead(cfg BulkheadConfig) *bulkhead {
+	return &bulkhead{
+		slots:   make(chan struct{}, cfg.MaxConcurrent),
+		maxWait: cfg.MaxWait,
+	}
+}
+
+// acquire 空きがあれば確保する。確保できた場合はreleaseを呼ぶこと
+func (b *bulkhead) acquire(ctx context.Context) bool {
+	select {
+	case b.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if b.maxWait <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(b.maxWait)
+	defer timer.Stop()
+	select {
+	case b.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (b *bulkhead) release() {
+	<-b.slots
+}
+
+func (b *bulkhead) inFlight() int {
+	return len(b.slots)
+}
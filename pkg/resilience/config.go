@@ -0,0 +1,107 @@
+package resilience
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// 環境変数での設定
+// prefixを付けて接続先ごとに指定する。例えばprefixがGREETならGREET_BREAKER_FAILURE_RATIO
+
+// 指定しなかった場合の値
+var (
+	DefaultBreakerConfig = BreakerConfig{
+		Window:           10 * time.Second,
+		MinRequests:      10,
+		FailureRatio:     0.5,
+		OpenTimeout:      5 * time.Second,
+		HalfOpenRequests: 3,
+	}
+	DefaultBulkheadConfig = BulkheadConfig{
+		MaxConcurrent: 100,
+	}
+)
+
+// ConfigFromEnv 次の環境変数から設定を読む。期間はミリ秒
+//
+//	<prefix>_BREAKER_FAILURE_RATIO       openにする失敗の割合。0ならサーキットブレーカーを使わない
+//	<prefix>_BREAKER_MIN_REQUESTS        判定に必要な最小の呼び出し数
+//	<prefix>_BREAKER_WINDOW              失敗の割合を数える期間
+//	<prefix>_BREAKER_OPEN_TIMEOUT        openからhalf-openにするまでの時間
+//	<prefix>_BREAKER_HALF_OPEN_REQUESTS  half-openで試す呼び出しの数
+//	<prefix>_BULKHEAD_MAX_CONCURRENT     同時に処理中にできる呼び出しの数。0ならバルクヘッドを使わない
+//	<prefix>_BULKHEAD_MAX_WAIT           空きを待つ最大の時間
+func ConfigFromEnv(prefix string) (Config, error) {
+	p := envParser{prefix: prefix}
+
+	b := DefaultBreakerConfig
+	b.FailureRatio = p.float("BREAKER_FAILURE_RATIO", b.FailureRatio)
+	b.MinRequests = p.int("BREAKER_MIN_REQUESTS", b.MinRequests)
+	b.Window = p.millis("BREAKER_WINDOW", b.Window)
+	b.OpenTimeout = p.millis("BREAKER_OPEN_TIMEOUT", b.OpenTimeout)
+	b.HalfOpenRequests = p.int("BREAKER_HALF_OPEN_REQUESTS", b.HalfOpenRequests)
+
+	bh := DefaultBulkheadConfig
+	bh.MaxConcurrent = p.int("BULKHEAD_MAX_CONCURRENT", bh.MaxConcurrent)
+	bh.MaxWait = p.millis("BULKHEAD_MAX_WAIT", bh.MaxWait)
+
+	if p.err != nil {
+		return Config{}, p.err
+	}
+
+	var c Config
+	if b.FailureRatio > 0 {
+		if b.FailureRatio > 1 || b.MinRequests < 1 || b.Window <= 0 || b.OpenTimeout <= 0 || b.HalfOpenRequests < 1 {
+			return Config{}, fmt.Errorf("%s_BREAKER_*: invalid circuit breaker config %+v", prefix, b)
+		}
+		c.Breaker = &b
+	}
+	if bh.MaxConcurrent > 0 {
+		c.Bulkhead = &bh
+	}
+	return c, nil
+}
+
+// envParser 最初のエラーだけを残す
+type envParser struct {
+	prefix string
+	err    error
+}
+
+func (p *envParser) lookup(name string) (string, string, bool) {
+	key := p.prefix + "_" + name
+	v := os.Getenv(key)
+	return key, v, v != "" && p.err == nil
+}
+
+func (p *envParser) int(name string, def int) int {
+	key, v, ok := p.lookup(name)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		p.err = fmt.Errorf("%s: invalid value %q", key, v)
+		return def
+	}
+	return n
+}
+
+func (p *envParser) float(name string, def float64) float64 {
+	key, v, ok := p.lookup(name)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		p.err = fmt.Errorf("%s: invalid value %q", key, v)
+		return def
+	}
+	return f
+}
+
+func (p *envParser) millis(name string, def time.Duration) time.Duration {
+	return time.Duration(p.int(name, int(def/time.Millisecond))) * time.Millisecond
+}
@@ -0,0 +1,249 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+
+	otelapi "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 依存先へのgRPCの呼び出しをサーキットブレーカーとバルクヘッドで守るクライアントのインターセプター
+// 接続先ごとにGuardを1つ作り、その接続のインターセプターとして登録する。
+// 再試行やhedgingよりも外側に置くと、1回の呼び出しを1件として数える
+
+type Config struct {
+	// nilならサーキットブレーカーを使わない
+	Breaker *BreakerConfig
+	// nilならバルクヘッドを使わない
+	Bulkhead *BulkheadConfig
+}
+
+type Guard struct {
+	target   string
+	breaker  *breaker
+	bulkhead *bulkhead
+
+	attrs       attribute.Set
+	transitions metric.Int64Counter
+	rejections  metric.Int64Counter
+}
+
+// 断った理由
+const (
+	rejectCircuitOpen  = "circuit_open"
+	rejectBulkheadFull = "bulkhead_full"
+)
+
+// New targetへの呼び出しを守るGuardを作る。targetはメトリクスとspanの属性に使う
+func New(target string, c Config) (*Guard, error) {
+	g := &Guard{
+		target: target,
+		attrs:  attribute.NewSet(attribute.String("resilience.target", target)),
+	}
+	if c.Breaker != nil {
+		g.breaker = newBreaker(*c.Breaker)
+	}
+	if c.Bulkhead != nil {
+		g.bulkhead = newBulkhead(*c.Bulkhead)
+	}
+
+	meter := otelapi.Meter("pkg/resilience")
+	var err error
+	if g.transitions, err = meter.Int64Counter("resilience.circuit_breaker.transitions",
+		metric.WithDescription("Number of circuit breaker state transitions"),
+		metric.WithUnit("{transition}"),
+	); err != nil {
+		return nil, err
+	}
+	if g.rejections, err = meter.Int64Counter("resilience.rejections",
+		metric.WithDescription("Number of calls rejected by the circuit breaker or the bulkhead"),
+		metric.WithUnit("{call}"),
+	); err != nil {
+		return nil, err
+	}
+	if g.breaker != nil {
+		if _, err = meter.Int64ObservableGauge("resilience.circuit_breaker.state",
+			metric.WithDescription("Circuit breaker state (0: closed, 1: half-open, 2: open)"),
+			metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+				o.Observe(int64(g.breaker.currentState()), metric.WithAttributeSet(g.attrs))
+				return nil
+			}),
+		); err != nil {
+			return nil, err
+		}
+	}
+	if g.bulkhead != nil {
+		if _, err = meter.Int64ObservableGauge("resilience.bulkhead.in_flight",
+			metric.WithDescription("Number of calls currently holding a bulkhead slot"),
+			metric.WithUnit("{call}"),
+			metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+				o.Observe(int64(g.bulkhead.inFlight()), metric.WithAttributeSet(g.attrs))
+				return nil
+			}),
+		); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// UnaryClientInterceptor 単項のRPCを守る
+func (g *Guard) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		done, err := g.begin(ctx)
+		if err != nil {
+			return err
+		}
+		err = invoker(ctx, method, req, reply, cc, opts...)
+		done(ctx, err)
+		return err
+	}
+}
+
+// StreamClientInterceptor ストリーミングのRPCを守る
+// ストリームが終わるまでバルクヘッドの枠を持ち続ける
+func (g *Guard) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		done, err := g.begin(ctx)
+		if err != nil {
+			return nil, err
+		}
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			done(ctx, err)
+			return nil, err
+		}
+		s := &guardedStream{
+			ClientStream:  cs,
+			ctx:           ctx,
+			serverStreams: desc.ServerStreams,
+			done:          done,
+			finished:      make(chan struct{}),
+		}
+		// 呼び出し元が最後まで読まずにキャンセルした場合も枠を返す
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.finish(ctx.Err())
+			case <-s.finished:
+			}
+		}()
+		return s, nil
+	}
+}
+
+// begin 呼び出しを通すかどうかを決める。通した場合は終わったときにdoneを呼ぶこと
+func (g *Guard) begin(ctx context.Context) (done func(context.Context, error), err error) {
+	var generation uint64
+	if g.breaker != nil {
+		var ok bool
+		var t *transition
+		generation, ok, t = g.breaker.allow()
+		g.recordTransition(ctx, t)
+		if !ok {
+			g.reject(ctx, rejectCircuitOpen)
+			return nil, status.Errorf(codes.Unavailable, "circuit breaker for %s is open", g.target)
+		}
+	}
+	if g.bulkhead != nil && !g.bulkhead.acquire(ctx) {
+		if g.breaker != nil {
+			// 依存先を呼んでいないので、成功にも失敗にも数えない
+			g.breaker.cancel(generation)
+		}
+		g.reject(ctx, rejectBulkheadFull)
+		return nil, status.Errorf(codes.ResourceExhausted, "too many concurrent calls to %s", g.target)
+	}
+
+	return func(ctx context.Context, err error) {
+		if g.bulkhead != nil {
+			g.bulkhead.release()
+		}
+		if g.breaker != nil {
+			g.recordTransition(ctx, g.breaker.done(generation, isFailure(err)))
+		}
+	}, nil
+}
+
+// isFailure 依存先の不調とみなすエラーかどうか
+// 入力の誤りなど依存先が正常に返したエラーと、呼び出し元がキャンセルしたものは数えない。
+// QuotaFailureの付いたRESOURCE_EXHAUSTEDは呼び出し元ごとの上限なので、他の呼び出し元を止めないように数えない
+func isFailure(err error) bool {
+	if err == nil || errors.Is(err, io.EOF) {
+		return false
+	}
+	st := status.Convert(err)
+	switch st.Code() {
+	case codes.ResourceExhausted:
+		return !hasQuotaFailure(st)
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown:
+		return true
+	}
+	return false
+}
+
+func hasQuotaFailure(st *status.Status) bool {
+	for _, d := range st.Details() {
+		if _, ok := d.(*errdetails.QuotaFailure); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Guard) recordTransition(ctx context.Context, t *transition) {
+	if t == nil {
+		return
+	}
+	log.Printf("circuit breaker for %s: %s -> %s", g.target, t.from, t.to)
+	attrs := []attribute.KeyValue{
+		attribute.String("resilience.target", g.target),
+		attribute.String("resilience.circuit_breaker.from", t.from.String()),
+		attribute.String("resilience.circuit_breaker.to", t.to.String()),
+	}
+	g.transitions.Add(ctx, 1, metric.WithAttributes(attrs...))
+	trace.SpanFromContext(ctx).AddEvent("resilience.circuit_breaker.transition", trace.WithAttributes(attrs...))
+}
+
+func (g *Guard) reject(ctx context.Context, reason string) {
+	attrs := []attribute.KeyValue{
+		attribute.String("resilience.target", g.target),
+		attribute.String("resilience.reason", reason),
+	}
+	g.rejections.Add(ctx, 1, metric.WithAttributes(attrs...))
+	trace.SpanFromContext(ctx).AddEvent("resilience.rejected", trace.WithAttributes(attrs...))
+}
+
+type guardedStream struct {
+	grpc.ClientStream
+	ctx           context.Context
+	serverStreams bool
+	done          func(context.Context, error)
+	once          sync.Once
+	finished      chan struct{}
+}
+
+func (s *guardedStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	// サーバーストリーミングでない場合は1件受け取った時点で終わり
+	if err != nil || !s.serverStreams {
+		s.finish(err)
+	}
+	return err
+}
+
+func (s *guardedStream) finish(err error) {
+	s.once.Do(func() {
+		s.done(s.ctx, err)
+		close(s.finished)
+	})
+}
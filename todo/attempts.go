@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+// 再試行の記録
+// gRPCがサービス設定のretryPolicyで再試行すると、試行ごとにstats.HandlerのTagRPCが呼ばれ、otelgrpcのspanも試行ごとにできる。
+// それだけだと同じ名前のspanが並ぶだけなので、試行の番号を数え、呼び出し元のspanにイベントとして残す。
+// 再試行で隠れている不安定なgreetをトレースから見つけられるようにするためのもの
+
+type attemptCounterKey struct{}
+
+type attemptKey struct{}
+
+type attemptInfo struct {
+	number int
+	// 呼び出し元のspan。試行のspanはotelgrpcが作る
+	parent trace.Span
+}
+
+// countAttemptsUnary 呼び出しごとに試行の数を数えるカウンターをctxに入れる
+func countAttemptsUnary(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(context.WithValue(ctx, attemptCounterKey{}, new(atomic.Int32)), method, req, reply, cc, opts...)
+}
+
+func countAttemptsStream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(context.WithValue(ctx, attemptCounterKey{}, new(atomic.Int32)), desc, cc, method, opts...)
+}
+
+// attemptHandler otelgrpcより前に登録すること
+// TagRPCの時点のspanが呼び出し元のspanになる
+type attemptHandler struct{}
+
+func (attemptHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	counter, ok := ctx.Value(attemptCounterKey{}).(*atomic.Int32)
+	if !ok {
+		return ctx
+	}
+	a := &attemptInfo{number: int(counter.Add(1)), parent: trace.SpanFromContext(ctx)}
+	if a.number > 1 {
+		a.parent.AddEvent("rpc.retry", trace.WithAttributes(
+			attribute.String("rpc.method", info.FullMethodName),
+			attribute.Int("rpc.grpc.attempt", a.number),
+		))
+	}
+	return context.WithValue(ctx, attemptKey{}, a)
+}
+
+func (attemptHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	end, ok := s.(*stats.End)
+	if !ok {
+		return
+	}
+	a, ok := ctx.Value(attemptKey{}).(*attemptInfo)
+	if !ok {
+		return
+	}
+	// ここでのspanはotelgrpcが作った試行のspanで、まだ終わっていない
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("rpc.grpc.attempt", a.number))
+	if end.Error != nil {
+		a.parent.AddEvent("rpc.attempt.failed", trace.WithAttributes(
+			attribute.Int("rpc.grpc.attempt", a.number),
+			attribute.String("rpc.grpc.status_code", status.Code(end.Error).String()),
+		))
+	}
+}
+
+func (attemptHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context { return ctx }
+func (attemptHandler) HandleConn(context.Context, stats.ConnStats)                       {}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	todoPb "gen/go/todo"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// 監査ログ
+// TodoStoreは作成、更新、削除のたびに、誰がどのtodoをどう変えたかを変更と同じトランザクションで記録する。
+// 記録は追記するだけで、書き換えるAPIはない。SQLiteではトリガーでUPDATEとDELETEも断る
+//
+// 変更した人はbffがメタデータx-actor-idで渡す。記録には変更したリクエストのトレースIDとspan IDも残し、
+// どのリクエストで変わったかをトレースから追えるようにする
+
+const (
+	actorMetadata  = "x-actor-id"
+	anonymousActor = "anonymous"
+)
+
+// auditQuery ListAuditEventsの条件。ゼロ値のフィールドは条件にしない。新しい順に返す
+type auditQuery struct {
+	todoID string
+	actor  string
+	action todoPb.AuditEvent_Action
+	// startは含み、endは含まない
+	start, end time.Time
+	// nilなら先頭から返す
+	after *auditCursor
+	limit int
+}
+
+// auditCursor 前のページの最後の記録
+type auditCursor struct {
+	EventTime time.Time
+	ID        string
+}
+
+type auditStore interface {
+	// listAuditEvents contextのテナントの記録を返す
+	listAuditEvents(ctx context.Context, query auditQuery) ([]*todoPb.AuditEvent, error)
+}
+
+// actorFromContext 変更した人。bffを通らない呼び出しはanonymous
+func actorFromContext(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(actorMetadata); len(v) > 0 && v[0] != "" {
+		return v[0]
+	}
+	return anonymousActor
+}
+
+// newAuditEvent 変更を始める前に作り、変更した後にsetAuditChangeで中身を入れる
+// ctxのspanを変更したspanとして残すので、保存先のトランザクションのspanではなくTodoStoreのspanのctxで呼ぶ
+func newAuditEvent(ctx context.Context, action todoPb.AuditEvent_Action, todoID string) (*todoPb.AuditEvent, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	e := &todoPb.AuditEvent{
+		Id:        newTodoID(),
+		Action:    action,
+		TodoId:    todoID,
+		TenantId:  tenant,
+		Actor:     actorFromContext(ctx),
+		EventTime: timestamppb.Now(),
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		e.TraceId = sc.TraceID().String()
+		e.SpanId = sc.SpanID().String()
+	}
+	return e, nil
+}
+
+// setAuditChange 変更前と変更後を入れ、値が変わったフィールドを調べる。nilはないものとして比べる
+func setAuditChange(e *todoPb.AuditEvent, before, after *todoPb.Todo) {
+	if before != nil {
+		e.Before = proto.Clone(before).(*todoPb.Todo)
+	}
+	if after != nil {
+		e.After = proto.Clone(after).(*todoPb.Todo)
+	}
+	e.ChangedFields = nil
+	if before.GetTitle() != after.GetTitle() {
+		e.ChangedFields = append(e.ChangedFields, "title")
+	}
+	if before.GetDescription() != after.GetDescription() {
+		e.ChangedFields = append(e.ChangedFields, "description")
+	}
+	if before.GetDone() != after.GetDone() {
+		e.ChangedFields = append(e.ChangedFields, "done")
+	}
+}
+
+func (s *todoServer) ListAuditEvents(ctx context.Context, req *todoPb.ListAuditEventsRequest) (*todoPb.ListAuditEventsResponse, error) {
+	span := trace.SpanFromContext(ctx)
+
+	query := auditQuery{todoID: req.GetTodoId(), actor: req.GetActor(), action: req.GetAction()}
+	switch size := req.GetPageSize(); {
+	case size < 0:
+		return nil, invalidArgument(ctx, errors.New("page_size must not be negative"))
+	case size == 0:
+		query.limit = defaultPageSize
+	default:
+		query.limit = int(min(size, maxPageSize))
+	}
+	if _, ok := todoPb.AuditEvent_Action_name[int32(query.action)]; !ok {
+		return nil, invalidArgument(ctx, fmt.Errorf("action: unknown value %d", query.action))
+	}
+	var err error
+	if query.start, query.end, err = timeRange("time", req.GetStartTime(), req.GetEndTime()); err != nil {
+		return nil, invalidArgument(ctx, err)
+	}
+	if token := req.GetPageToken(); token != "" {
+		cursor, err := decodeAuditPageToken(req, token)
+		if err != nil {
+			return nil, invalidArgument(ctx, err)
+		}
+		query.after = cursor
+	}
+	span.SetAttributes(
+		attribute.Int("todo.audit.page_size", query.limit),
+		attribute.Bool("todo.audit.page_token", query.after != nil),
+	)
+
+	// 1件多く取り、次のページがあるかを調べる
+	limit := query.limit
+	query.limit++
+	events, err := s.audit.listAuditEvents(ctx, query)
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+
+	res := &todoPb.ListAuditEventsResponse{AuditEvents: events}
+	if len(events) > limit {
+		res.AuditEvents = events[:limit]
+		res.NextPageToken = encodeAuditPageToken(req, res.AuditEvents[limit-1])
+	}
+	span.SetAttributes(attribute.Int("todo.audit.count", len(res.AuditEvents)))
+	return res, nil
+}
+
+// auditPageToken next_page_tokenの中身。条件を変えて続きを取ろうとしたら弾く
+type auditPageToken struct {
+	Query     string `json:"q"`
+	EventTime int64  `json:"t"`
+	ID        string `json:"i"`
+}
+
+func encodeAuditPageToken(req *todoPb.ListAuditEventsRequest, last *todoPb.AuditEvent) string {
+	b, _ := json.Marshal(auditPageToken{
+		Query:     auditQueryHash(req),
+		EventTime: last.GetEventTime().AsTime().UnixNano(),
+		ID:        last.GetId(),
+	})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeAuditPageToken(req *todoPb.ListAuditEventsRequest, s string) (*auditCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidPageToken
+	}
+	var t auditPageToken
+	if err := json.Unmarshal(b, &t); err != nil || t.ID == "" || t.Query != auditQueryHash(req) {
+		return nil, errInvalidPageToken
+	}
+	return &auditCursor{EventTime: time.Unix(0, t.EventTime), ID: t.ID}, nil
+}
+
+// auditQueryHash ページをまたいで変わってはいけないフィールドのハッシュ
+func auditQueryHash(req *todoPb.ListAuditEventsRequest) string {
+	req = proto.Clone(req).(*todoPb.ListAuditEventsRequest)
+	req.PageSize = 0
+	req.PageToken = ""
+	b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	todoPb "gen/go/todo"
+	"slices"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// memoryAudit プロセスのメモリに保存する。memoryStoreがtodoを変更するときに、同じロックの中で書く
+type memoryAudit struct {
+	mu sync.Mutex
+	// 書いた順
+	events []*todoPb.AuditEvent
+}
+
+func newMemoryAudit() *memoryAudit {
+	return &memoryAudit{}
+}
+
+func (a *memoryAudit) insert(e *todoPb.AuditEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events = append(a.events, proto.Clone(e).(*todoPb.AuditEvent))
+}
+
+func (a *memoryAudit) listAuditEvents(ctx context.Context, query auditQuery) ([]*todoPb.AuditEvent, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var events []*todoPb.AuditEvent
+	for _, e := range a.events {
+		switch {
+		case e.GetTenantId() != tenant,
+			query.todoID != "" && e.GetTodoId() != query.todoID,
+			query.actor != "" && e.GetActor() != query.actor,
+			query.action != todoPb.AuditEvent_ACTION_UNSPECIFIED && e.GetAction() != query.action,
+			!inRange(e.GetEventTime().AsTime(), query.start, query.end),
+			query.after != nil && compareAuditEvent(e, query.after) >= 0:
+			continue
+		}
+		events = append(events, e)
+	}
+	// 新しい順
+	slices.SortFunc(events, func(x, y *todoPb.AuditEvent) int {
+		return -compareAuditEvent(x, &auditCursor{EventTime: y.GetEventTime().AsTime(), ID: y.GetId()})
+	})
+	if len(events) > query.limit {
+		events = events[:query.limit]
+	}
+	for i, e := range events {
+		events[i] = proto.Clone(e).(*todoPb.AuditEvent)
+	}
+	return events, nil
+}
+
+// compareAuditEvent (event_time, id)の組でeがcより前なら負、後ろなら正を返す
+func compareAuditEvent(e *todoPb.AuditEvent, c *auditCursor) int {
+	if n := e.GetEventTime().AsTime().Compare(c.EventTime); n != 0 {
+		return n
+	}
+	return strings.Compare(e.GetId(), c.ID)
+}
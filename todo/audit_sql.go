@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	todoPb "gen/go/todo"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// sqlAudit todoと同じSQLiteのaudit_eventsに保存する
+type sqlAudit struct {
+	db *sqlDB
+}
+
+func newSQLAudit(db *sqlDB) *sqlAudit {
+	return &sqlAudit{db: db}
+}
+
+const auditColumns = `id, tenant_id, todo_id, action, actor, before_todo, after_todo, changed_fields,
+	event_time, trace_id, span_id`
+
+// insert todoを変更したトランザクションの中で呼ぶ
+func (a *sqlAudit) insert(ctx context.Context, tx *sqlTx, e *todoPb.AuditEvent) error {
+	before, err := marshalAuditTodo(e.GetBefore())
+	if err != nil {
+		return err
+	}
+	after, err := marshalAuditTodo(e.GetAfter())
+	if err != nil {
+		return err
+	}
+	changed, err := json.Marshal(e.GetChangedFields())
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO audit_events (`+auditColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.GetId(), e.GetTenantId(), e.GetTodoId(), e.GetAction(), e.GetActor(), before, after, string(changed),
+		e.GetEventTime().AsTime().UnixNano(), e.GetTraceId(), e.GetSpanId(),
+	)
+	return err
+}
+
+// marshalAuditTodo ないものはNULLにする
+func marshalAuditTodo(todo *todoPb.Todo) (sql.NullString, error) {
+	if todo == nil {
+		return sql.NullString{}, nil
+	}
+	b, err := protojson.Marshal(todo)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+func (a *sqlAudit) listAuditEvents(ctx context.Context, query auditQuery) ([]*todoPb.AuditEvent, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	where := []string{`tenant_id = ?`}
+	args := []any{tenant}
+	if query.todoID != "" {
+		where = append(where, `todo_id = ?`)
+		args = append(args, query.todoID)
+	}
+	if query.actor != "" {
+		where = append(where, `actor = ?`)
+		args = append(args, query.actor)
+	}
+	if query.action != todoPb.AuditEvent_ACTION_UNSPECIFIED {
+		where = append(where, `action = ?`)
+		args = append(args, query.action)
+	}
+	if !query.start.IsZero() {
+		where = append(where, `event_time >= ?`)
+		args = append(args, query.start.UnixNano())
+	}
+	if !query.end.IsZero() {
+		where = append(where, `event_time < ?`)
+		args = append(args, query.end.UnixNano())
+	}
+	if c := query.after; c != nil {
+		where = append(where, `(event_time, id) < (?, ?)`)
+		args = append(args, c.EventTime.UnixNano(), c.ID)
+	}
+
+	rows, err := a.db.QueryContext(ctx,
+		`SELECT `+auditColumns+` FROM audit_events`+whereClause(where)+` ORDER BY event_time DESC, id DESC LIMIT ?`,
+		append(args, query.limit)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*todoPb.AuditEvent
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func scanAuditEvent(s scanner) (*todoPb.AuditEvent, error) {
+	var (
+		e             todoPb.AuditEvent
+		before, after sql.NullString
+		changed       string
+		eventTime     int64
+	)
+	if err := s.Scan(&e.Id, &e.TenantId, &e.TodoId, &e.Action, &e.Actor, &before, &after, &changed,
+		&eventTime, &e.TraceId, &e.SpanId); err != nil {
+		return nil, err
+	}
+	for _, t := range []struct {
+		src sql.NullString
+		dst **todoPb.Todo
+	}{{before, &e.Before}, {after, &e.After}} {
+		if !t.src.Valid {
+			continue
+		}
+		*t.dst = &todoPb.Todo{}
+		if err := protojson.Unmarshal([]byte(t.src.String), *t.dst); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal([]byte(changed), &e.ChangedFields); err != nil {
+		return nil, err
+	}
+	e.EventTime = timestamppb.New(time.Unix(0, eventTime))
+	return &e, nil
+}
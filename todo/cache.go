@@ -0,0 +1,226 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	greetPb "gen/go/greet"
+	"sync"
+	"time"
+
+	otelapi "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// greetの応答のキャッシュ
+// 同じテナントの同じリクエストのSayHelloはTTLの間キャッシュした応答を返し、同時に来たものは1回の呼び出しにまとめる。
+// キャッシュした応答もまとめた応答も同じIDを返すので、デフォルトではどちらもせず、毎回greetを呼ぶ。
+// IDが重なってもよい場合だけGREET_CACHE_TTLを指定する
+
+const (
+	cacheTTLEnv         = "GREET_CACHE_TTL"
+	cacheMaxEntriesEnv  = "GREET_CACHE_MAX_ENTRIES"
+	cacheCallTimeoutEnv = "GREET_CACHE_CALL_TIMEOUT"
+
+	defaultCacheTTL         = 0
+	defaultCacheMaxEntries  = 1000
+	defaultCacheCallTimeout = 2 * time.Second
+)
+
+// 結果。spanの属性とメトリクスに使う
+const (
+	cacheHit       = "hit"
+	cacheMiss      = "miss"
+	cacheCoalesced = "coalesced"
+)
+
+type greetingCache struct {
+	// 0ならキャッシュも、同時に来たリクエストをまとめることもしない
+	ttl        time.Duration
+	maxEntries int
+	// まとめた呼び出しのタイムアウト。呼び出し元のキャンセルとdeadlineは引き継がない
+	callTimeout time.Duration
+	now         func() time.Time
+
+	mu sync.Mutex
+	// 最近使ったものが前
+	lru     *list.List
+	entries map[string]*list.Element
+
+	group singleflight.Group
+
+	lookups metric.Int64Counter
+}
+
+type cacheEntry struct {
+	key     string
+	res     *greetPb.HelloResponse
+	expires time.Time
+}
+
+func newGreetingCache() (*greetingCache, error) {
+	ttl, err := millisFromEnv(cacheTTLEnv, defaultCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+	maxEntries, err := intFromEnv(cacheMaxEntriesEnv, defaultCacheMaxEntries)
+	if err != nil {
+		return nil, err
+	}
+	callTimeout, err := millisFromEnv(cacheCallTimeoutEnv, defaultCacheCallTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if callTimeout <= 0 {
+		return nil, fmt.Errorf("%s must be positive", cacheCallTimeoutEnv)
+	}
+
+	c := &greetingCache{
+		ttl:         ttl,
+		maxEntries:  maxEntries,
+		callTimeout: callTimeout,
+		now:         time.Now,
+		lru:         list.New(),
+		entries:     map[string]*list.Element{},
+	}
+
+	meter := otelapi.Meter("todo")
+	if c.lookups, err = meter.Int64Counter("todo.greet.cache.lookups",
+		metric.WithDescription("Number of greet lookups by cache result"),
+		metric.WithUnit("{lookup}"),
+	); err != nil {
+		return nil, err
+	}
+	if _, err = meter.Int64ObservableGauge("todo.greet.cache.entries",
+		metric.WithDescription("Number of cached greet responses"),
+		metric.WithUnit("{entry}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			o.Observe(int64(c.lru.Len()))
+			return nil
+		}),
+	); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// sayHello キャッシュになければcallを呼ぶ
+// 同時に来た同じリクエストは最初の1件だけがcallを呼び、残りはその結果を待つ
+func (c *greetingCache) sayHello(ctx context.Context, req *greetPb.HelloRequest, call func(context.Context) (*greetPb.HelloResponse, error)) (*greetPb.HelloResponse, error) {
+	if c.ttl <= 0 {
+		return call(ctx)
+	}
+	key, err := cacheKey(ctx, req)
+	if err != nil {
+		return call(ctx)
+	}
+
+	if res, ok := c.get(key); ok {
+		c.record(ctx, cacheHit)
+		return res, nil
+	}
+
+	leader := false
+	ch := c.group.DoChan(key, func() (any, error) {
+		leader = true
+		// 待っている他のリクエストがあるので、最初のリクエストがキャンセルされても止めない。
+		// 最初のリクエストのdeadlineも引き継がないので、代わりにcallTimeoutで打ち切る。
+		// キーにテナントが入っているので、greetに渡るテナントは待っている全員で同じ
+		callCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.callTimeout)
+		defer cancel()
+		res, err := call(callCtx)
+		if err == nil {
+			c.put(key, res)
+		}
+		return res, err
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-ch:
+		// 関数を実行したのは自分のDoChanで渡したものだけなので、それ以外はまとめられた側
+		// leaderへの書き込みはchへの送信より前に起きる
+		result := cacheCoalesced
+		if leader {
+			result = cacheMiss
+		}
+		c.record(ctx, result)
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		return proto.Clone(r.Val.(*greetPb.HelloResponse)).(*greetPb.HelloResponse), nil
+	}
+}
+
+func (c *greetingCache) record(ctx context.Context, result string) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("todo.greet.cache", result))
+	c.lookups.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+}
+
+func (c *greetingCache) get(key string) (*greetPb.HelloResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !c.now().Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return proto.Clone(e.res).(*greetPb.HelloResponse), true
+}
+
+func (c *greetingCache) put(key string, res *greetPb.HelloResponse) {
+	if c.maxEntries <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := &cacheEntry{key: key, res: proto.Clone(res).(*greetPb.HelloResponse), expires: c.now().Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// cacheKey テナントとリクエストのメッセージをキーにする。フィールドの順序が変わらないようにdeterministicで直列化する
+// テナントが違えば同じリクエストでも別の呼び出しにし、他のテナントの応答を返さない
+func cacheKey(ctx context.Context, req proto.Message) (string, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("cache key: %w", err)
+	}
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("cache key: %w", err)
+	}
+	return tenant + "\x00" + string(b), nil
+}
+
+// SayHello キャッシュを通してgreetのSayHelloを呼ぶ
+func (c *GreetClient) SayHello(ctx context.Context, req *greetPb.HelloRequest, opts ...grpc.CallOption) (*greetPb.HelloResponse, error) {
+	return c.cache.sayHello(ctx, req, func(ctx context.Context) (*greetPb.HelloResponse, error) {
+		return c.GreetServiceClient.SayHello(ctx, req, opts...)
+	})
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// intFromEnv 0以上の整数を読む。未設定ならdef
+func intFromEnv(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s: invalid value %q", key, v)
+	}
+	return n, nil
+}
+
+// millisFromEnv ミリ秒で指定された期間を読む。未設定ならdef
+func millisFromEnv(key string, def time.Duration) (time.Duration, error) {
+	ms, err := intFromEnv(key, int(def/time.Millisecond))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
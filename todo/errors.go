@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	grpcCodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// 依存先のエラーの変換
+// greetから返ったエラーをtodoの呼び出し元向けのstatusに変換し、google.rpcのエラー詳細を付ける
+//   - ErrorInfo: どの依存先で何が起きたか (domain, reason)
+//   - RequestInfo: トレースIDで、エラーからトレースを引ける
+//   - RetryInfo: 再試行して良い場合の待ち時間
+
+// ErrorInfoのdomain
+const errorDomain = "todo.otel-go-sample"
+
+// 再試行して良いエラーで返す待ち時間
+const retryDelay = time.Second
+
+// ErrorInfoのreason
+const (
+	reasonUnavailable     = "DEPENDENCY_UNAVAILABLE"
+	reasonTimeout         = "DEPENDENCY_TIMEOUT"
+	reasonOverloaded      = "DEPENDENCY_OVERLOADED"
+	reasonInvalidArgument = "DEPENDENCY_INVALID_ARGUMENT"
+	reasonFailed          = "DEPENDENCY_FAILED"
+	// 指定したetagが今のtodoと違う。bffはHTTPの412にする
+	reasonEtagMismatch = "ETAG_MISMATCH"
+	// etagを指定していない更新の間に他の更新があった。そのままやり直して良い
+	reasonConcurrentModification = "CONCURRENT_MODIFICATION"
+	// Idempotency-Keyが別の中身のリクエストで使われた
+	reasonIdempotencyKeyReused = "IDEMPOTENCY_KEY_REUSED"
+	// 同じIdempotency-Keyのリクエストがまだ処理中
+	reasonIdempotencyKeyInProgress = "IDEMPOTENCY_KEY_IN_PROGRESS"
+	// WatchTodosのresume_tokenの続きが履歴にない
+	reasonResumeTokenExpired = "RESUME_TOKEN_EXPIRED"
+	// WatchTodosの受け取りが遅く、イベントが溜まりすぎた
+	reasonWatcherTooSlow = "WATCHER_TOO_SLOW"
+	// テナントのリクエストが多すぎる。RetryInfoの時間だけ待ってから再試行する
+	reasonTenantRateLimited = "TENANT_RATE_LIMITED"
+	// テナントのtodoが上限に達している。消すまで作れない
+	reasonTodoQuotaExceeded = "TODO_QUOTA_EXCEEDED"
+)
+
+// downstreamError 依存先のエラーをstatusに変換し、spanにも記録する
+// 呼び出し元の都合で止まった場合(キャンセルとデッドライン)はそのまま返す
+func downstreamError(ctx context.Context, dependency string, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return status.FromContextError(ctxErr).Err()
+	}
+
+	st, _ := status.FromError(err)
+	var (
+		code   grpcCodes.Code
+		reason string
+		retry  bool
+	)
+	switch st.Code() {
+	case grpcCodes.Unavailable:
+		code, reason, retry = grpcCodes.Unavailable, reasonUnavailable, true
+	case grpcCodes.DeadlineExceeded:
+		code, reason, retry = grpcCodes.DeadlineExceeded, reasonTimeout, true
+	case grpcCodes.ResourceExhausted:
+		// バルクヘッドで断った場合もここに来る
+		code, reason, retry = grpcCodes.ResourceExhausted, reasonOverloaded, true
+	case grpcCodes.InvalidArgument:
+		// 入力はtodoの呼び出し元から来ているので、そのまま伝える
+		code, reason = grpcCodes.InvalidArgument, reasonInvalidArgument
+	default:
+		code, reason = grpcCodes.Internal, reasonFailed
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err, trace.WithAttributes(attribute.String("dependency", dependency)))
+	span.SetStatus(codes.Error, st.Message())
+	span.SetAttributes(attribute.String("error.type", reason))
+
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{
+		Domain: errorDomain,
+		Reason: reason,
+		Metadata: map[string]string{
+			"dependency":      dependency,
+			"dependency_code": st.Code().String(),
+		},
+	}}
+	if info := requestInfo(span); info != nil {
+		details = append(details, info)
+	}
+	if retry {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: durationpb.New(retryDelay)})
+	}
+
+	res := status.New(code, dependency+": "+st.Message())
+	if withDetails, err := res.WithDetails(details...); err == nil {
+		res = withDetails
+	}
+	return res.Err()
+}
+
+// etagMismatchError 他で更新されたtodoを古いetagで書き換えようとした
+// 読み直してから再度更新してもらうので、FailedPreconditionにする
+func etagMismatchError(ctx context.Context) error {
+	return todoError(ctx, grpcCodes.FailedPrecondition, reasonEtagMismatch, "etag does not match the current todo")
+}
+
+// todoError todo自身が断ったエラーに、ErrorInfoとRequestInfoを付ける。extraはその後ろに付ける
+func todoError(ctx context.Context, code grpcCodes.Code, reason, msg string, extra ...protoadapt.MessageV1) error {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("error.type", reason))
+
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{
+		Domain: errorDomain,
+		Reason: reason,
+	}}
+	if info := requestInfo(span); info != nil {
+		details = append(details, info)
+	}
+	details = append(details, extra...)
+	res := status.New(code, msg)
+	if withDetails, err := res.WithDetails(details...); err == nil {
+		res = withDetails
+	}
+	return res.Err()
+}
+
+// requestInfo トレースIDをリクエストIDとして返す。トレースしていなければnil
+func requestInfo(span trace.Span) *errdetails.RequestInfo {
+	sc := span.SpanContext()
+	if !sc.HasTraceID() {
+		return nil
+	}
+	return &errdetails.RequestInfo{
+		RequestId:   sc.TraceID().String(),
+		ServingData: sc.SpanID().String(),
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	greetPb "gen/go/greet"
+	"log"
+	"os"
+	"pkg/resilience"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+)
+
+// greetのクライアント
+// 起動時に1度だけ作り、todoServerとヘルスチェックで同じコネクションを使い回す。
+// 接続は最初のRPCで張られ、切れた場合もgRPCが張り直す。つながらない間のRPCはUnavailableで返る
+
+const (
+	greetTargetEnv = "GREET_TARGET"
+
+	// dns:///にするとgreetのすべてのアドレスを解決し、round_robinで振り分ける
+	defaultGreetTarget = "dns:///greet:8082"
+
+	// 接続が張られてから使われないままでも、この間隔でpingを送って死んだ接続を検出する
+	// greet側のkeepalive.EnforcementPolicyのMinTimeより長くすること
+	greetKeepaliveTime    = 30 * time.Second
+	greetKeepaliveTimeout = 10 * time.Second
+)
+
+type GreetClient struct {
+	greetPb.GreetServiceClient
+	conn  *grpc.ClientConn
+	cache *greetingCache
+}
+
+// NewGreetClient GREET_TARGETに接続するクライアントを作る
+// この時点では接続しないので、greetが起動していなくても失敗しない
+func NewGreetClient() (*GreetClient, error) {
+	target := os.Getenv(greetTargetEnv)
+	if target == "" {
+		target = defaultGreetTarget
+	}
+
+	serviceConfig, hedging, err := loadGreetServiceConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := newGreetingCache()
+	if err != nil {
+		return nil, err
+	}
+
+	// greetが不調なときにtodoのgoroutineが溜まらないように、すぐに失敗させる
+	resilienceConfig, err := resilience.ConfigFromEnv("GREET")
+	if err != nil {
+		return nil, err
+	}
+	guard, err := resilience.New("greet", resilienceConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := grpc.NewClient(
+		target,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		// タイムアウトと再試行はサービス設定で決める。hedgingだけはインターセプターで扱う
+		grpc.WithDefaultServiceConfig(serviceConfig),
+		// サーキットブレーカーとバルクヘッドは再試行とhedgingの外側に置き、1回の呼び出しを1件として数える
+		// テナントはbaggageでも伝わるが、greetのログでも引けるようにメタデータにも入れる
+		grpc.WithChainUnaryInterceptor(tenantClientInterceptor, guard.UnaryClientInterceptor(), hedging.unaryInterceptor, countAttemptsUnary),
+		grpc.WithChainStreamInterceptor(tenantStreamClientInterceptor, guard.StreamClientInterceptor(), countAttemptsStream),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                greetKeepaliveTime,
+			Timeout:             greetKeepaliveTimeout,
+			PermitWithoutStream: true,
+		}),
+		// 再試行の記録はotelgrpcより前に登録する
+		grpc.WithStatsHandler(attemptHandler{}),
+		// ストリームで受け取ったメッセージごとにspanのイベントを残す
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler(
+			otelgrpc.WithMessageEvents(otelgrpc.ReceivedEvents, otelgrpc.SentEvents),
+		)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("greet client for %q: %w", target, err)
+	}
+	log.Printf("greet client created for %s", target)
+
+	return &GreetClient{
+		GreetServiceClient: greetPb.NewGreetServiceClient(conn),
+		conn:               conn,
+		cache:              cache,
+	}, nil
+}
+
+// Conn 同じ接続で別のサービス(ヘルスチェックなど)を呼ぶときに使う
+func (c *GreetClient) Conn() grpc.ClientConnInterface {
+	return c.conn
+}
+
+// Close サーバーが止まった後に呼ぶ。以降のRPCはCanceledで失敗する
+func (c *GreetClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	greetPb "gen/go/greet"
+	todoPb "gen/go/todo"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// GetGreeting greetのSayHelloを呼び、挨拶を返す
+func (s *todoServer) GetGreeting(ctx context.Context, req *todoPb.GetGreetingRequest) (*todoPb.Greeting, error) {
+	// 名前を省略した場合はgreetのバリデーションに通るデフォルトを使う
+	name := req.GetName()
+	if name == "" {
+		name = "World"
+	}
+
+	res, err := s.greet.SayHello(ctx, &greetPb.HelloRequest{
+		Name:   name,
+		Locale: req.GetLocale(),
+	})
+	if err != nil {
+		return nil, downstreamError(ctx, "greet", err)
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("greet.id", int64(res.Id)))
+
+	return &todoPb.Greeting{
+		Id:      res.Id,
+		Message: res.Message,
+		Locale:  res.Locale,
+	}, nil
+}
+
+// GetGreetings greetのStreamGreetingsを最後まで受け取り、まとめて返す
+// 呼び出し元がキャンセルするとストリームも止まる
+func (s *todoServer) GetGreetings(ctx context.Context, req *todoPb.GetGreetingsRequest) (*todoPb.GetGreetingsResponse, error) {
+	span := trace.SpanFromContext(ctx)
+
+	name := req.GetName()
+	if name == "" {
+		name = "World"
+	}
+
+	start := time.Now()
+	stream, err := s.greet.StreamGreetings(ctx, &greetPb.StreamGreetingsRequest{
+		Hello: &greetPb.HelloRequest{
+			Name:   name,
+			Locale: req.GetLocale(),
+		},
+		Count:      req.GetCount(),
+		IntervalMs: req.GetIntervalMs(),
+	})
+	if err != nil {
+		return nil, downstreamError(ctx, "greet", err)
+	}
+
+	res := &todoPb.GetGreetingsResponse{}
+	var ids []int64
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, downstreamError(ctx, "greet", err)
+		}
+		ids = append(ids, int64(msg.GetId()))
+		res.Greetings = append(res.Greetings, &todoPb.Greeting{
+			Id:      msg.GetId(),
+			Message: msg.GetMessage(),
+			Locale:  msg.GetLocale(),
+		})
+	}
+	res.Count = uint32(len(res.Greetings))
+	res.ElapsedMs = uint64(time.Since(start).Milliseconds())
+
+	span.SetAttributes(
+		attribute.Int("todo.greetings.count", int(res.Count)),
+		attribute.Int64Slice("greet.ids", ids),
+		attribute.Int64("todo.greetings.elapsed_ms", int64(res.ElapsedMs)),
+	)
+	return res, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	otelapi "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// 依存先のヘルスチェック
+// todoはgreetがないとGetを返せないので、greetのHealth/Checkを定期的に呼び、結果をtodo自身の状態に反映する。
+// 状態が細かく揺れないように、連続して失敗・成功した回数が閾値を超えたときだけ切り替える。
+
+const (
+	probeIntervalEnv = "GREET_HEALTH_INTERVAL"
+	probeTimeoutEnv  = "GREET_HEALTH_TIMEOUT"
+
+	defaultProbeInterval = 5 * time.Second
+	defaultProbeTimeout  = time.Second
+
+	// NOT_SERVINGにするまでの連続した失敗の回数
+	probeFailureThreshold = 3
+	// SERVINGに戻すまでの連続した成功の回数
+	probeSuccessThreshold = 2
+
+	// todoのヘルスチェックで依存先の状態を返すときのサービス名
+	// bffはこれを見て、どこで止まっているのかを返す
+	greetDependency = "dependency/greet"
+)
+
+type dependencyProber struct {
+	name     string
+	client   healthpb.HealthClient
+	service  string
+	interval time.Duration
+	timeout  time.Duration
+
+	hs *health.Server
+	// 依存先の状態に合わせて更新するtodoのサービス名
+	services []string
+
+	mu        sync.Mutex
+	healthy   bool
+	failures  int
+	successes int
+
+	tracer   trace.Tracer
+	probes   metric.Int64Counter
+	duration metric.Float64Histogram
+}
+
+// newDependencyProber connのHealthでserviceを確認し、hsのservicesを更新する
+// 起動直後は依存先が使えるものとして扱い、失敗が続いたときだけNOT_SERVINGにする
+func newDependencyProber(name string, conn grpc.ClientConnInterface, service string, hs *health.Server, services []string) (*dependencyProber, error) {
+	interval, err := millisFromEnv(probeIntervalEnv, defaultProbeInterval)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := millisFromEnv(probeTimeoutEnv, defaultProbeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 || timeout <= 0 {
+		return nil, fmt.Errorf("%s and %s must be positive", probeIntervalEnv, probeTimeoutEnv)
+	}
+
+	p := &dependencyProber{
+		name:     name,
+		client:   healthpb.NewHealthClient(conn),
+		service:  service,
+		interval: interval,
+		timeout:  timeout,
+		hs:       hs,
+		services: services,
+		healthy:  true,
+		tracer:   otelapi.Tracer("todo"),
+	}
+
+	meter := otelapi.Meter("todo")
+	if p.probes, err = meter.Int64Counter("todo.dependency.probes",
+		metric.WithDescription("Number of health probes sent to a dependency"),
+		metric.WithUnit("{probe}"),
+	); err != nil {
+		return nil, err
+	}
+	if p.duration, err = meter.Float64Histogram("todo.dependency.probe.duration",
+		metric.WithDescription("Duration of health probes sent to a dependency"),
+		metric.WithUnit("s"),
+	); err != nil {
+		return nil, err
+	}
+	if _, err = meter.Int64ObservableGauge("todo.dependency.up",
+		metric.WithDescription("Whether a dependency is considered available (1) or not (0)"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			var up int64
+			if p.isHealthy() {
+				up = 1
+			}
+			o.Observe(up, metric.WithAttributes(attribute.String("dependency", p.name)))
+			return nil
+		}),
+	); err != nil {
+		return nil, err
+	}
+
+	p.setStatus()
+	return p, nil
+}
+
+// run ctxが終わるまで定期的に確認する
+func (p *dependencyProber) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.probe(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *dependencyProber) probe(ctx context.Context) {
+	ctx, span := p.tracer.Start(ctx, "todo.dependency.probe", trace.WithAttributes(
+		attribute.String("dependency", p.name),
+		attribute.String("rpc.grpc.health.service", p.service),
+	))
+	defer span.End()
+
+	start := time.Now()
+	checkCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	res, err := p.client.Check(checkCtx, &healthpb.HealthCheckRequest{Service: p.service})
+	cancel()
+	elapsed := time.Since(start)
+
+	result := res.GetStatus().String()
+	if err != nil {
+		result = "error"
+	}
+	attrs := metric.WithAttributes(
+		attribute.String("dependency", p.name),
+		attribute.String("result", result),
+	)
+	p.probes.Add(ctx, 1, attrs)
+	p.duration.Record(ctx, elapsed.Seconds(), attrs)
+
+	eventAttrs := []attribute.KeyValue{
+		attribute.String("result", result),
+		attribute.Int64("duration_ms", elapsed.Milliseconds()),
+	}
+	if err != nil {
+		eventAttrs = append(eventAttrs, attribute.String("error", err.Error()))
+	}
+	span.AddEvent("dependency.probe", trace.WithAttributes(eventAttrs...))
+
+	ok := err == nil && res.GetStatus() == healthpb.HealthCheckResponse_SERVING
+	if changed, healthy := p.record(ok); changed {
+		span.AddEvent("dependency.status_changed", trace.WithAttributes(attribute.Bool("healthy", healthy)))
+		log.Printf("dependency %s is now %s (last probe: %s)", p.name, statusOf(healthy), result)
+		p.setStatus()
+	}
+}
+
+// record 結果を数え、状態が切り替わったかどうかを返す
+func (p *dependencyProber) record(ok bool) (changed, healthy bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ok {
+		p.failures = 0
+		p.successes++
+		if !p.healthy && p.successes >= probeSuccessThreshold {
+			p.healthy = true
+			return true, true
+		}
+	} else {
+		p.successes = 0
+		p.failures++
+		if p.healthy && p.failures >= probeFailureThreshold {
+			p.healthy = false
+			return true, false
+		}
+	}
+	return false, p.healthy
+}
+
+func (p *dependencyProber) isHealthy() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.healthy
+}
+
+// setStatus 依存先とtodoのサービスの状態を更新する
+// 停止中はhealth.ServerがNOT_SERVINGのまま更新を無視する
+func (p *dependencyProber) setStatus() {
+	s := statusOf(p.isHealthy())
+	p.hs.SetServingStatus(greetDependency, s)
+	for _, name := range p.services {
+		p.hs.SetServingStatus(name, s)
+	}
+}
+
+func statusOf(healthy bool) healthpb.HealthCheckResponse_ServingStatus {
+	if healthy {
+		return healthpb.HealthCheckResponse_SERVING
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	grpcCodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// hedging
+// 応答がhedgingDelayの間に返らなければ、同じリクエストをもう1本送り、最初に返った結果を使う。
+// 遅いgreetが1台あってもレイテンシが引きずられないようにするためのもの。
+// 単項のRPCだけが対象で、ストリーミングのRPCには使わない
+
+// gRPCの仕様に合わせて、試行の回数は5回までにする
+const maxHedgingAttempts = 5
+
+type hedgingPolicy struct {
+	maxAttempts int
+	delay       time.Duration
+	// このコードで失敗した場合は、待たずに次の試行を送る。それ以外のエラーはそのまま返す
+	nonFatal map[grpcCodes.Code]bool
+}
+
+// "/service/method" または "/service/" ごとの設定
+type hedgingPolicies map[string]*hedgingPolicy
+
+func (ps hedgingPolicies) lookup(method string) (*hedgingPolicy, bool) {
+	if p, ok := ps[method]; ok {
+		return p, true
+	}
+	// "/service/method" から "/service/" を取り出す
+	for i := len(method) - 1; i > 0; i-- {
+		if method[i] == '/' {
+			p, ok := ps[method[:i+1]]
+			return p, ok
+		}
+	}
+	return nil, false
+}
+
+type hedgingResult struct {
+	reply   proto.Message
+	err     error
+	attempt int
+}
+
+// unaryInterceptor 設定のあるメソッドだけhedgingする
+// 試行を送るたびに呼び出し元のspanにイベント rpc.hedge.attempt を残す
+func (ps hedgingPolicies) unaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	p, ok := ps.lookup(method)
+	out, isProto := reply.(proto.Message)
+	if !ok || !isProto {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	span := trace.SpanFromContext(ctx)
+	// 返った時点で残りの試行はキャンセルする
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgingResult, p.maxAttempts)
+	launched := 0
+	launch := func() {
+		launched++
+		attempt := launched
+		span.AddEvent("rpc.hedge.attempt", trace.WithAttributes(
+			attribute.String("rpc.method", method),
+			attribute.Int("rpc.hedge.attempt", attempt),
+		))
+		r := out.ProtoReflect().New().Interface()
+		go func() {
+			err := invoker(ctx, method, req, r, cc, opts...)
+			results <- hedgingResult{reply: r, err: err, attempt: attempt}
+		}()
+	}
+
+	launch()
+	timer := time.NewTimer(p.delay)
+	defer timer.Stop()
+
+	var lastErr error
+	for pending := 1; pending > 0; {
+		select {
+		case <-timer.C:
+			if launched < p.maxAttempts {
+				launch()
+				pending++
+				timer.Reset(p.delay)
+			}
+		case r := <-results:
+			pending--
+			code := status.Code(r.err)
+			if r.err == nil || !p.nonFatal[code] {
+				span.AddEvent("rpc.hedge.result", trace.WithAttributes(
+					attribute.Int("rpc.hedge.attempt", r.attempt),
+					attribute.Int("rpc.hedge.attempts", launched),
+					attribute.String("rpc.grpc.status_code", code.String()),
+				))
+				if r.err == nil {
+					proto.Reset(out)
+					proto.Merge(out, r.reply)
+				}
+				return r.err
+			}
+			lastErr = r.err
+			if launched < p.maxAttempts {
+				launch()
+				pending++
+				timer.Reset(p.delay)
+			}
+		}
+	}
+	return lastErr
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	todoPb "gen/go/todo"
+	"log"
+	"time"
+
+	otelapi "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	grpcCodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// Idempotency-Keyによる重複の防止
+// メタデータidempotency-keyのついたリクエストは、最初に成功したレスポンスをTTLの間保存し、
+// 同じキーでもう一度来たら処理せずに同じレスポンスを返す。
+//   - 同じキーで中身の違うリクエスト: INVALID_ARGUMENT
+//   - 最初のリクエストがまだ処理中: ABORTED。少し待ってやり直してもらう
+//   - 最初のリクエストが失敗した: 何も残さないので、同じキーでやり直せる
+
+const (
+	idempotencyTTLEnv     = "TODO_IDEMPOTENCY_TTL"
+	defaultIdempotencyTTL = 24 * time.Hour
+
+	// 処理中の予約の期限。処理中にプロセスが落ちても、これを過ぎれば同じキーでやり直せる
+	idempotencyLease = time.Minute
+
+	idempotencyKeyMetadata   = "idempotency-key"
+	maxIdempotencyKeyLength  = 255
+	idempotentReplayedHeader = "idempotent-replayed"
+)
+
+// キーを使えるRPC。作成のように、やり直すと結果が増えるものだけ
+var idempotentMethods = map[string]bool{
+	todoPb.TodoApi_CreateTodo_FullMethodName: true,
+}
+
+// 結果。spanの属性とメトリクスに使う
+const (
+	idempotencyNew        = "new"
+	idempotencyReplayed   = "replayed"
+	idempotencyMismatch   = "mismatch"
+	idempotencyInProgress = "in_progress"
+)
+
+// errNotReserved completeしようとしたキーが処理中として押さえられていない。予約の期限が切れた
+var errNotReserved = errors.New("idempotency key is not reserved")
+
+// idempotencyRecord 保存されているキーの記録
+type idempotencyRecord struct {
+	requestHash []byte
+	// 処理中ならnil
+	response []byte
+}
+
+type idempotencyStore interface {
+	// reserve キーが空いていれば処理中として押さえてnilを返す。使われていればその記録を返す
+	// 期限を過ぎた記録はないものとして扱う
+	reserve(ctx context.Context, method, key string, requestHash []byte, now, leaseExpire time.Time) (*idempotencyRecord, error)
+	// complete 処理中のキーにレスポンスを保存し、期限をexpireまで延ばす
+	complete(ctx context.Context, method, key string, response []byte, expire time.Time) error
+	// release 処理中のキーを消す
+	release(ctx context.Context, method, key string) error
+}
+
+type idempotency struct {
+	store idempotencyStore
+	// 0なら何もしない
+	ttl time.Duration
+	now func() time.Time
+
+	requests metric.Int64Counter
+}
+
+func newIdempotency(store idempotencyStore) (*idempotency, error) {
+	ttl, err := millisFromEnv(idempotencyTTLEnv, defaultIdempotencyTTL)
+	if err != nil {
+		return nil, err
+	}
+	i := &idempotency{store: store, ttl: ttl, now: time.Now}
+	if i.requests, err = otelapi.Meter("todo").Int64Counter("todo.idempotency.requests",
+		metric.WithDescription("Number of requests with an idempotency key by result"),
+		metric.WithUnit("{request}"),
+	); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func (i *idempotency) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if i.ttl <= 0 || !idempotentMethods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+		key := idempotencyKeyFromContext(ctx)
+		if key == "" {
+			return handler(ctx, req)
+		}
+		return i.handle(ctx, info.FullMethod, key, req.(proto.Message), handler)
+	}
+}
+
+func (i *idempotency) handle(ctx context.Context, method, key string, req proto.Message, handler grpc.UnaryHandler) (any, error) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("idempotency.key", key))
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, invalidArgument(ctx, fmt.Errorf("idempotency key must be at most %d bytes", maxIdempotencyKeyLength))
+	}
+
+	hash, err := requestHash(req)
+	if err != nil {
+		return nil, status.Error(grpcCodes.Internal, err.Error())
+	}
+	now := i.now()
+	rec, err := i.store.reserve(ctx, method, key, hash, now, now.Add(idempotencyLease))
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+
+	switch {
+	case rec == nil:
+		i.record(ctx, idempotencyNew)
+		res, err := handler(ctx, req)
+		// 呼び出し元がキャンセルしても、押さえたキーは片付ける
+		ctx := context.WithoutCancel(ctx)
+		if err != nil {
+			if err := i.store.release(ctx, method, key); err != nil {
+				log.Printf("failed to release idempotency key: %v", err)
+			}
+			return nil, err
+		}
+		b, err := marshalResponse(res)
+		if err == nil {
+			err = i.store.complete(ctx, method, key, b, i.now().Add(i.ttl))
+		}
+		if err != nil {
+			// 処理は終わっているので、レスポンスは返す。キーは予約の期限が切れると空く
+			span.RecordError(err)
+			log.Printf("failed to save idempotent response: %v", err)
+		}
+		return res, nil
+
+	case !bytes.Equal(rec.requestHash, hash):
+		i.record(ctx, idempotencyMismatch)
+		return nil, todoError(ctx, grpcCodes.InvalidArgument, reasonIdempotencyKeyReused,
+			"idempotency key was already used with a different request")
+
+	case rec.response == nil:
+		i.record(ctx, idempotencyInProgress)
+		return nil, todoError(ctx, grpcCodes.Aborted, reasonIdempotencyKeyInProgress,
+			"a request with the same idempotency key is in progress")
+
+	default:
+		i.record(ctx, idempotencyReplayed)
+		res, err := unmarshalResponse(rec.response)
+		if err != nil {
+			return nil, status.Error(grpcCodes.Internal, err.Error())
+		}
+		span.AddEvent("idempotency.replayed")
+		grpc.SetHeader(ctx, metadata.Pairs(idempotentReplayedHeader, "true"))
+		return res, nil
+	}
+}
+
+func (i *idempotency) record(ctx context.Context, result string) {
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("idempotency.result", result),
+		attribute.Bool("idempotency.replayed", result == idempotencyReplayed),
+	)
+	i.requests.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+}
+
+func idempotencyKeyFromContext(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(idempotencyKeyMetadata); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// requestHash 同じキーで同じリクエストが来たかを比べる。deterministicで直列化する
+func requestHash(req proto.Message) ([]byte, error) {
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("idempotency request hash: %w", err)
+	}
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
+
+// レスポンスはAnyに包んで保存し、取り出すときに型を戻す
+func marshalResponse(res any) ([]byte, error) {
+	m, ok := res.(proto.Message)
+	if !ok {
+		return nil, errors.New("idempotency: response is not a proto message")
+	}
+	a, err := anypb.New(m)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(a)
+}
+
+func unmarshalResponse(b []byte) (proto.Message, error) {
+	var a anypb.Any
+	if err := proto.Unmarshal(b, &a); err != nil {
+		return nil, err
+	}
+	return a.UnmarshalNew()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryIdempotencyStore プロセスのメモリに保存する。再起動すると消える
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[idempotencyKey]*memoryIdempotencyRecord
+}
+
+// idempotencyKey 同じキーでもテナントが違えば別のリクエスト
+type idempotencyKey struct {
+	tenant, method, key string
+}
+
+type memoryIdempotencyRecord struct {
+	idempotencyRecord
+	expire time.Time
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{records: map[idempotencyKey]*memoryIdempotencyRecord{}}
+}
+
+func (s *memoryIdempotencyStore) reserve(ctx context.Context, method, key string, requestHash []byte, now, leaseExpire time.Time) (*idempotencyRecord, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 期限切れはここでまとめて消す。件数はTTLの間に来たリクエストの数までしか増えない
+	for k, r := range s.records {
+		if !now.Before(r.expire) {
+			delete(s.records, k)
+		}
+	}
+
+	k := idempotencyKey{tenant: tenant, method: method, key: key}
+	if r, ok := s.records[k]; ok {
+		rec := r.idempotencyRecord
+		return &rec, nil
+	}
+	s.records[k] = &memoryIdempotencyRecord{
+		idempotencyRecord: idempotencyRecord{requestHash: requestHash},
+		expire:            leaseExpire,
+	}
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) complete(ctx context.Context, method, key string, response []byte, expire time.Time) error {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[idempotencyKey{tenant: tenant, method: method, key: key}]
+	if !ok || r.response != nil {
+		return errNotReserved
+	}
+	r.response = response
+	r.expire = expire
+	return nil
+}
+
+func (s *memoryIdempotencyStore) release(ctx context.Context, method, key string) error {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := idempotencyKey{tenant: tenant, method: method, key: key}
+	if r, ok := s.records[k]; ok && r.response == nil {
+		delete(s.records, k)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// sqlIdempotencyStore todoと同じSQLiteのidempotency_keysに保存する。キーはテナントごとに分ける
+type sqlIdempotencyStore struct {
+	db *sqlDB
+}
+
+func newSQLIdempotencyStore(db *sqlDB) *sqlIdempotencyStore {
+	return &sqlIdempotencyStore{db: db}
+}
+
+func (s *sqlIdempotencyStore) reserve(ctx context.Context, method, key string, requestHash []byte, now, leaseExpire time.Time) (rec *idempotencyRecord, err error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.InTx(ctx, func(ctx context.Context, tx *sqlTx) error {
+		// 最初に書き込むので、トランザクションの間は他の予約と重ならない
+		if _, err := tx.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expire_time <= ?`, now.UnixNano()); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx,
+			`INSERT INTO idempotency_keys (tenant_id, method, key, request_hash, response, create_time, expire_time)
+			VALUES (?, ?, ?, ?, NULL, ?, ?) ON CONFLICT (tenant_id, method, key) DO NOTHING`,
+			tenant, method, key, requestHash, now.UnixNano(), leaseExpire.UnixNano(),
+		)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 1 {
+			return err
+		}
+
+		rec = &idempotencyRecord{}
+		return tx.QueryRowContext(ctx,
+			`SELECT request_hash, response FROM idempotency_keys WHERE tenant_id = ? AND method = ? AND key = ?`,
+			tenant, method, key,
+		).Scan(&rec.requestHash, &rec.response)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (s *sqlIdempotencyStore) complete(ctx context.Context, method, key string, response []byte, expire time.Time) error {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE idempotency_keys SET response = ?, expire_time = ?
+		WHERE tenant_id = ? AND method = ? AND key = ? AND response IS NULL`,
+		response, expire.UnixNano(), tenant, method, key,
+	)
+	if err := notFoundIfNoRows(res, err); !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return errNotReserved
+}
+
+func (s *sqlIdempotencyStore) release(ctx context.Context, method, key string) error {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx,
+		`DELETE FROM idempotency_keys WHERE tenant_id = ? AND method = ? AND key = ? AND response IS NULL`,
+		tenant, method, key)
+	return err
+}
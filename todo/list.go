@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	todoPb "gen/go/todo"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ListTodosのページングと絞り込み
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+func (s *todoServer) ListTodos(ctx context.Context, req *todoPb.ListTodosRequest) (*todoPb.ListTodosResponse, error) {
+	span := trace.SpanFromContext(ctx)
+
+	query, err := listQueryFromRequest(req)
+	if err != nil {
+		return nil, invalidArgument(ctx, err)
+	}
+	span.SetAttributes(
+		attribute.Int("todo.list.page_size", query.Limit),
+		attribute.String("todo.list.order_by", query.Order.String()),
+		attribute.Bool("todo.list.page_token", query.After != nil),
+	)
+
+	// 1件多く取り、次のページがあるかを調べる
+	limit := query.Limit
+	query.Limit++
+	todos, err := s.store.List(ctx, query)
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+
+	res := &todoPb.ListTodosResponse{Todos: todos}
+	if len(todos) > limit {
+		res.Todos = todos[:limit]
+		res.NextPageToken = encodePageToken(req, cursorAfter(res.Todos[limit-1], query.Order))
+	}
+	if req.GetIncludeTotalSize() {
+		n, err := s.store.Count(ctx, query.Filter)
+		if err != nil {
+			return nil, storeError(ctx, err)
+		}
+		res.TotalSize = proto.Int32(int32(n))
+	}
+
+	span.SetAttributes(
+		attribute.Int("todo.count", len(res.Todos)),
+		attribute.Bool("todo.list.next_page", res.NextPageToken != ""),
+	)
+	return res, nil
+}
+
+// listQueryFromRequest リクエストを検証し、ストアに渡す条件にする
+func listQueryFromRequest(req *todoPb.ListTodosRequest) (ListQuery, error) {
+	var query ListQuery
+
+	switch size := req.GetPageSize(); {
+	case size < 0:
+		return query, errors.New("page_size must not be negative")
+	case size == 0:
+		query.Limit = defaultPageSize
+	default:
+		query.Limit = int(min(size, maxPageSize))
+	}
+
+	order, err := parseOrderBy(req.GetOrderBy())
+	if err != nil {
+		return query, err
+	}
+	query.Order = order
+
+	query.Filter = TodoFilter{Done: req.Done, Query: req.GetQuery()}
+	query.Filter.CreateTimeStart, query.Filter.CreateTimeEnd, err = timeRange("create_time", req.GetCreateTimeStart(), req.GetCreateTimeEnd())
+	if err != nil {
+		return query, err
+	}
+	query.Filter.UpdateTimeStart, query.Filter.UpdateTimeEnd, err = timeRange("update_time", req.GetUpdateTimeStart(), req.GetUpdateTimeEnd())
+	if err != nil {
+		return query, err
+	}
+
+	if token := req.GetPageToken(); token != "" {
+		cursor, err := decodePageToken(req, token)
+		if err != nil {
+			return query, err
+		}
+		query.After = cursor
+	}
+	return query, nil
+}
+
+// timeRange 指定されなかった方はゼロ値にする
+func timeRange(name string, start, end *timestamppb.Timestamp) (time.Time, time.Time, error) {
+	var t [2]time.Time
+	for i, ts := range []*timestamppb.Timestamp{start, end} {
+		if ts == nil {
+			continue
+		}
+		if err := ts.CheckValid(); err != nil {
+			return t[0], t[1], fmt.Errorf("%s: %w", name, err)
+		}
+		t[i] = ts.AsTime()
+	}
+	if start != nil && end != nil && !t[0].Before(t[1]) {
+		return t[0], t[1], fmt.Errorf("%s_start must be before %s_end", name, name)
+	}
+	return t[0], t[1], nil
+}
+
+// parseOrderBy "create_time", "update_time desc"のように列と向きを1つだけ受け付ける
+func parseOrderBy(s string) (TodoOrder, error) {
+	fields := strings.Fields(strings.ToLower(s))
+	order := TodoOrder{Field: orderByCreateTime}
+	if len(fields) == 0 {
+		return order, nil
+	}
+	if len(fields) > 2 {
+		return order, fmt.Errorf("order_by: invalid %q", s)
+	}
+	switch fields[0] {
+	case orderByCreateTime, orderByUpdateTime, orderByTitle:
+		order.Field = fields[0]
+	default:
+		return order, fmt.Errorf("order_by: unknown field %q", fields[0])
+	}
+	if len(fields) == 2 {
+		switch fields[1] {
+		case "asc":
+		case "desc":
+			order.Desc = true
+		default:
+			return order, fmt.Errorf("order_by: invalid direction %q", fields[1])
+		}
+	}
+	return order, nil
+}
+
+// pageToken next_page_tokenの中身。クライアントからは中身を見せないように、JSONをbase64にして渡す
+type pageToken struct {
+	// 絞り込みと並び順のハッシュ。条件を変えて続きを取ろうとしたら弾く
+	Query string `json:"q"`
+	ID    string `json:"i"`
+	// 並び順の列の値。時刻はUnixナノ秒
+	Time  int64  `json:"t,omitempty"`
+	Title string `json:"s,omitempty"`
+}
+
+var errInvalidPageToken = errors.New("page_token is invalid or does not match the request")
+
+func encodePageToken(req *todoPb.ListTodosRequest, c *TodoCursor) string {
+	t := pageToken{Query: queryHash(req), ID: c.ID, Title: c.Title}
+	if !c.Time.IsZero() {
+		t.Time = c.Time.UnixNano()
+	}
+	b, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodePageToken(req *todoPb.ListTodosRequest, s string) (*TodoCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidPageToken
+	}
+	var t pageToken
+	if err := json.Unmarshal(b, &t); err != nil || t.ID == "" || t.Query != queryHash(req) {
+		return nil, errInvalidPageToken
+	}
+	c := &TodoCursor{ID: t.ID, Title: t.Title}
+	if t.Time != 0 {
+		c.Time = time.Unix(0, t.Time)
+	}
+	return c, nil
+}
+
+// queryHash ページをまたいで変わってはいけないフィールドのハッシュ
+func queryHash(req *todoPb.ListTodosRequest) string {
+	req = proto.Clone(req).(*todoPb.ListTodosRequest)
+	req.PageSize = 0
+	req.PageToken = ""
+	req.IncludeTotalSize = false
+	// order_byの書き方の違いは同じ条件として扱う
+	if order, err := parseOrderBy(req.OrderBy); err == nil {
+		req.OrderBy = order.String()
+	}
+	b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
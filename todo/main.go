@@ -2,17 +2,19 @@ package main
 
 import (
 	"context"
+	"errors"
 	greetPb "gen/go/greet"
 	todoPb "gen/go/todo"
 	"log"
 	"net"
 	"os/signal"
+	"pkg/grpcserver"
 	"pkg/otel"
 	"syscall"
 
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/reflection"
 )
 
@@ -27,64 +29,145 @@ func main() {
 	}
 }
 
-func run() error {
-	close := otel.NewTracerProvider("todo")
-	defer close()
+func run() (err error) {
+	shutdown, err := otel.Setup(context.Background(), "todo")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, shutdown(context.Background()))
+	}()
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	shutdownConfig, err := grpcserver.ShutdownConfigFromEnv()
+	if err != nil {
+		return err
+	}
+
 	ln, err := net.Listen("tcp", ":8081")
 	if err != nil {
-		log.Fatalf("Failed to start server %v", err)
+		return err
 	}
 	log.Printf("Server started at %v", ln.Addr())
 
-	srv := setupServer()
+	greet, err := NewGreetClient()
+	if err != nil {
+		return err
+	}
+	// Serveが返るのは処理中のリクエストが終わった後なので、ここで閉じても途中のRPCは切れない
+	defer greet.Close()
+
+	stores, err := openStore(ctx)
+	if err != nil {
+		return err
+	}
+	defer stores.todos.Close()
+
+	tenants, err := newTenants()
+	if err != nil {
+		return err
+	}
+	idempotency, err := newIdempotency(stores.idempotency)
+	if err != nil {
+		return err
+	}
+
+	b, err := openBroker()
+	if err != nil {
+		return err
+	}
+	// リレーが止まってから閉じる
+	defer b.Close()
+
+	watch, err := newWatchHub()
+	if err != nil {
+		return err
+	}
+	if _, err := b.Subscribe(todoEventsTopic, watch.consume); err != nil {
+		return err
+	}
+	// WatchTodosは終わらないので、止めるときに切ってGracefulStopを待たせない
 	go func() {
 		<-ctx.Done()
-		srv.GracefulStop()
-		log.Println("gRPC server stopped")
+		watch.close(context.Background())
+	}()
+
+	dispatcher := &webhookDispatcher{store: stores.webhooks}
+	if _, err := b.Subscribe(todoEventsTopic, dispatcher.consume); err != nil {
+		return err
+	}
+	webhookAddrs, err := newWebhookAddressPolicy()
+	if err != nil {
+		return err
+	}
+	webhooks, err := newWebhookWorker(stores.webhooks, webhookAddrs)
+	if err != nil {
+		return err
+	}
+	// 送っている途中の配信を記録し終えてから、保存先を閉じる
+	webhooksDone := make(chan struct{})
+	go func() {
+		defer close(webhooksDone)
+		webhooks.run(ctx)
 	}()
+	defer func() { <-webhooksDone }()
+
+	relay, err := newOutboxRelay(stores.outbox, b)
+	if err != nil {
+		return err
+	}
+	// 処理中のRPCが書いたイベントも送れるように、リレーはServeが返った後に止める
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		relay.run(relayCtx)
+	}()
+	defer func() {
+		stopRelay()
+		<-relayDone
+	}()
+
+	srv, hs := setupServer(&todoServer{store: stores.todos, webhooks: stores.webhooks, webhookAddrs: webhookAddrs, audit: stores.audit, greet: greet, watch: watch}, tenants, idempotency)
 
-	return srv.Serve(ln)
+	// greetの状態をtodoのヘルスチェックに反映する
+	prober, err := newDependencyProber("greet", greet.Conn(), greetPb.GreetService_ServiceDesc.ServiceName, hs,
+		append([]string{""}, grpcserver.Services(srv)...))
+	if err != nil {
+		return err
+	}
+	go prober.run(ctx)
+
+	return grpcserver.Serve(ctx, srv, hs, ln, shutdownConfig)
 }
 
 type todoServer struct {
 	todoPb.TodoApiServer
+	store    TodoStore
+	webhooks webhookStore
+	// Webhookに登録できる送り先
+	webhookAddrs *webhookAddressPolicy
+	audit        auditStore
+	greet        *GreetClient
+	watch        *watchHub
 }
 
-func setupServer() *grpc.Server {
+func setupServer(todo *todoServer, tenants *tenants, idempotency *idempotency) (*grpc.Server, *health.Server) {
 	srv := grpc.NewServer(
-		// grpc.ChainUnaryInterceptor(),
-		grpc.StatsHandler(otelgrpc.NewServerHandler()), // 分散トレーシングとメトリクスを有効にするためのgrpc.StatsHandlerを追加
+		// Idempotency-Keyはテナントごとなので、テナントを決めてから調べる
+		grpc.ChainUnaryInterceptor(tenants.UnaryServerInterceptor(), idempotency.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(tenants.StreamServerInterceptor()),
+		// 分散トレーシングとメトリクスを有効にするためのgrpc.StatsHandlerを追加
+		grpc.StatsHandler(otelgrpc.NewServerHandler(
+			otelgrpc.WithMessageEvents(otelgrpc.ReceivedEvents, otelgrpc.SentEvents),
+		)),
 	)
 
-	todoPb.RegisterTodoApiServer(srv, &todoServer{})
+	todoPb.RegisterTodoApiServer(srv, todo)
+	hs := grpcserver.NewHealthServer(srv)
 	reflection.Register(srv)
 
-	return srv
-}
-
-func (s *todoServer) Get(ctx context.Context, req *todoPb.GetRequest) (*todoPb.GetResponse, error) {
-	conn, err := grpc.DialContext(
-		ctx,
-		"greet:8082",
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
-	)
-	if err != nil {
-		log.Fatalf("did not connect: %v", err)
-	}
-	defer conn.Close()
-
-	client := greetPb.NewGreetServiceClient(conn)
-	res, err := client.SayHello(ctx, &greetPb.NoParam{})
-	if err != nil {
-		log.Fatalf("could not greet: %v", err)
-	}
-
-	return &todoPb.GetResponse{
-		Id: res.Id,
-	}, nil
+	return srv, hs
 }
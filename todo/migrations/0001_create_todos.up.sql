@@ -0,0 +1,9 @@
+-- 時刻はUnix時間(ナノ秒)で持つ
+CREATE TABLE todos (
+    id          TEXT    PRIMARY KEY,
+    title       TEXT    NOT NULL,
+    description TEXT    NOT NULL DEFAULT '',
+    done        INTEGER NOT NULL DEFAULT 0,
+    create_time INTEGER NOT NULL,
+    update_time INTEGER NOT NULL
+);
@@ -0,0 +1,4 @@
+DROP INDEX todos_done_create_time;
+DROP INDEX todos_title;
+DROP INDEX todos_update_time;
+DROP INDEX todos_create_time;
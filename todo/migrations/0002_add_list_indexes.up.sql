@@ -0,0 +1,6 @@
+-- ListTodosの並び順ごとに(列, id)のインデックスを作り、カーソルから続きを読めるようにする
+CREATE INDEX todos_create_time ON todos (create_time, id);
+CREATE INDEX todos_update_time ON todos (update_time, id);
+CREATE INDEX todos_title ON todos (title, id);
+-- 未完了のものを作成順に見ることが多い
+CREATE INDEX todos_done_create_time ON todos (done, create_time, id);
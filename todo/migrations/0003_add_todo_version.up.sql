@@ -0,0 +1,2 @@
+-- 楽観的排他制御のため、更新のたびに1増やす。etagはこの値から作る
+ALTER TABLE todos ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
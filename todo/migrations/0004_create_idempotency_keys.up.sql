@@ -0,0 +1,12 @@
+-- Idempotency-Keyごとの最初のレスポンス。responseがNULLのものは処理中
+-- 期限の切れた行は次に予約するときに消す
+CREATE TABLE idempotency_keys (
+    method       TEXT    NOT NULL,
+    key          TEXT    NOT NULL,
+    request_hash BLOB    NOT NULL,
+    response     BLOB,
+    create_time  INTEGER NOT NULL,
+    expire_time  INTEGER NOT NULL,
+    PRIMARY KEY (method, key)
+);
+CREATE INDEX idempotency_keys_expire_time ON idempotency_keys (expire_time);
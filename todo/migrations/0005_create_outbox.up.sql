@@ -0,0 +1,13 @@
+-- todoの変更と同じトランザクションで書き、リレーがブローカーに送る
+-- headersはトレースコンテキストなどのJSON。publish_timeがNULLのものがまだ送っていないもの
+CREATE TABLE outbox (
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    topic        TEXT    NOT NULL,
+    message_key  TEXT    NOT NULL,
+    headers      TEXT    NOT NULL,
+    payload      BLOB    NOT NULL,
+    create_time  INTEGER NOT NULL,
+    publish_time INTEGER
+);
+CREATE INDEX outbox_unpublished ON outbox (id) WHERE publish_time IS NULL;
+CREATE INDEX outbox_publish_time ON outbox (publish_time) WHERE publish_time IS NOT NULL;
@@ -0,0 +1,31 @@
+-- secretは本文の署名に使うので、ハッシュにせずに保存する
+-- event_typesはTodoEvent.Typeの番号のJSON配列。空の配列ならすべて
+CREATE TABLE webhooks (
+    id          TEXT    PRIMARY KEY,
+    url         TEXT    NOT NULL,
+    secret      TEXT    NOT NULL,
+    event_types TEXT    NOT NULL,
+    create_time INTEGER NOT NULL
+);
+
+-- 1つのイベントを1つのWebhookに送った記録。message_idはブローカーのメッセージのID
+-- 同じメッセージが2回届いても、配信は1つしか作らない
+CREATE TABLE webhook_deliveries (
+    id                TEXT    PRIMARY KEY,
+    webhook_id        TEXT    NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+    message_id        TEXT    NOT NULL,
+    event_type        INTEGER NOT NULL,
+    todo_id           TEXT    NOT NULL,
+    payload           BLOB    NOT NULL,
+    headers           TEXT    NOT NULL,
+    state             INTEGER NOT NULL,
+    attempts          INTEGER NOT NULL DEFAULT 0,
+    last_status_code  INTEGER NOT NULL DEFAULT 0,
+    last_error        TEXT    NOT NULL DEFAULT '',
+    next_attempt_time INTEGER,
+    create_time       INTEGER NOT NULL,
+    update_time       INTEGER NOT NULL,
+    UNIQUE (webhook_id, message_id)
+);
+CREATE INDEX webhook_deliveries_due ON webhook_deliveries (next_attempt_time) WHERE state = 1;
+CREATE INDEX webhook_deliveries_webhook ON webhook_deliveries (webhook_id, create_time, id);
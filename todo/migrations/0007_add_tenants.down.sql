@@ -0,0 +1,24 @@
+DROP TABLE idempotency_keys;
+CREATE TABLE idempotency_keys (
+    method       TEXT    NOT NULL,
+    key          TEXT    NOT NULL,
+    request_hash BLOB    NOT NULL,
+    response     BLOB,
+    create_time  INTEGER NOT NULL,
+    expire_time  INTEGER NOT NULL,
+    PRIMARY KEY (method, key)
+);
+CREATE INDEX idempotency_keys_expire_time ON idempotency_keys (expire_time);
+
+DROP INDEX webhooks_tenant;
+ALTER TABLE webhooks DROP COLUMN tenant_id;
+
+DROP INDEX todos_tenant_done_create_time;
+DROP INDEX todos_tenant_title;
+DROP INDEX todos_tenant_update_time;
+DROP INDEX todos_tenant_create_time;
+ALTER TABLE todos DROP COLUMN tenant_id;
+CREATE INDEX todos_create_time ON todos (create_time, id);
+CREATE INDEX todos_update_time ON todos (update_time, id);
+CREATE INDEX todos_title ON todos (title, id);
+CREATE INDEX todos_done_create_time ON todos (done, create_time, id);
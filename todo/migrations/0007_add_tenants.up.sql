@@ -0,0 +1,27 @@
+-- テナントごとに分ける。今までの行はデフォルトのテナントのものにする
+ALTER TABLE todos ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+DROP INDEX todos_done_create_time;
+DROP INDEX todos_title;
+DROP INDEX todos_update_time;
+DROP INDEX todos_create_time;
+CREATE INDEX todos_tenant_create_time ON todos (tenant_id, create_time, id);
+CREATE INDEX todos_tenant_update_time ON todos (tenant_id, update_time, id);
+CREATE INDEX todos_tenant_title ON todos (tenant_id, title, id);
+CREATE INDEX todos_tenant_done_create_time ON todos (tenant_id, done, create_time, id);
+
+ALTER TABLE webhooks ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+CREATE INDEX webhooks_tenant ON webhooks (tenant_id, create_time, id);
+
+-- 同じキーでも別のテナントなら別のリクエストにする。記録はTTLまでしか使わないので作り直す
+DROP TABLE idempotency_keys;
+CREATE TABLE idempotency_keys (
+    tenant_id    TEXT    NOT NULL,
+    method       TEXT    NOT NULL,
+    key          TEXT    NOT NULL,
+    request_hash BLOB    NOT NULL,
+    response     BLOB,
+    create_time  INTEGER NOT NULL,
+    expire_time  INTEGER NOT NULL,
+    PRIMARY KEY (tenant_id, method, key)
+);
+CREATE INDEX idempotency_keys_expire_time ON idempotency_keys (expire_time);
@@ -0,0 +1,26 @@
+-- todoの変更の監査ログ。追記だけで、書き換えと削除はトリガーで断る
+-- before_todo, after_todoはTodoのJSONで、そのまま読めるようにする
+CREATE TABLE audit_events (
+    id             TEXT    PRIMARY KEY,
+    tenant_id      TEXT    NOT NULL,
+    todo_id        TEXT    NOT NULL,
+    action         INTEGER NOT NULL,
+    actor          TEXT    NOT NULL,
+    before_todo    TEXT,
+    after_todo     TEXT,
+    changed_fields TEXT    NOT NULL,
+    event_time     INTEGER NOT NULL,
+    trace_id       TEXT    NOT NULL,
+    span_id        TEXT    NOT NULL
+);
+CREATE INDEX audit_events_tenant_event_time ON audit_events (tenant_id, event_time, id);
+CREATE INDEX audit_events_tenant_todo ON audit_events (tenant_id, todo_id, event_time, id);
+
+CREATE TRIGGER audit_events_no_update BEFORE UPDATE ON audit_events
+BEGIN
+    SELECT RAISE(ABORT, 'audit events are immutable');
+END;
+CREATE TRIGGER audit_events_no_delete BEFORE DELETE ON audit_events
+BEGIN
+    SELECT RAISE(ABORT, 'audit events are immutable');
+END;
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	todoPb "gen/go/todo"
+	"log"
+	"os"
+	"pkg/broker"
+	"strconv"
+	"time"
+
+	otelapi "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// todoの変更イベントのoutbox
+// TodoStoreは作成、更新、削除と同じトランザクションでoutboxにイベントを書く。
+// outboxRelayがそれを読んでブローカーに送るので、変更だけ保存されてイベントが消えることはない。
+// 送った後に送信済みにする前に落ちると、次に起動したときにもう一度送る。受け取る側はMessage.IDで見分ける
+//
+// 保証するのはブローカーに少なくとも1回渡すところまで。購読する側で処理に失敗した場合は、
+// ブローカーがTODO_BROKER_MAX_ATTEMPTS回までやり直し、それでも失敗したものや、
+// 処理する前にプロセスが止まったものは届かない(broker.InProcを参照)
+//
+// outboxには変更したRPCのトレースコンテキストをヘッダーとして保存する。
+// リレーはそれを親にしてPublishするので、RPCから受け取る側の処理までが1つのトレースになる
+
+const (
+	outboxPollIntervalEnv = "TODO_OUTBOX_POLL_INTERVAL"
+	outboxBatchSizeEnv    = "TODO_OUTBOX_BATCH_SIZE"
+	outboxRetentionEnv    = "TODO_OUTBOX_RETENTION"
+	brokerEnv             = "TODO_BROKER"
+	brokerQueueSizeEnv    = "TODO_BROKER_QUEUE_SIZE"
+	brokerMaxAttemptsEnv  = "TODO_BROKER_MAX_ATTEMPTS"
+	brokerBackoffBaseEnv  = "TODO_BROKER_BACKOFF_BASE"
+	brokerBackoffMaxEnv   = "TODO_BROKER_BACKOFF_MAX"
+
+	// 書いたときに知らせるので、ポーリングは知らせを取りこぼしたときのため
+	defaultOutboxPollInterval = time.Second
+	defaultOutboxBatchSize    = 100
+	// 送った後も調べられるように残しておく期間
+	defaultOutboxRetention = time.Hour
+	defaultBrokerQueueSize = 1000
+	// 購読する側の失敗をやり直す回数と間隔。やり直している間はその購読の次のメッセージが待つ
+	defaultBrokerMaxAttempts = 5
+	defaultBrokerBackoffBase = 100 * time.Millisecond
+	defaultBrokerBackoffMax  = 5 * time.Second
+
+	// 送信済みのものを消す間隔
+	outboxPurgeInterval = time.Minute
+	// 止めるときに残りを送るのを待つ時間
+	outboxDrainTimeout = 5 * time.Second
+)
+
+// todoの変更イベントのトピック。ペイロードはTodoEvent
+const todoEventsTopic = "todo.events"
+
+// outboxMessage outboxに書いた1件。idは書いた順に増える
+type outboxMessage struct {
+	id         int64
+	topic      string
+	key        string
+	headers    map[string]string
+	payload    []byte
+	createTime time.Time
+}
+
+type outboxStore interface {
+	// pending まだ送っていないものを書いた順にlimit件まで返す
+	pending(ctx context.Context, limit int) ([]*outboxMessage, error)
+	// markPublished 送信済みにする
+	markPublished(ctx context.Context, id int64, t time.Time) error
+	// purge beforeより前に送ったものを消し、消した件数を返す
+	purge(ctx context.Context, before time.Time) (int64, error)
+	// notified outboxに書かれると受け取れる
+	notified() <-chan struct{}
+}
+
+// notifier 書いたことを読む側に知らせる。溜めずに1つにまとめる
+type notifier chan struct{}
+
+func newNotifier() notifier {
+	return make(notifier, 1)
+}
+
+func (n notifier) notify() {
+	select {
+	case n <- struct{}{}:
+	default:
+	}
+}
+
+func (n notifier) notified() <-chan struct{} { return n }
+
+// newTodoEventMessage todoの変更イベントをoutboxに書く形にする。ctxは変更したRPCのもの
+// idは書くときに決まる
+func newTodoEventMessage(ctx context.Context, typ todoPb.TodoEvent_Type, todo *todoPb.Todo, t time.Time) (*outboxMessage, error) {
+	event := &todoPb.TodoEvent{Type: typ, Todo: todo, EventTime: timestamppb.New(t)}
+	payload, err := proto.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("marshal todo event: %w", err)
+	}
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	headers := broker.HeaderCarrier{
+		"message-type": string(proto.MessageName(event)),
+		tenantHeader:   tenant,
+	}
+	otelapi.GetTextMapPropagator().Inject(ctx, headers)
+	return &outboxMessage{
+		topic:      todoEventsTopic,
+		key:        todo.GetId(),
+		headers:    headers,
+		payload:    payload,
+		createTime: t,
+	}, nil
+}
+
+// openBroker TODO_BROKERで選んだブローカーを作る
+//   - inproc(デフォルト): プロセスの中だけで配る。外のサービスはいらない
+func openBroker() (broker.Broker, error) {
+	queueSize, err := intFromEnv(brokerQueueSizeEnv, defaultBrokerQueueSize)
+	if err != nil {
+		return nil, err
+	}
+	var retry broker.Retry
+	if retry.MaxAttempts, err = intFromEnv(brokerMaxAttemptsEnv, defaultBrokerMaxAttempts); err != nil {
+		return nil, err
+	}
+	if retry.BaseDelay, err = millisFromEnv(brokerBackoffBaseEnv, defaultBrokerBackoffBase); err != nil {
+		return nil, err
+	}
+	if retry.MaxDelay, err = millisFromEnv(brokerBackoffMaxEnv, defaultBrokerBackoffMax); err != nil {
+		return nil, err
+	}
+	switch kind := os.Getenv(brokerEnv); kind {
+	case "", "inproc":
+		log.Printf("todo broker: inproc")
+		return broker.WithTracing(broker.NewInProc(queueSize, retry), "inproc"), nil
+	default:
+		return nil, fmt.Errorf("%s: unknown broker %q", brokerEnv, kind)
+	}
+}
+
+// outboxRelay outboxのメッセージを書いた順にブローカーに送る
+type outboxRelay struct {
+	outbox    outboxStore
+	broker    broker.Broker
+	interval  time.Duration
+	batchSize int
+	retention time.Duration
+
+	relayed metric.Int64Counter
+}
+
+func newOutboxRelay(outbox outboxStore, b broker.Broker) (*outboxRelay, error) {
+	interval, err := millisFromEnv(outboxPollIntervalEnv, defaultOutboxPollInterval)
+	if err != nil {
+		return nil, err
+	}
+	batchSize, err := intFromEnv(outboxBatchSizeEnv, defaultOutboxBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	retention, err := millisFromEnv(outboxRetentionEnv, defaultOutboxRetention)
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 || batchSize <= 0 {
+		return nil, errors.New(outboxPollIntervalEnv + " and " + outboxBatchSizeEnv + " must be positive")
+	}
+
+	r := &outboxRelay{outbox: outbox, broker: b, interval: interval, batchSize: batchSize, retention: retention}
+	if r.relayed, err = otelapi.Meter("todo").Int64Counter("todo.outbox.relayed",
+		metric.WithDescription("Number of outbox messages relayed to the broker by result"),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// run ctxが終わるまで送り続け、最後に残りを送ってから返す
+// 送れなかったら順番を変えないようにそこで止め、次の機会にそのメッセージからやり直す
+func (r *outboxRelay) run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	// リレーのクエリはRPCのトレースに入れないので、spanのないcontextで読み書きする
+	relayCtx := context.WithoutCancel(ctx)
+	var lastPurge time.Time
+	for {
+		if err := r.relay(relayCtx); err != nil {
+			log.Printf("failed to relay outbox: %v", err)
+		}
+		if now := time.Now(); now.Sub(lastPurge) >= outboxPurgeInterval {
+			r.purge(relayCtx, now)
+			lastPurge = now
+		}
+
+		select {
+		case <-ctx.Done():
+			drainCtx, cancel := context.WithTimeout(relayCtx, outboxDrainTimeout)
+			defer cancel()
+			if err := r.relay(drainCtx); err != nil {
+				log.Printf("failed to relay outbox: %v", err)
+			}
+			return
+		case <-r.outbox.notified():
+		case <-ticker.C:
+		}
+	}
+}
+
+// relay まだ送っていないものがなくなるまで送る
+func (r *outboxRelay) relay(ctx context.Context) error {
+	for {
+		msgs, err := r.outbox.pending(ctx, r.batchSize)
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if err := r.publish(ctx, m); err != nil {
+				return err
+			}
+		}
+		if len(msgs) < r.batchSize {
+			return nil
+		}
+	}
+}
+
+func (r *outboxRelay) publish(ctx context.Context, m *outboxMessage) error {
+	// Publishのspanは変更したRPCのspanの子にする
+	publishCtx := otelapi.GetTextMapPropagator().Extract(ctx, broker.HeaderCarrier(m.headers))
+	err := r.broker.Publish(publishCtx, &broker.Message{
+		ID:      strconv.FormatInt(m.id, 10),
+		Topic:   m.topic,
+		Key:     m.key,
+		Headers: m.headers,
+		Payload: m.payload,
+	})
+	if err == nil {
+		err = r.outbox.markPublished(ctx, m.id, time.Now())
+	}
+
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	r.relayed.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("messaging.destination.name", m.topic),
+		attribute.String("result", result),
+	))
+	return err
+}
+
+func (r *outboxRelay) purge(ctx context.Context, now time.Time) {
+	n, err := r.outbox.purge(ctx, now.Add(-r.retention))
+	if err != nil {
+		log.Printf("failed to purge outbox: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("purged %d published outbox messages", n)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryOutbox プロセスのメモリに保存する。memoryStoreがtodoを変更するときに、同じロックの中で書く
+type memoryOutbox struct {
+	mu sync.Mutex
+	// 書いた順。送信済みのものも消すまでは残す
+	messages []*memoryOutboxMessage
+	nextID   int64
+	notifier
+}
+
+type memoryOutboxMessage struct {
+	*outboxMessage
+	// 送っていなければゼロ値
+	publishTime time.Time
+}
+
+func newMemoryOutbox() *memoryOutbox {
+	return &memoryOutbox{nextID: 1, notifier: newNotifier()}
+}
+
+// insert mを書く。呼び出し元が変更を終えた後にnotifyを呼ぶこと
+func (o *memoryOutbox) insert(m *outboxMessage) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	m.id = o.nextID
+	o.nextID++
+	o.messages = append(o.messages, &memoryOutboxMessage{outboxMessage: m})
+}
+
+func (o *memoryOutbox) pending(_ context.Context, limit int) ([]*outboxMessage, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var msgs []*outboxMessage
+	for _, m := range o.messages {
+		if len(msgs) == limit {
+			break
+		}
+		if m.publishTime.IsZero() {
+			msgs = append(msgs, m.outboxMessage)
+		}
+	}
+	return msgs, nil
+}
+
+func (o *memoryOutbox) markPublished(_ context.Context, id int64, t time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, m := range o.messages {
+		if m.id == id {
+			m.publishTime = t
+			break
+		}
+	}
+	return nil
+}
+
+func (o *memoryOutbox) purge(_ context.Context, before time.Time) (int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	kept := o.messages[:0]
+	for _, m := range o.messages {
+		if m.publishTime.IsZero() || !m.publishTime.Before(before) {
+			kept = append(kept, m)
+		}
+	}
+	n := int64(len(o.messages) - len(kept))
+	clear(o.messages[len(kept):])
+	o.messages = kept
+	return n, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// sqlOutbox todoと同じSQLiteのoutboxに保存する
+// 書き込みはsqlStoreがtodoの変更と同じトランザクションで行う
+type sqlOutbox struct {
+	db *sqlDB
+	notifier
+}
+
+func newSQLOutbox(db *sqlDB) *sqlOutbox {
+	return &sqlOutbox{db: db, notifier: newNotifier()}
+}
+
+// insert トランザクションの中でmを書く。コミットした後にnotifyを呼ぶこと
+func (o *sqlOutbox) insert(ctx context.Context, tx *sqlTx, m *outboxMessage) error {
+	headers, err := json.Marshal(m.headers)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO outbox (topic, message_key, headers, payload, create_time) VALUES (?, ?, ?, ?, ?)`,
+		m.topic, m.key, string(headers), m.payload, m.createTime.UnixNano(),
+	)
+	return err
+}
+
+func (o *sqlOutbox) pending(ctx context.Context, limit int) ([]*outboxMessage, error) {
+	rows, err := o.db.QueryContext(ctx,
+		`SELECT id, topic, message_key, headers, payload, create_time FROM outbox
+		WHERE publish_time IS NULL ORDER BY id LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []*outboxMessage
+	for rows.Next() {
+		var (
+			m          outboxMessage
+			headers    string
+			createTime int64
+		)
+		if err := rows.Scan(&m.id, &m.topic, &m.key, &headers, &m.payload, &createTime); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(headers), &m.headers); err != nil {
+			return nil, err
+		}
+		m.createTime = time.Unix(0, createTime)
+		msgs = append(msgs, &m)
+	}
+	return msgs, rows.Err()
+}
+
+func (o *sqlOutbox) markPublished(ctx context.Context, id int64, t time.Time) error {
+	_, err := o.db.ExecContext(ctx, `UPDATE outbox SET publish_time = ? WHERE id = ?`, t.UnixNano(), id)
+	return err
+}
+
+func (o *sqlOutbox) purge(ctx context.Context, before time.Time) (int64, error) {
+	res, err := o.db.ExecContext(ctx,
+		`DELETE FROM outbox WHERE publish_time IS NOT NULL AND publish_time < ?`, before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	grpcCodes "google.golang.org/grpc/codes"
+)
+
+// greetのクライアントのサービス設定
+// https://github.com/grpc/grpc/blob/master/doc/service_config.md の形式で、
+// メソッドごとのタイムアウトと再試行(retryPolicy)はgRPCがそのまま扱う。
+// grpc-goはhedgingPolicyに対応していないので、同じ設定からtodoで読み取り、hedging.goのインターセプターで扱う
+
+const greetServiceConfigEnv = "GREET_SERVICE_CONFIG_FILE"
+
+// GREET_SERVICE_CONFIG_FILEを指定しない場合の設定
+// SayHelloはUNAVAILABLEのときだけ最大3回まで試す。StreamGreetingsは最初のメッセージを受け取る前なら再試行される
+const defaultGreetServiceConfig = `{
+  "loadBalancingConfig": [{"round_robin": {}}],
+  "methodConfig": [
+    {
+      "name": [{"service": "greet_service.GreetService", "method": "SayHello"}],
+      "timeout": "2s",
+      "retryPolicy": {
+        "maxAttempts": 3,
+        "initialBackoff": "0.1s",
+        "maxBackoff": "1s",
+        "backoffMultiplier": 2,
+        "retryableStatusCodes": ["UNAVAILABLE"]
+      }
+    },
+    {
+      "name": [{"service": "greet_service.GreetService", "method": "StreamGreetings"}],
+      "timeout": "30s",
+      "retryPolicy": {
+        "maxAttempts": 3,
+        "initialBackoff": "0.1s",
+        "maxBackoff": "1s",
+        "backoffMultiplier": 2,
+        "retryableStatusCodes": ["UNAVAILABLE"]
+      }
+    }
+  ]
+}`
+
+// loadGreetServiceConfig サービス設定のJSONと、そこから読み取ったhedgingの設定を返す
+func loadGreetServiceConfig() (string, hedgingPolicies, error) {
+	js := defaultGreetServiceConfig
+	if path := os.Getenv(greetServiceConfigEnv); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %w", greetServiceConfigEnv, err)
+		}
+		js = string(b)
+	}
+	policies, err := parseHedgingPolicies(js)
+	if err != nil {
+		return "", nil, fmt.Errorf("service config: %w", err)
+	}
+	return js, policies, nil
+}
+
+type serviceConfig struct {
+	MethodConfig []struct {
+		Name []struct {
+			Service string `json:"service"`
+			Method  string `json:"method"`
+		} `json:"name"`
+		RetryPolicy   json.RawMessage `json:"retryPolicy"`
+		HedgingPolicy *struct {
+			MaxAttempts         int      `json:"maxAttempts"`
+			HedgingDelay        string   `json:"hedgingDelay"`
+			NonFatalStatusCodes []string `json:"nonFatalStatusCodes"`
+		} `json:"hedgingPolicy"`
+	} `json:"methodConfig"`
+}
+
+// parseHedgingPolicies methodConfigのhedgingPolicyを "/service/method" ごとにまとめる
+// methodを省略した場合はサービスのすべてのメソッドに使う
+func parseHedgingPolicies(js string) (hedgingPolicies, error) {
+	var sc serviceConfig
+	if err := json.Unmarshal([]byte(js), &sc); err != nil {
+		return nil, err
+	}
+
+	policies := hedgingPolicies{}
+	for _, mc := range sc.MethodConfig {
+		hp := mc.HedgingPolicy
+		if hp == nil {
+			continue
+		}
+		if len(mc.RetryPolicy) > 0 {
+			return nil, fmt.Errorf("retryPolicy and hedgingPolicy cannot be used together")
+		}
+		if hp.MaxAttempts < 2 {
+			return nil, fmt.Errorf("hedgingPolicy.maxAttempts must be at least 2: %d", hp.MaxAttempts)
+		}
+		delay, err := parseProtoDuration(hp.HedgingDelay)
+		if err != nil {
+			return nil, fmt.Errorf("hedgingPolicy.hedgingDelay: %w", err)
+		}
+		p := &hedgingPolicy{
+			maxAttempts: min(hp.MaxAttempts, maxHedgingAttempts),
+			delay:       delay,
+			nonFatal:    map[grpcCodes.Code]bool{},
+		}
+		for _, name := range hp.NonFatalStatusCodes {
+			var c grpcCodes.Code
+			// UnmarshalJSONは "UNAVAILABLE" のような名前を受け付ける
+			if err := c.UnmarshalJSON([]byte(strconv.Quote(name))); err != nil {
+				return nil, fmt.Errorf("hedgingPolicy.nonFatalStatusCodes: %w", err)
+			}
+			p.nonFatal[c] = true
+		}
+		for _, n := range mc.Name {
+			policies["/"+n.Service+"/"+n.Method] = p
+		}
+	}
+	return policies, nil
+}
+
+// parseProtoDuration "0.5s" のようなprotobufのJSONの期間を読む
+func parseProtoDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if !strings.HasSuffix(s, "s") {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	secs, err := strconv.ParseFloat(strings.TrimSuffix(s, "s"), 64)
+	if err != nil || secs < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
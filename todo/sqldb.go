@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	otelapi "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteへの接続
+// 外部のデータベースを使わずに動くように、pure GoのSQLiteのドライバー(modernc.org/sqlite)を使う。
+// クエリごとにspanを作り、パラメーターの値はspanに残さない。
+// spanはRPCなどの親があるときだけ作る。outboxのリレーが定期的に読むクエリでトレースが増え続けないようにする
+
+const dbSystem = "sqlite"
+
+// sqlDB クエリをトレースする*sql.DB
+type sqlDB struct {
+	db *sql.DB
+	tracedConn
+}
+
+// sqlTx クエリをトレースする*sql.Tx
+type sqlTx struct {
+	tx *sql.Tx
+	tracedConn
+}
+
+// database/sqlの*sql.DBと*sql.Txに共通のメソッド
+type conn interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+type tracedConn struct {
+	conn   conn
+	name   string
+	tracer trace.Tracer
+}
+
+// openSQLite pathのSQLiteを開き、マイグレーションを適用する
+func openSQLite(ctx context.Context, path string, migrateTo int) (*sqlDB, error) {
+	// WALにすると読み込みが書き込みを待たない。書き込みが重なった場合はbusy_timeoutまで待つ
+	// トランザクションは書き込みにしか使わないので、始めるときに書き込みのロックを取る(_txlock=immediate)。
+	// 読んでから書くトランザクションが、途中で他の書き込みに追い越されて失敗しないようにする
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_txlock=immediate", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(4)
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	d := &sqlDB{
+		db:         db,
+		tracedConn: tracedConn{conn: db, name: name, tracer: otelapi.Tracer("todo")},
+	}
+	if err := d.registerPoolMetrics(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrate(ctx, d, migrateTo); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *sqlDB) Close() error {
+	return d.db.Close()
+}
+
+// InTx fnをトランザクションの中で実行する。fnがエラーを返したらロールバックする
+// fnに渡すctxを使うと、クエリのspanがトランザクションのspanの下にできる
+func (d *sqlDB) InTx(ctx context.Context, fn func(ctx context.Context, tx *sqlTx) error) (err error) {
+	ctx, span := d.startSpan(ctx, "transaction")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(ctx, &sqlTx{tx: tx, tracedConn: tracedConn{conn: tx, name: d.name, tracer: d.tracer}}); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	return tx.Commit()
+}
+
+// startSpan 親のspanがなければspanを作らない
+func (c *tracedConn) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	attrs = append(attrs,
+		attribute.String("db.system", dbSystem),
+		attribute.String("db.name", c.name),
+	)
+	return c.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func (c *tracedConn) start(ctx context.Context, query string) (context.Context, trace.Span) {
+	statement := redactStatement(query)
+	op := strings.ToUpper(strings.Fields(statement + " ")[0])
+	return c.startSpan(ctx, op,
+		attribute.String("db.operation", op),
+		attribute.String("db.statement", statement),
+	)
+}
+
+func endQuerySpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args ...any) (_ sql.Result, err error) {
+	ctx, span := c.start(ctx, query)
+	defer func() { endQuerySpan(span, err) }()
+
+	res, err := c.conn.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err == nil {
+		span.SetAttributes(attribute.Int64("db.rows_affected", n))
+	}
+	return res, nil
+}
+
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args ...any) (_ *sql.Rows, err error) {
+	ctx, span := c.start(ctx, query)
+	defer func() { endQuerySpan(span, err) }()
+	return c.conn.QueryContext(ctx, query, args...)
+}
+
+// QueryRowContext 結果はScanするまで分からないので、spanはクエリを送った時点で閉じる
+func (c *tracedConn) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, span := c.start(ctx, query)
+	row := c.conn.QueryRowContext(ctx, query, args...)
+	endQuerySpan(span, row.Err())
+	return row
+}
+
+var (
+	sqlComment     = regexp.MustCompile(`--[^\n]*|/\*[\s\S]*?\*/`)
+	stringLiteral  = regexp.MustCompile(`'(?:[^']|'')*'`)
+	numericLiteral = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+)
+
+// redactStatement コメントを除き、クエリに直接書かれた値を?に置き換える
+// パラメーターはプレースホルダーで渡すので、値がspanに残ることはない
+func redactStatement(query string) string {
+	query = sqlComment.ReplaceAllString(query, "")
+	query = stringLiteral.ReplaceAllString(query, "?")
+	query = numericLiteral.ReplaceAllString(query, "?")
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// registerPoolMetrics コネクションプールの状態をメトリクスにする
+func (d *sqlDB) registerPoolMetrics() error {
+	meter := otelapi.Meter("todo")
+	pool := attribute.String("pool.name", d.name)
+
+	usage, err := meter.Int64ObservableUpDownCounter("db.client.connections.usage",
+		metric.WithDescription("Number of connections that are currently in the state described by the state attribute"),
+		metric.WithUnit("{connection}"),
+	)
+	if err != nil {
+		return err
+	}
+	maxConns, err := meter.Int64ObservableUpDownCounter("db.client.connections.max",
+		metric.WithDescription("Maximum number of open connections allowed"),
+		metric.WithUnit("{connection}"),
+	)
+	if err != nil {
+		return err
+	}
+	waits, err := meter.Int64ObservableCounter("db.client.connections.waits",
+		metric.WithDescription("Number of times a connection had to be waited for"),
+		metric.WithUnit("{wait}"),
+	)
+	if err != nil {
+		return err
+	}
+	waitTime, err := meter.Float64ObservableCounter("db.client.connections.wait_time",
+		metric.WithDescription("Total time spent waiting for a connection"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		s := d.db.Stats()
+		o.ObserveInt64(usage, int64(s.Idle), metric.WithAttributes(pool, attribute.String("state", "idle")))
+		o.ObserveInt64(usage, int64(s.InUse), metric.WithAttributes(pool, attribute.String("state", "used")))
+		o.ObserveInt64(maxConns, int64(s.MaxOpenConnections), metric.WithAttributes(pool))
+		o.ObserveInt64(waits, s.WaitCount, metric.WithAttributes(pool))
+		o.ObserveFloat64(waitTime, s.WaitDuration.Seconds(), metric.WithAttributes(pool))
+		return nil
+	}, usage, maxConns, waits, waitTime)
+	return err
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	todoPb "gen/go/todo"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	otelapi "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Todoの保存先
+// todoServerはTodoStoreだけを使い、保存先の実装はmain関数で選ぶ。
+// 作成、更新、削除は、そのイベントをoutboxに、変更の記録を監査ログに書くのと一緒に行う。
+// どのメソッドもcontextのテナントのtodoだけを扱い、別のテナントのtodoは見つからないものとして扱う
+
+var (
+	ErrNotFound = errors.New("todo not found")
+	// ErrEtagMismatch 指定したetagが保存されているものと違う。他で更新されている
+	ErrEtagMismatch = errors.New("todo etag mismatch")
+	// ErrQuotaExceeded テナントのtodoが上限に達している
+	ErrQuotaExceeded = errors.New("todo quota exceeded")
+)
+
+type TodoStore interface {
+	// Create 採番済みのtodoを保存し、todo.Etagを設定する
+	// テナントのtodoが上限に達していればErrQuotaExceeded
+	Create(ctx context.Context, todo *todoPb.Todo) error
+	// Get 見つからなければErrNotFound
+	Get(ctx context.Context, id string) (*todoPb.Todo, error)
+	// List queryの条件に合うものをquery.Orderの順にquery.Limit件まで返す
+	List(ctx context.Context, query ListQuery) ([]*todoPb.Todo, error)
+	// Count filterの条件に合う件数
+	Count(ctx context.Context, filter TodoFilter) (int, error)
+	// Update todo.Etagが保存されているものと同じときだけ置き換え、todo.Etagを新しくする
+	// 見つからなければErrNotFound、etagが違えばErrEtagMismatch
+	Update(ctx context.Context, todo *todoPb.Todo) error
+	// Delete etagが空でなければ保存されているものと同じときだけ削除する
+	// 見つからなければErrNotFound、etagが違えばErrEtagMismatch
+	Delete(ctx context.Context, id, etag string) error
+	Close() error
+}
+
+// TodoFilter Listの絞り込み条件。ゼロ値のフィールドは条件にしない
+type TodoFilter struct {
+	Done *bool
+	// titleかdescriptionに含まれる文字列。ASCIIの大文字と小文字は区別しない
+	Query string
+	// startは含み、endは含まない
+	CreateTimeStart, CreateTimeEnd time.Time
+	UpdateTimeStart, UpdateTimeEnd time.Time
+}
+
+// 並べ替えに使える列
+const (
+	orderByCreateTime = "create_time"
+	orderByUpdateTime = "update_time"
+	orderByTitle      = "title"
+)
+
+// TodoOrder 並び順。同じ値のものはidの順に並べる
+type TodoOrder struct {
+	Field string
+	Desc  bool
+}
+
+// TodoCursor 前のページの最後のtodo。Listはこの続きから返すので、途中で追加や削除があってもずれない
+type TodoCursor struct {
+	ID string
+	// Order.Fieldの列の値。使わない方はゼロ値
+	Time  time.Time
+	Title string
+}
+
+// cursorAfter todoの続きから返すカーソル
+func cursorAfter(todo *todoPb.Todo, order TodoOrder) *TodoCursor {
+	c := &TodoCursor{ID: todo.GetId()}
+	switch order.Field {
+	case orderByCreateTime:
+		c.Time = todo.GetCreateTime().AsTime()
+	case orderByUpdateTime:
+		c.Time = todo.GetUpdateTime().AsTime()
+	case orderByTitle:
+		c.Title = todo.GetTitle()
+	}
+	return c
+}
+
+func (o TodoOrder) String() string {
+	if o.Desc {
+		return o.Field + " desc"
+	}
+	return o.Field
+}
+
+type ListQuery struct {
+	Filter TodoFilter
+	Order  TodoOrder
+	// nilなら先頭から返す
+	After *TodoCursor
+	Limit int
+}
+
+// etagは保存先が持つ版番号から作る。クライアントには中身の意味を見せない
+func formatEtag(version int64) string {
+	return strconv.FormatInt(version, 10)
+}
+
+// parseEtag 作った覚えのない値ならfalse
+func parseEtag(etag string) (int64, bool) {
+	v, err := strconv.ParseInt(etag, 10, 64)
+	return v, err == nil && v > 0
+}
+
+const (
+	storeEnv          = "TODO_STORE"
+	sqlitePathEnv     = "TODO_SQLITE_PATH"
+	sqliteMigrateEnv  = "TODO_SQLITE_MIGRATE_TO"
+	defaultSQLitePath = "todo.db"
+)
+
+// stores openStoreで開いた保存先。すべて同じところに保存する
+type stores struct {
+	todos       TodoStore
+	idempotency idempotencyStore
+	outbox      outboxStore
+	webhooks    webhookStore
+	audit       auditStore
+}
+
+// openStore TODO_STOREで選んだ保存先を開く。Idempotency-Keyの記録、outbox、Webhook、監査ログも同じところに保存する
+//   - sqlite(デフォルト): TODO_SQLITE_PATHのファイルに保存する。起動時にマイグレーションを適用し、
+//     TODO_SQLITE_MIGRATE_TOを指定した場合はそのバージョンまで上げるか下げる
+//   - memory: プロセスのメモリに保存する
+//
+// どれもcontextのテナントの中だけで読み書きする。テナントごとのtodoはTODO_TENANT_MAX_TODOS件までにする
+//
+// 閉じるのはTodoStoreのCloseだけで良い
+func openStore(ctx context.Context) (*stores, error) {
+	maxTodos, err := intFromEnv(tenantMaxTodosEnv, defaultTenantMaxTodos)
+	if err != nil {
+		return nil, err
+	}
+	switch kind := os.Getenv(storeEnv); kind {
+	case "", "sqlite":
+		path := os.Getenv(sqlitePathEnv)
+		if path == "" {
+			path = defaultSQLitePath
+		}
+		migrateTo := -1
+		if v := os.Getenv(sqliteMigrateEnv); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%s: invalid version %q", sqliteMigrateEnv, v)
+			}
+			migrateTo = n
+		}
+		db, err := openSQLite(ctx, path, migrateTo)
+		if err != nil {
+			return nil, fmt.Errorf("open %s: %w", path, err)
+		}
+		log.Printf("todo store: sqlite (%s)", path)
+		outbox, audit := newSQLOutbox(db), newSQLAudit(db)
+		return &stores{
+			todos:       newTracedStore(newSQLStore(db, outbox, audit, maxTodos), "sqlite"),
+			idempotency: newSQLIdempotencyStore(db),
+			outbox:      outbox,
+			webhooks:    newSQLWebhookStore(db),
+			audit:       audit,
+		}, nil
+	case "memory":
+		log.Printf("todo store: memory")
+		outbox, audit := newMemoryOutbox(), newMemoryAudit()
+		return &stores{
+			todos:       newTracedStore(newMemoryStore(outbox, audit, maxTodos), "memory"),
+			idempotency: newMemoryIdempotencyStore(),
+			outbox:      outbox,
+			webhooks:    newMemoryWebhookStore(),
+			audit:       audit,
+		}, nil
+	default:
+		return nil, fmt.Errorf("%s: unknown store %q", storeEnv, kind)
+	}
+}
+
+// tracedStore TodoStoreの呼び出しごとにspanを作る
+type tracedStore struct {
+	store  TodoStore
+	kind   string
+	tracer trace.Tracer
+}
+
+// newTracedStore kindは保存先の種類で、spanの属性todo.storeになる
+func newTracedStore(store TodoStore, kind string) TodoStore {
+	return &tracedStore{store: store, kind: kind, tracer: otelapi.Tracer("todo")}
+}
+
+func (s *tracedStore) start(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs,
+		attribute.String("todo.store", s.kind),
+		attribute.String("todo.store.operation", op),
+	)
+	return s.tracer.Start(ctx, "TodoStore."+op, trace.WithAttributes(attrs...))
+}
+
+// endStoreSpan エラーをspanに記録する。見つからない、etagが違う、上限に達したのは呼び出し元の問題なのでエラーにしない
+func endStoreSpan(span trace.Span, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		span.SetAttributes(attribute.Bool("todo.found", false))
+	case errors.Is(err, ErrEtagMismatch):
+		span.SetAttributes(attribute.Bool("todo.etag_match", false))
+	case errors.Is(err, ErrQuotaExceeded):
+		span.SetAttributes(attribute.Bool("todo.quota_exceeded", true))
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s *tracedStore) Create(ctx context.Context, todo *todoPb.Todo) (err error) {
+	ctx, span := s.start(ctx, "Create", attribute.String("todo.id", todo.GetId()))
+	defer func() { endStoreSpan(span, err) }()
+	return s.store.Create(ctx, todo)
+}
+
+func (s *tracedStore) Get(ctx context.Context, id string) (_ *todoPb.Todo, err error) {
+	ctx, span := s.start(ctx, "Get", attribute.String("todo.id", id))
+	defer func() { endStoreSpan(span, err) }()
+	return s.store.Get(ctx, id)
+}
+
+func (s *tracedStore) List(ctx context.Context, query ListQuery) (_ []*todoPb.Todo, err error) {
+	ctx, span := s.start(ctx, "List",
+		attribute.String("todo.list.order_by", query.Order.String()),
+		attribute.Int("todo.list.limit", query.Limit),
+		attribute.Bool("todo.list.cursor", query.After != nil),
+	)
+	defer func() { endStoreSpan(span, err) }()
+	todos, err := s.store.List(ctx, query)
+	span.SetAttributes(attribute.Int("todo.count", len(todos)))
+	return todos, err
+}
+
+func (s *tracedStore) Count(ctx context.Context, filter TodoFilter) (_ int, err error) {
+	ctx, span := s.start(ctx, "Count")
+	defer func() { endStoreSpan(span, err) }()
+	n, err := s.store.Count(ctx, filter)
+	span.SetAttributes(attribute.Int("todo.count", n))
+	return n, err
+}
+
+func (s *tracedStore) Update(ctx context.Context, todo *todoPb.Todo) (err error) {
+	ctx, span := s.start(ctx, "Update",
+		attribute.String("todo.id", todo.GetId()),
+		attribute.String("todo.etag", todo.GetEtag()),
+	)
+	defer func() { endStoreSpan(span, err) }()
+	return s.store.Update(ctx, todo)
+}
+
+func (s *tracedStore) Delete(ctx context.Context, id, etag string) (err error) {
+	ctx, span := s.start(ctx, "Delete",
+		attribute.String("todo.id", id),
+		attribute.String("todo.etag", etag),
+	)
+	defer func() { endStoreSpan(span, err) }()
+	return s.store.Delete(ctx, id, etag)
+}
+
+func (s *tracedStore) Close() error {
+	return s.store.Close()
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	todoPb "gen/go/todo"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// memoryStore プロセスのメモリに保存する。再起動すると消える
+// 呼び出し元と値を共有しないように、出し入れのたびにコピーする。
+// 作成、更新、削除のイベントと監査ログは同じロックの中で書く。
+// IDはテナントをまたいで重ならないので、todoはIDだけで引き、テナントが違えば見つからないものとして扱う
+type memoryStore struct {
+	mu    sync.RWMutex
+	todos map[string]*todoPb.Todo
+	// etagの元になる版番号
+	versions map[string]int64
+	// todoのテナント
+	tenants map[string]string
+	// テナントごとのtodoの数
+	counts map[string]int
+	// 作成順のID
+	order  []string
+	outbox *memoryOutbox
+	audit  *memoryAudit
+	// テナントごとのtodoの上限。0なら制限しない
+	maxTodos int
+}
+
+func newMemoryStore(outbox *memoryOutbox, audit *memoryAudit, maxTodos int) *memoryStore {
+	return &memoryStore{
+		todos:    map[string]*todoPb.Todo{},
+		versions: map[string]int64{},
+		tenants:  map[string]string{},
+		counts:   map[string]int{},
+		outbox:   outbox,
+		audit:    audit,
+		maxTodos: maxTodos,
+	}
+}
+
+func (s *memoryStore) Create(ctx context.Context, todo *todoPb.Todo) error {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxTodos > 0 && s.counts[tenant] >= s.maxTodos {
+		return ErrQuotaExceeded
+	}
+	created := proto.Clone(todo).(*todoPb.Todo)
+	created.Etag = formatEtag(1)
+	audit, err := newAuditEvent(ctx, todoPb.AuditEvent_CREATE, todo.GetId())
+	if err != nil {
+		return err
+	}
+	setAuditChange(audit, nil, created)
+	if err := s.writeEvent(ctx, todoPb.TodoEvent_CREATED, created, todo.GetUpdateTime().AsTime(), audit); err != nil {
+		return err
+	}
+	todo.Etag = created.GetEtag()
+	s.todos[todo.GetId()] = created
+	s.versions[todo.GetId()] = 1
+	s.tenants[todo.GetId()] = tenant
+	s.counts[tenant]++
+	s.order = append(s.order, todo.GetId())
+	return nil
+}
+
+// writeEvent イベントをoutboxに、変更の記録を監査ログに書く。s.muを持って呼び、書けたら変更する
+func (s *memoryStore) writeEvent(ctx context.Context, typ todoPb.TodoEvent_Type, todo *todoPb.Todo, t time.Time, audit *todoPb.AuditEvent) error {
+	m, err := newTodoEventMessage(ctx, typ, todo, t)
+	if err != nil {
+		return err
+	}
+	s.outbox.insert(m)
+	s.audit.insert(audit)
+	s.outbox.notify()
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (*todoPb.Todo, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	todo, ok := s.todos[id]
+	if !ok || s.tenants[id] != tenant {
+		return nil, ErrNotFound
+	}
+	return proto.Clone(todo).(*todoPb.Todo), nil
+}
+
+func (s *memoryStore) List(ctx context.Context, query ListQuery) ([]*todoPb.Todo, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// 全件を絞り込んで並べ替える。メモリに載る件数しか扱わないので、インデックスは持たない
+	var todos []*todoPb.Todo
+	for _, id := range s.order {
+		todo := s.todos[id]
+		if s.tenants[id] != tenant || !matchFilter(todo, query.Filter) {
+			continue
+		}
+		if query.After != nil && compareTodo(cursorAfter(todo, query.Order), query.After, query.Order) <= 0 {
+			continue
+		}
+		todos = append(todos, todo)
+	}
+	slices.SortFunc(todos, func(a, b *todoPb.Todo) int {
+		return compareTodo(cursorAfter(a, query.Order), cursorAfter(b, query.Order), query.Order)
+	})
+	if len(todos) > query.Limit {
+		todos = todos[:query.Limit]
+	}
+	for i, todo := range todos {
+		todos[i] = proto.Clone(todo).(*todoPb.Todo)
+	}
+	return todos, nil
+}
+
+func (s *memoryStore) Count(ctx context.Context, filter TodoFilter) (int, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for id, todo := range s.todos {
+		if s.tenants[id] == tenant && matchFilter(todo, filter) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// compareTodo 並び順でaがbより前なら負、後ろなら正を返す
+func compareTodo(a, b *TodoCursor, order TodoOrder) int {
+	c := a.Time.Compare(b.Time)
+	if order.Field == orderByTitle {
+		c = strings.Compare(a.Title, b.Title)
+	}
+	if c == 0 {
+		c = strings.Compare(a.ID, b.ID)
+	}
+	if order.Desc {
+		return -c
+	}
+	return c
+}
+
+// matchFilter sqlStoreのfilterClauseと同じ条件で判定する
+func matchFilter(todo *todoPb.Todo, f TodoFilter) bool {
+	if f.Done != nil && todo.GetDone() != *f.Done {
+		return false
+	}
+	if f.Query != "" && !containsFold(todo.GetTitle(), f.Query) && !containsFold(todo.GetDescription(), f.Query) {
+		return false
+	}
+	return inRange(todo.GetCreateTime().AsTime(), f.CreateTimeStart, f.CreateTimeEnd) &&
+		inRange(todo.GetUpdateTime().AsTime(), f.UpdateTimeStart, f.UpdateTimeEnd)
+}
+
+func inRange(t, start, end time.Time) bool {
+	return (start.IsZero() || !t.Before(start)) && (end.IsZero() || t.Before(end))
+}
+
+// containsFold SQLiteのLIKEに合わせて、ASCIIだけ大文字と小文字を区別しない
+func containsFold(s, substr string) bool {
+	return strings.Contains(asciiLower(s), asciiLower(substr))
+}
+
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+	return string(b)
+}
+
+func (s *memoryStore) Update(ctx context.Context, todo *todoPb.Todo) error {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(tenant, todo.GetId(), todo.GetEtag()); err != nil {
+		return err
+	}
+	version := s.versions[todo.GetId()] + 1
+	updated := proto.Clone(todo).(*todoPb.Todo)
+	updated.Etag = formatEtag(version)
+	audit, err := newAuditEvent(ctx, todoPb.AuditEvent_UPDATE, todo.GetId())
+	if err != nil {
+		return err
+	}
+	setAuditChange(audit, s.todos[todo.GetId()], updated)
+	if err := s.writeEvent(ctx, todoPb.TodoEvent_UPDATED, updated, todo.GetUpdateTime().AsTime(), audit); err != nil {
+		return err
+	}
+	todo.Etag = updated.GetEtag()
+	s.versions[todo.GetId()] = version
+	s.todos[todo.GetId()] = updated
+	return nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id, etag string) error {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.todos[id]; !ok || s.tenants[id] != tenant {
+		return ErrNotFound
+	}
+	if etag != "" {
+		if err := s.check(tenant, id, etag); err != nil {
+			return err
+		}
+	}
+	audit, err := newAuditEvent(ctx, todoPb.AuditEvent_DELETE, id)
+	if err != nil {
+		return err
+	}
+	setAuditChange(audit, s.todos[id], nil)
+	if err := s.writeEvent(ctx, todoPb.TodoEvent_DELETED, &todoPb.Todo{Id: id}, time.Now(), audit); err != nil {
+		return err
+	}
+	delete(s.todos, id)
+	delete(s.versions, id)
+	delete(s.tenants, id)
+	s.counts[tenant]--
+	for i, v := range s.order {
+		if v == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// check tenantのidのtodoがあり、etagが今の版と同じか調べる。s.muを持って呼ぶ
+func (s *memoryStore) check(tenant, id, etag string) error {
+	current, ok := s.versions[id]
+	if !ok || s.tenants[id] != tenant {
+		return ErrNotFound
+	}
+	if version, ok := parseEtag(etag); !ok || version != current {
+		return ErrEtagMismatch
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error { return nil }
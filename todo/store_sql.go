@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	todoPb "gen/go/todo"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// sqlStore SQLiteに保存する
+// 作成、更新、削除はイベントをoutboxに書くのと同じトランザクションで行う。
+// 監査ログも同じトランザクションで書く。
+// どのクエリもcontextのテナントの行だけに当たるようにtenant_idで絞る
+type sqlStore struct {
+	db     *sqlDB
+	outbox *sqlOutbox
+	audit  *sqlAudit
+	// テナントごとのtodoの上限。0なら制限しない
+	maxTodos int
+}
+
+func newSQLStore(db *sqlDB, outbox *sqlOutbox, audit *sqlAudit, maxTodos int) *sqlStore {
+	return &sqlStore{db: db, outbox: outbox, audit: audit, maxTodos: maxTodos}
+}
+
+const todoColumns = `id, title, description, done, create_time, update_time, version`
+
+func (s *sqlStore) Create(ctx context.Context, todo *todoPb.Todo) error {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	created := proto.Clone(todo).(*todoPb.Todo)
+	created.Etag = formatEtag(1)
+	audit, err := newAuditEvent(ctx, todoPb.AuditEvent_CREATE, todo.GetId())
+	if err != nil {
+		return err
+	}
+	err = s.db.InTx(ctx, func(ctx context.Context, tx *sqlTx) error {
+		// 数えるのと書くのを1つの文にして、同時に作っても上限を超えないようにする
+		res, err := tx.ExecContext(ctx,
+			`INSERT INTO todos (tenant_id, `+todoColumns+`) SELECT ?, ?, ?, ?, ?, ?, ?, 1
+			WHERE ? <= 0 OR (SELECT COUNT(*) FROM todos WHERE tenant_id = ?) < ?`,
+			tenant, todo.GetId(), todo.GetTitle(), todo.GetDescription(), todo.GetDone(),
+			todo.GetCreateTime().AsTime().UnixNano(), todo.GetUpdateTime().AsTime().UnixNano(),
+			s.maxTodos, tenant, s.maxTodos,
+		)
+		if err := notFoundIfNoRows(res, err); errors.Is(err, ErrNotFound) {
+			return ErrQuotaExceeded
+		} else if err != nil {
+			return err
+		}
+		setAuditChange(audit, nil, created)
+		return s.writeEvent(ctx, tx, todoPb.TodoEvent_CREATED, created, todo.GetUpdateTime().AsTime(), audit)
+	})
+	if err != nil {
+		return err
+	}
+	s.outbox.notify()
+	todo.Etag = created.GetEtag()
+	return nil
+}
+
+// writeEvent 変更と同じトランザクションでイベントをoutboxに、変更の記録を監査ログに書く
+func (s *sqlStore) writeEvent(ctx context.Context, tx *sqlTx, typ todoPb.TodoEvent_Type, todo *todoPb.Todo, t time.Time, audit *todoPb.AuditEvent) error {
+	m, err := newTodoEventMessage(ctx, typ, todo, t)
+	if err != nil {
+		return err
+	}
+	if err := s.outbox.insert(ctx, tx, m); err != nil {
+		return err
+	}
+	return s.audit.insert(ctx, tx, audit)
+}
+
+func (s *sqlStore) Get(ctx context.Context, id string) (*todoPb.Todo, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	row := s.db.QueryRowContext(ctx, `SELECT `+todoColumns+` FROM todos WHERE tenant_id = ? AND id = ?`, tenant, id)
+	todo, err := scanTodo(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return todo, err
+}
+
+func (s *sqlStore) List(ctx context.Context, query ListQuery) ([]*todoPb.Todo, error) {
+	where, args, err := tenantFilterClause(ctx, query.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// (列, id)の組でカーソルより後ろを取る。インデックスも同じ組なので、ページが進んでも読み飛ばしが増えない
+	column := query.Order.Field
+	cmp, dir := ">", ""
+	if query.Order.Desc {
+		cmp, dir = "<", " DESC"
+	}
+	if c := query.After; c != nil {
+		var key any = c.Title
+		if column != orderByTitle {
+			key = c.Time.UnixNano()
+		}
+		where = append(where, `(`+column+`, id) `+cmp+` (?, ?)`)
+		args = append(args, key, c.ID)
+	}
+
+	stmt := `SELECT ` + todoColumns + ` FROM todos` + whereClause(where) +
+		` ORDER BY ` + column + dir + `, id` + dir + ` LIMIT ?`
+	rows, err := s.db.QueryContext(ctx, stmt, append(args, query.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var todos []*todoPb.Todo
+	for rows.Next() {
+		todo, err := scanTodo(rows)
+		if err != nil {
+			return nil, err
+		}
+		todos = append(todos, todo)
+	}
+	return todos, rows.Err()
+}
+
+func (s *sqlStore) Count(ctx context.Context, filter TodoFilter) (int, error) {
+	where, args, err := tenantFilterClause(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM todos`+whereClause(where), args...).Scan(&n)
+	return n, err
+}
+
+// tenantFilterClause contextのテナントと条件をWHEREの式とその引数にする
+// テナントを先頭にするので、インデックスはどれもtenant_idから始まる
+func tenantFilterClause(ctx context.Context, f TodoFilter) ([]string, []any, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	where, args := filterClause(f)
+	return append([]string{`tenant_id = ?`}, where...), append([]any{tenant}, args...), nil
+}
+
+// filterClause 条件をWHEREの式とその引数にする
+func filterClause(f TodoFilter) ([]string, []any) {
+	var (
+		where []string
+		args  []any
+	)
+	if f.Done != nil {
+		where = append(where, `done = ?`)
+		args = append(args, *f.Done)
+	}
+	if f.Query != "" {
+		// LIKEはASCIIの大文字と小文字を区別しない。%と_は文字としてそのまま探す
+		pattern := "%" + likeEscaper.Replace(f.Query) + "%"
+		where = append(where, `(title LIKE ? ESCAPE '\' OR description LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern)
+	}
+	for _, r := range []struct {
+		column     string
+		start, end time.Time
+	}{
+		{"create_time", f.CreateTimeStart, f.CreateTimeEnd},
+		{"update_time", f.UpdateTimeStart, f.UpdateTimeEnd},
+	} {
+		if !r.start.IsZero() {
+			where = append(where, r.column+` >= ?`)
+			args = append(args, r.start.UnixNano())
+		}
+		if !r.end.IsZero() {
+			where = append(where, r.column+` < ?`)
+			args = append(args, r.end.UnixNano())
+		}
+	}
+	return where, args
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func whereClause(where []string) string {
+	if len(where) == 0 {
+		return ""
+	}
+	return ` WHERE ` + strings.Join(where, ` AND `)
+}
+
+func (s *sqlStore) Update(ctx context.Context, todo *todoPb.Todo) error {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	version, ok := parseEtag(todo.GetEtag())
+	if !ok {
+		return ErrEtagMismatch
+	}
+	updated := proto.Clone(todo).(*todoPb.Todo)
+	audit, err := newAuditEvent(ctx, todoPb.AuditEvent_UPDATE, todo.GetId())
+	if err != nil {
+		return err
+	}
+	err = s.db.InTx(ctx, func(ctx context.Context, tx *sqlTx) error {
+		// 監査ログに残す変更前の値。トランザクションは書き込みのロックを取って始めるので、書き換えるまでに他の更新は入らない
+		before, err := scanTodo(tx.QueryRowContext(ctx,
+			`SELECT `+todoColumns+` FROM todos WHERE tenant_id = ? AND id = ?`, tenant, todo.GetId()))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if before.GetEtag() != formatEtag(version) {
+			return ErrEtagMismatch
+		}
+		if err := tx.QueryRowContext(ctx,
+			`UPDATE todos SET title = ?, description = ?, done = ?, update_time = ?, version = version + 1
+			WHERE tenant_id = ? AND id = ? RETURNING version`,
+			todo.GetTitle(), todo.GetDescription(), todo.GetDone(), todo.GetUpdateTime().AsTime().UnixNano(),
+			tenant, todo.GetId(),
+		).Scan(&version); err != nil {
+			return err
+		}
+		updated.Etag = formatEtag(version)
+		setAuditChange(audit, before, updated)
+		return s.writeEvent(ctx, tx, todoPb.TodoEvent_UPDATED, updated, todo.GetUpdateTime().AsTime(), audit)
+	})
+	if err != nil {
+		return err
+	}
+	s.outbox.notify()
+	todo.Etag = updated.GetEtag()
+	return nil
+}
+
+func (s *sqlStore) Delete(ctx context.Context, id, etag string) error {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	var version int64
+	if etag != "" {
+		var ok bool
+		if version, ok = parseEtag(etag); !ok {
+			return ErrEtagMismatch
+		}
+	}
+	audit, err := newAuditEvent(ctx, todoPb.AuditEvent_DELETE, id)
+	if err != nil {
+		return err
+	}
+	err = s.db.InTx(ctx, func(ctx context.Context, tx *sqlTx) error {
+		// 消した行を返させて、監査ログに変更前の値として残す
+		stmt, args := `DELETE FROM todos WHERE tenant_id = ? AND id = ?`, []any{tenant, id}
+		if etag != "" {
+			stmt, args = stmt+` AND version = ?`, append(args, version)
+		}
+		before, err := scanTodo(tx.QueryRowContext(ctx, stmt+` RETURNING `+todoColumns, args...))
+		switch {
+		case errors.Is(err, sql.ErrNoRows) && etag != "":
+			return conflict(ctx, tx, tenant, id)
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrNotFound
+		case err != nil:
+			return err
+		}
+		setAuditChange(audit, before, nil)
+		return s.writeEvent(ctx, tx, todoPb.TodoEvent_DELETED, &todoPb.Todo{Id: id}, time.Now(), audit)
+	})
+	if err != nil {
+		return err
+	}
+	s.outbox.notify()
+	return nil
+}
+
+// conflict idとversionで1行も当たらなかったときに、見つからないのかetagが違うのかを調べる
+func conflict(ctx context.Context, tx *sqlTx, tenant, id string) error {
+	var one int
+	err := tx.QueryRowContext(ctx, `SELECT 1 FROM todos WHERE tenant_id = ? AND id = ?`, tenant, id).Scan(&one)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrNotFound
+	case err != nil:
+		return err
+	}
+	return ErrEtagMismatch
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func notFoundIfNoRows(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTodo(s scanner) (*todoPb.Todo, error) {
+	var (
+		todo                   todoPb.Todo
+		createTime, updateTime int64
+		version                int64
+	)
+	if err := s.Scan(&todo.Id, &todo.Title, &todo.Description, &todo.Done, &createTime, &updateTime, &version); err != nil {
+		return nil, err
+	}
+	todo.Etag = formatEtag(version)
+	todo.CreateTime = timestamppb.New(time.Unix(0, createTime))
+	todo.UpdateTime = timestamppb.New(time.Unix(0, updateTime))
+	return &todo, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	todoPb "gen/go/todo"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// テナントの分離
+// どの保存先も、テナントAで書いたものはテナントBからは見つからないか、空の結果になることを確かめる
+
+const (
+	tenantA = "tenant-a"
+	tenantB = "tenant-b"
+)
+
+// openTestStores TODO_STOREにkindを指定してopenStoreで開く。sqliteは一時ディレクトリに作る
+func openTestStores(t *testing.T, kind string) *stores {
+	t.Helper()
+	t.Setenv(storeEnv, kind)
+	t.Setenv(sqlitePathEnv, filepath.Join(t.TempDir(), "todo.db"))
+	t.Setenv(sqliteMigrateEnv, "")
+	s, err := openStore(context.Background())
+	if err != nil {
+		t.Fatalf("openStore(%s): %v", kind, err)
+	}
+	t.Cleanup(func() { s.todos.Close() })
+	return s
+}
+
+func newTestTodo(title string) *todoPb.Todo {
+	now := timestamppb.Now()
+	return &todoPb.Todo{Id: newTodoID(), Title: title, CreateTime: now, UpdateTime: now}
+}
+
+func TestStoreTenantIsolation(t *testing.T) {
+	tests := []struct {
+		name string
+		// テナントAのctxで書き、テナントBのctxで読んで確かめる
+		run func(t *testing.T, s *stores, a, b context.Context)
+	}{
+		{
+			name: "Get",
+			run: func(t *testing.T, s *stores, a, b context.Context) {
+				todo := createTestTodo(t, s, a)
+				if _, err := s.todos.Get(b, todo.GetId()); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Get from tenant B: err = %v, want ErrNotFound", err)
+				}
+				if _, err := s.todos.Get(a, todo.GetId()); err != nil {
+					t.Errorf("Get from tenant A: %v", err)
+				}
+			},
+		},
+		{
+			name: "List and Count",
+			run: func(t *testing.T, s *stores, a, b context.Context) {
+				createTestTodo(t, s, a)
+				todos, err := s.todos.List(b, ListQuery{Order: TodoOrder{Field: orderByCreateTime}, Limit: 10})
+				if err != nil {
+					t.Fatalf("List: %v", err)
+				}
+				if len(todos) != 0 {
+					t.Errorf("List from tenant B returned %d todos, want 0", len(todos))
+				}
+				if n, err := s.todos.Count(b, TodoFilter{}); err != nil || n != 0 {
+					t.Errorf("Count from tenant B = %d, %v, want 0", n, err)
+				}
+			},
+		},
+		{
+			name: "Update",
+			run: func(t *testing.T, s *stores, a, b context.Context) {
+				todo := createTestTodo(t, s, a)
+				changed := newTestTodo("changed by B")
+				changed.Id, changed.Etag, changed.CreateTime = todo.GetId(), todo.GetEtag(), todo.GetCreateTime()
+				if err := s.todos.Update(b, changed); !errors.Is(err, ErrNotFound) {
+					t.Errorf("Update from tenant B: err = %v, want ErrNotFound", err)
+				}
+				assertUnchanged(t, s, a, todo)
+			},
+		},
+		{
+			name: "Delete",
+			run: func(t *testing.T, s *stores, a, b context.Context) {
+				todo := createTestTodo(t, s, a)
+				for _, etag := range []string{"", todo.GetEtag()} {
+					if err := s.todos.Delete(b, todo.GetId(), etag); !errors.Is(err, ErrNotFound) {
+						t.Errorf("Delete(etag %q) from tenant B: err = %v, want ErrNotFound", etag, err)
+					}
+				}
+				assertUnchanged(t, s, a, todo)
+			},
+		},
+		{
+			name: "audit events",
+			run: func(t *testing.T, s *stores, a, b context.Context) {
+				createTestTodo(t, s, a)
+				events, err := s.audit.listAuditEvents(b, auditQuery{limit: 10})
+				if err != nil {
+					t.Fatalf("listAuditEvents: %v", err)
+				}
+				if len(events) != 0 {
+					t.Errorf("listAuditEvents from tenant B returned %d events, want 0", len(events))
+				}
+			},
+		},
+		{
+			name: "webhooks",
+			run: func(t *testing.T, s *stores, a, b context.Context) {
+				w := &todoPb.Webhook{Id: newTodoID(), Url: "https://example.com/hook", CreateTime: timestamppb.Now()}
+				if err := s.webhooks.createWebhook(a, w); err != nil {
+					t.Fatalf("createWebhook: %v", err)
+				}
+				if _, err := s.webhooks.getWebhook(b, w.GetId()); !errors.Is(err, errWebhookNotFound) {
+					t.Errorf("getWebhook from tenant B: err = %v, want errWebhookNotFound", err)
+				}
+				if ws, err := s.webhooks.listWebhooks(b); err != nil || len(ws) != 0 {
+					t.Errorf("listWebhooks from tenant B = %d webhooks, %v, want 0", len(ws), err)
+				}
+				if err := s.webhooks.deleteWebhook(b, w.GetId()); !errors.Is(err, errWebhookNotFound) {
+					t.Errorf("deleteWebhook from tenant B: err = %v, want errWebhookNotFound", err)
+				}
+
+				now := timestamppb.Now()
+				err := s.webhooks.enqueue(a, []*webhookDelivery{{
+					WebhookDelivery: &todoPb.WebhookDelivery{
+						Id:              newTodoID(),
+						WebhookId:       w.GetId(),
+						EventType:       todoPb.TodoEvent_CREATED,
+						TodoId:          newTodoID(),
+						State:           todoPb.WebhookDelivery_PENDING,
+						NextAttemptTime: now,
+						CreateTime:      now,
+						UpdateTime:      now,
+					},
+					messageID: newTodoID(),
+					payload:   []byte(`{}`),
+					headers:   map[string]string{},
+				}})
+				if err != nil {
+					t.Fatalf("enqueue: %v", err)
+				}
+				query := deliveryQuery{webhookID: w.GetId(), limit: 10}
+				if ds, err := s.webhooks.listDeliveries(b, query); err != nil || len(ds) != 0 {
+					t.Errorf("listDeliveries from tenant B = %d deliveries, %v, want 0", len(ds), err)
+				}
+				if ds, err := s.webhooks.listDeliveries(a, query); err != nil || len(ds) != 1 {
+					t.Errorf("listDeliveries from tenant A = %d deliveries, %v, want 1", len(ds), err)
+				}
+			},
+		},
+		{
+			name: "idempotency keys",
+			run: func(t *testing.T, s *stores, a, b context.Context) {
+				const method, key = "/todo.TodoApi/CreateTodo", "same-key"
+				now := time.Now()
+				if _, err := s.idempotency.reserve(a, method, key, []byte("a"), now, now.Add(time.Minute)); err != nil {
+					t.Fatalf("reserve from tenant A: %v", err)
+				}
+				if err := s.idempotency.complete(a, method, key, []byte("response of A"), now.Add(time.Hour)); err != nil {
+					t.Fatalf("complete: %v", err)
+				}
+				rec, err := s.idempotency.reserve(b, method, key, []byte("b"), now, now.Add(time.Minute))
+				if err != nil {
+					t.Fatalf("reserve from tenant B: %v", err)
+				}
+				if rec != nil {
+					t.Errorf("reserve from tenant B returned the record of tenant A: %q", rec.response)
+				}
+			},
+		},
+	}
+
+	for _, kind := range []string{"memory", "sqlite"} {
+		for _, tt := range tests {
+			t.Run(kind+"/"+tt.name, func(t *testing.T) {
+				s := openTestStores(t, kind)
+				ctx := context.Background()
+				tt.run(t, s, withTenant(ctx, tenantA), withTenant(ctx, tenantB))
+			})
+		}
+	}
+}
+
+func createTestTodo(t *testing.T, s *stores, ctx context.Context) *todoPb.Todo {
+	t.Helper()
+	todo := newTestTodo("created by A")
+	if err := s.todos.Create(ctx, todo); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	return todo
+}
+
+// assertUnchanged テナントAからは書いたときのまま見える
+func assertUnchanged(t *testing.T, s *stores, ctx context.Context, want *todoPb.Todo) {
+	t.Helper()
+	got, err := s.todos.Get(ctx, want.GetId())
+	if err != nil {
+		t.Fatalf("Get from tenant A: %v", err)
+	}
+	if got.GetTitle() != want.GetTitle() || got.GetEtag() != want.GetEtag() {
+		t.Errorf("todo of tenant A changed: title %q etag %q, want title %q etag %q",
+			got.GetTitle(), got.GetEtag(), want.GetTitle(), want.GetEtag())
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	todoPb "gen/go/todo"
+	"math"
+	"os"
+	"pkg/broker"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	otelapi "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	grpcCodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// テナント
+// bffは認証したテナントをメタデータx-tenant-idとbaggageのtenant.idで渡す。
+// TodoApiのRPCはテナントをcontextに入れてから処理し、保存先はすべての読み書きをそのテナントに絞る。
+// どちらもなければTODO_DEFAULT_TENANTのテナントとして扱う
+//
+// テナントごとに、1秒あたりのリクエスト数(TODO_TENANT_RATE, TODO_TENANT_BURST)と
+// todoの件数(TODO_TENANT_MAX_TODOS)を制限する。0なら制限しない
+
+const (
+	tenantMetadata   = "x-tenant-id"
+	tenantBaggageKey = "tenant.id"
+	// ブローカーのメッセージのヘッダー。購読する側はこれでテナントを知る
+	tenantHeader = "tenant-id"
+
+	defaultTenantEnv  = "TODO_DEFAULT_TENANT"
+	tenantRateEnv     = "TODO_TENANT_RATE"
+	tenantBurstEnv    = "TODO_TENANT_BURST"
+	tenantMaxTodosEnv = "TODO_TENANT_MAX_TODOS"
+
+	defaultTenant         = "default"
+	defaultTenantRate     = 50
+	defaultTenantBurst    = 100
+	defaultTenantMaxTodos = 10000
+)
+
+// テナントIDに使える文字。メタデータ、baggage、SQLにそのまま入れられるものだけ
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+var errNoTenant = errors.New("no tenant in context")
+
+type tenantKey struct{}
+
+// withTenant テナントをcontextに入れる。後で呼ぶgreetにも伝わるようにbaggageにも入れる
+func withTenant(ctx context.Context, tenant string) context.Context {
+	ctx = context.WithValue(ctx, tenantKey{}, tenant)
+	if m, err := baggage.NewMemberRaw(tenantBaggageKey, tenant); err == nil {
+		if b, err := baggage.FromContext(ctx).SetMember(m); err == nil {
+			ctx = baggage.ContextWithBaggage(ctx, b)
+		}
+	}
+	return ctx
+}
+
+// tenantFromContext 保存先はこれでテナントを調べる。なければ読み書きしない
+func tenantFromContext(ctx context.Context) (string, error) {
+	if t, ok := ctx.Value(tenantKey{}).(string); ok && t != "" {
+		return t, nil
+	}
+	return "", errNoTenant
+}
+
+// withMessageTenant メッセージのテナントをcontextに入れる。テナントがなければやり直しても変わらない
+func withMessageTenant(ctx context.Context, m *broker.Message) (context.Context, error) {
+	tenant := m.Headers[tenantHeader]
+	if !tenantIDPattern.MatchString(tenant) {
+		return ctx, broker.Permanent(fmt.Errorf("message %s: invalid tenant %q", m.ID, tenant))
+	}
+	return withTenant(ctx, tenant), nil
+}
+
+// tenantAttribute メトリクスに付ける属性。テナントを決める前のcontextではbaggageから取る
+func tenantAttribute(ctx context.Context) attribute.KeyValue {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		tenant = baggage.FromContext(ctx).Member(tenantBaggageKey).Value()
+	}
+	return attribute.String(tenantBaggageKey, tenant)
+}
+
+// tenantFromIncoming メタデータ、baggageの順に探す
+func tenantFromIncoming(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(tenantMetadata); len(v) > 0 {
+		return v[0]
+	}
+	return baggage.FromContext(ctx).Member(tenantBaggageKey).Value()
+}
+
+type tenants struct {
+	defaultTenant string
+	// 1秒あたりに増えるトークンの数。0なら制限しない
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// 最後に使われていないバケツを捨てた時刻
+	lastSweep time.Time
+
+	requests metric.Int64Counter
+}
+
+// tokenBucket テナントごとのリクエスト数の制限
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTenants() (*tenants, error) {
+	t := &tenants{defaultTenant: os.Getenv(defaultTenantEnv), now: time.Now, buckets: map[string]*tokenBucket{}}
+	if t.defaultTenant == "" {
+		t.defaultTenant = defaultTenant
+	}
+	if !tenantIDPattern.MatchString(t.defaultTenant) {
+		return nil, fmt.Errorf("%s: invalid tenant %q", defaultTenantEnv, t.defaultTenant)
+	}
+	rate, err := intFromEnv(tenantRateEnv, defaultTenantRate)
+	if err != nil {
+		return nil, err
+	}
+	burst, err := intFromEnv(tenantBurstEnv, defaultTenantBurst)
+	if err != nil {
+		return nil, err
+	}
+	if rate > 0 && burst <= 0 {
+		return nil, errors.New(tenantBurstEnv + " must be positive")
+	}
+	t.rate, t.burst = float64(rate), float64(burst)
+
+	if t.requests, err = otelapi.Meter("todo").Int64Counter("todo.tenant.requests",
+		metric.WithDescription("Number of TodoApi requests by tenant and result"),
+		metric.WithUnit("{request}"),
+	); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// tenantMethod テナントが必要なRPCか。ヘルスチェックやリフレクションは対象にしない
+func tenantMethod(fullMethod string) bool {
+	return strings.HasPrefix(fullMethod, "/"+todoPb.TodoApi_ServiceDesc.ServiceName+"/")
+}
+
+func (t *tenants) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if !tenantMethod(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		ctx, err := t.admit(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		res, err := handler(ctx, req)
+		t.record(ctx, info.FullMethod, err)
+		return res, err
+	}
+}
+
+func (t *tenants) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !tenantMethod(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		ctx, err := t.admit(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		err = handler(srv, &tenantStream{ServerStream: ss, ctx: ctx})
+		t.record(ctx, info.FullMethod, err)
+		return err
+	}
+}
+
+// tenantStream Contextだけテナントを入れたものに差し替える
+type tenantStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tenantStream) Context() context.Context { return s.ctx }
+
+// admit テナントを決めてcontextに入れ、リクエスト数の制限を超えていれば断る
+func (t *tenants) admit(ctx context.Context, method string) (context.Context, error) {
+	tenant := tenantFromIncoming(ctx)
+	if tenant == "" {
+		tenant = t.defaultTenant
+	}
+	if !tenantIDPattern.MatchString(tenant) {
+		return ctx, invalidArgument(ctx, fmt.Errorf("invalid tenant id %q", tenant))
+	}
+	ctx = withTenant(ctx, tenant)
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String(tenantBaggageKey, tenant))
+
+	if wait, ok := t.allow(tenant); !ok {
+		t.requests.Add(ctx, 1, metric.WithAttributes(
+			attribute.String(tenantBaggageKey, tenant),
+			attribute.String("rpc.method", method),
+			attribute.String("result", "rate_limited"),
+		))
+		return ctx, todoError(ctx, grpcCodes.ResourceExhausted, reasonTenantRateLimited,
+			"too many requests for the tenant, retry later",
+			&errdetails.QuotaFailure{Violations: []*errdetails.QuotaFailure_Violation{{
+				Subject:     "tenant:" + tenant,
+				Description: "requests per second",
+			}}},
+			&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)})
+	}
+	return ctx, nil
+}
+
+// allow トークンを1つ使う。足りなければ1つ貯まるまでの時間を返す
+func (t *tenants) allow(tenant string) (time.Duration, bool) {
+	if t.rate <= 0 {
+		return 0, true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.sweep(now)
+	b, ok := t.buckets[tenant]
+	if !ok {
+		b = &tokenBucket{tokens: t.burst, last: now}
+		t.buckets[tenant] = b
+	}
+	b.tokens = math.Min(t.burst, b.tokens+now.Sub(b.last).Seconds()*t.rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / t.rate * float64(time.Second))
+		return wait, false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// sweep burst/rate秒より長く使われていないバケツを捨てる
+// その間にトークンは満タンまで貯まっているので、捨てて次に新しく作っても同じになる。
+// 毎回全部は見ず、burst/rate秒に1回だけ見る
+func (t *tenants) sweep(now time.Time) {
+	idle := time.Duration(t.burst / t.rate * float64(time.Second))
+	if now.Sub(t.lastSweep) < idle {
+		return
+	}
+	t.lastSweep = now
+	for tenant, b := range t.buckets {
+		if now.Sub(b.last) >= idle {
+			delete(t.buckets, tenant)
+		}
+	}
+}
+
+func (t *tenants) record(ctx context.Context, method string, err error) {
+	t.requests.Add(ctx, 1, metric.WithAttributes(
+		tenantAttribute(ctx),
+		attribute.String("rpc.method", method),
+		attribute.String("result", status.Code(err).String()),
+	))
+}
+
+// tenantClientInterceptor greetにもメタデータでテナントを渡す
+func tenantClientInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(outgoingTenant(ctx), method, req, reply, cc, opts...)
+}
+
+func tenantStreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(outgoingTenant(ctx), desc, cc, method, opts...)
+}
+
+func outgoingTenant(ctx context.Context) context.Context {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return ctx
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	md.Set(tenantMetadata, tenant)
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// quotaExceededError テナントのtodoが上限に達した。再試行しても通らないのでRetryInfoは付けない
+func quotaExceededError(ctx context.Context) error {
+	tenant, _ := tenantFromContext(ctx)
+	return todoError(ctx, grpcCodes.ResourceExhausted, reasonTodoQuotaExceeded,
+		"the tenant has too many todos, delete some before creating more",
+		&errdetails.QuotaFailure{Violations: []*errdetails.QuotaFailure_Violation{{
+			Subject:     "tenant:" + tenant,
+			Description: "todos per tenant",
+		}}})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	todoPb "gen/go/todo"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	grpcCodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// TodoのCRUD
+
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 2000
+)
+
+func (s *todoServer) CreateTodo(ctx context.Context, req *todoPb.CreateTodoRequest) (*todoPb.Todo, error) {
+	if err := validateTodo(req.GetTodo()); err != nil {
+		return nil, invalidArgument(ctx, err)
+	}
+
+	now := timestamppb.Now()
+	todo := &todoPb.Todo{
+		Id:          newTodoID(),
+		Title:       req.GetTodo().GetTitle(),
+		Description: req.GetTodo().GetDescription(),
+		Done:        req.GetTodo().GetDone(),
+		CreateTime:  now,
+		UpdateTime:  now,
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("todo.id", todo.GetId()))
+
+	if err := s.store.Create(ctx, todo); err != nil {
+		return nil, storeError(ctx, err)
+	}
+	return todo, nil
+}
+
+func (s *todoServer) GetTodo(ctx context.Context, req *todoPb.GetTodoRequest) (*todoPb.Todo, error) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("todo.id", req.GetId()))
+
+	todo, err := s.store.Get(ctx, req.GetId())
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+	return todo, nil
+}
+
+func (s *todoServer) UpdateTodo(ctx context.Context, req *todoPb.UpdateTodoRequest) (*todoPb.Todo, error) {
+	in := req.GetTodo()
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("todo.id", in.GetId()))
+
+	paths, err := updatePaths(req.GetUpdateMask())
+	if err != nil {
+		return nil, invalidArgument(ctx, err)
+	}
+	span.SetAttributes(
+		attribute.StringSlice("todo.update_mask", paths),
+		attribute.Bool("todo.etag_specified", in.GetEtag() != ""),
+	)
+
+	todo, err := s.store.Get(ctx, in.GetId())
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+	if in.GetEtag() != "" && in.GetEtag() != todo.GetEtag() {
+		return nil, storeError(ctx, ErrEtagMismatch)
+	}
+	for _, path := range paths {
+		switch path {
+		case "title":
+			todo.Title = in.GetTitle()
+		case "description":
+			todo.Description = in.GetDescription()
+		case "done":
+			todo.Done = in.GetDone()
+		}
+	}
+	if err := validateTodo(todo); err != nil {
+		return nil, invalidArgument(ctx, err)
+	}
+	todo.UpdateTime = timestamppb.Now()
+
+	// 読んだときのetagで書き込むので、間に他の更新があればErrEtagMismatchになる
+	if err := s.store.Update(ctx, todo); err != nil {
+		if errors.Is(err, ErrEtagMismatch) && in.GetEtag() == "" {
+			// 呼び出し元はetagを指定していないので、やり直せば通る
+			return nil, todoError(ctx, grpcCodes.Aborted, reasonConcurrentModification,
+				"todo was updated concurrently, retry the request")
+		}
+		return nil, storeError(ctx, err)
+	}
+	return todo, nil
+}
+
+func (s *todoServer) DeleteTodo(ctx context.Context, req *todoPb.DeleteTodoRequest) (*emptypb.Empty, error) {
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("todo.id", req.GetId()),
+		attribute.Bool("todo.etag_specified", req.GetEtag() != ""),
+	)
+
+	if err := s.store.Delete(ctx, req.GetId(), req.GetEtag()); err != nil {
+		return nil, storeError(ctx, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// 更新できるフィールド
+var mutableTodoFields = []string{"title", "description", "done"}
+
+// updatePaths update_maskを置き換えるフィールドの一覧にする。サーバーが決めるフィールドは無視する
+func updatePaths(mask *fieldmaskpb.FieldMask) ([]string, error) {
+	if len(mask.GetPaths()) == 0 || slices.Equal(mask.GetPaths(), []string{"*"}) {
+		return mutableTodoFields, nil
+	}
+	var paths []string
+	for _, path := range mask.GetPaths() {
+		switch path {
+		case "title", "description", "done":
+			if !slices.Contains(paths, path) {
+				paths = append(paths, path)
+			}
+		case "id", "etag", "create_time", "update_time":
+		default:
+			return nil, fmt.Errorf("update_mask: unknown field %q", path)
+		}
+	}
+	return paths, nil
+}
+
+func validateTodo(todo *todoPb.Todo) error {
+	title := todo.GetTitle()
+	switch {
+	case strings.TrimSpace(title) == "":
+		return errors.New("title is required")
+	case !utf8.ValidString(title) || !utf8.ValidString(todo.GetDescription()):
+		return errors.New("title and description must be valid UTF-8")
+	case utf8.RuneCountInString(title) > maxTitleLength:
+		return fmt.Errorf("title must be at most %d characters", maxTitleLength)
+	case utf8.RuneCountInString(todo.GetDescription()) > maxDescriptionLength:
+		return fmt.Errorf("description must be at most %d characters", maxDescriptionLength)
+	}
+	return nil
+}
+
+// newTodoID 128bitの乱数を16進数にしたID
+func newTodoID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func invalidArgument(ctx context.Context, err error) error {
+	trace.SpanFromContext(ctx).SetStatus(codes.Error, err.Error())
+	return status.Error(grpcCodes.InvalidArgument, err.Error())
+}
+
+// storeError 保存先のエラーをstatusにする
+func storeError(ctx context.Context, err error) error {
+	if errors.Is(err, ErrNotFound) || errors.Is(err, errWebhookNotFound) {
+		return status.Error(grpcCodes.NotFound, err.Error())
+	}
+	if errors.Is(err, ErrEtagMismatch) {
+		return etagMismatchError(ctx)
+	}
+	if errors.Is(err, ErrQuotaExceeded) {
+		return quotaExceededError(ctx)
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return status.FromContextError(ctxErr).Err()
+	}
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return status.Error(grpcCodes.Internal, "failed to access the todo store")
+}
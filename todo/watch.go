@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	todoPb "gen/go/todo"
+	"pkg/broker"
+	"sync"
+	"time"
+
+	otelapi "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	grpcCodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// WatchTodosの変更通知
+// watchHubはブローカーのtodo.eventsトピックを購読し、届いたイベントを見ている全員に配る。
+// イベントはoutboxからリレーされるので、変更がコミットされた順に届く。
+// 直近のイベントは履歴に残し、resume_tokenを渡されたらその続きから送る。
+// 履歴はプロセスのメモリにしかないので、再起動した後や履歴から消えた後のトークンは使えない。
+// その場合は一覧を取り直してから、空のトークンで見直してもらう
+//
+// 送るのが追いつかない相手のためにイベントを溜め続けたり、変更する側を待たせたりはしない。
+// 相手ごとのバッファが一杯になったら、その相手だけRESOURCE_EXHAUSTEDで切る。
+// 最後に受け取ったresume_tokenで見直せば、履歴から続きを受け取れる
+//
+// イベントは見ている相手と同じテナントのものだけを送る。番号はテナントをまたいで振るので、途中が飛ぶことがある
+
+const (
+	watchHistoryEnv   = "TODO_WATCH_HISTORY"
+	watchBufferEnv    = "TODO_WATCH_BUFFER"
+	watchHeartbeatEnv = "TODO_WATCH_HEARTBEAT"
+
+	defaultWatchHistory   = 1000
+	defaultWatchBuffer    = 100
+	defaultWatchHeartbeat = 15 * time.Second
+)
+
+// todoEvent 配るイベント。受け取ったメッセージを処理したspanを持っていて、送るときのspanからリンクする
+type todoEvent struct {
+	seq      uint64
+	tenant   string
+	typ      todoPb.TodoEvent_Type
+	todo     *todoPb.Todo
+	time     time.Time
+	producer trace.SpanContext
+}
+
+var (
+	errInvalidResumeToken = errors.New("resume token is invalid")
+	errResumeTokenExpired = errors.New("resume token has expired")
+	errWatcherTooSlow     = errors.New("watcher could not keep up with the events")
+	errWatchHubClosed     = errors.New("todo server is shutting down")
+)
+
+type watchHub struct {
+	// プロセスごとに変わる。別のプロセスが出したトークンを見分ける
+	epoch      string
+	bufferSize int
+	heartbeat  time.Duration
+
+	mu      sync.Mutex
+	seq     uint64
+	history []*todoEvent
+	// 履歴に残す最大の件数
+	historySize int
+	watchers    map[*watcher]struct{}
+	closed      bool
+
+	watchersGauge metric.Int64UpDownCounter
+	events        metric.Int64Counter
+	disconnects   metric.Int64Counter
+}
+
+type watcher struct {
+	tenant string
+	ch     chan *todoEvent
+	// 切られたら閉じる。理由はerr
+	done chan struct{}
+	err  error
+}
+
+func newWatchHub() (*watchHub, error) {
+	historySize, err := intFromEnv(watchHistoryEnv, defaultWatchHistory)
+	if err != nil {
+		return nil, err
+	}
+	bufferSize, err := intFromEnv(watchBufferEnv, defaultWatchBuffer)
+	if err != nil {
+		return nil, err
+	}
+	heartbeat, err := millisFromEnv(watchHeartbeatEnv, defaultWatchHeartbeat)
+	if err != nil {
+		return nil, err
+	}
+	if bufferSize <= 0 || heartbeat <= 0 {
+		return nil, errors.New(watchBufferEnv + " and " + watchHeartbeatEnv + " must be positive")
+	}
+
+	var b [8]byte
+	rand.Read(b[:])
+	h := &watchHub{
+		epoch:       hex.EncodeToString(b[:]),
+		bufferSize:  bufferSize,
+		heartbeat:   heartbeat,
+		historySize: historySize,
+		watchers:    map[*watcher]struct{}{},
+	}
+
+	meter := otelapi.Meter("todo")
+	if h.watchersGauge, err = meter.Int64UpDownCounter("todo.watch.watchers",
+		metric.WithDescription("Number of active WatchTodos streams"),
+		metric.WithUnit("{watcher}"),
+	); err != nil {
+		return nil, err
+	}
+	if h.events, err = meter.Int64Counter("todo.watch.events",
+		metric.WithDescription("Number of published todo events by type"),
+		metric.WithUnit("{event}"),
+	); err != nil {
+		return nil, err
+	}
+	if h.disconnects, err = meter.Int64Counter("todo.watch.disconnects",
+		metric.WithDescription("Number of WatchTodos streams closed by the server by reason"),
+		metric.WithUnit("{watcher}"),
+	); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// consume ブローカーから届いたTodoEventを配る
+func (h *watchHub) consume(ctx context.Context, m *broker.Message) error {
+	var e todoPb.TodoEvent
+	if err := proto.Unmarshal(m.Payload, &e); err != nil {
+		return broker.Permanent(fmt.Errorf("unmarshal todo event %s: %w", m.ID, err))
+	}
+	ctx, err := withMessageTenant(ctx, m)
+	if err != nil {
+		return err
+	}
+	h.publish(ctx, e.GetType(), e.GetTodo(), e.GetEventTime().AsTime())
+	return nil
+}
+
+// publish ctxはメッセージを処理しているもので、イベントのテナントが入っている
+func (h *watchHub) publish(ctx context.Context, typ todoPb.TodoEvent_Type, todo *todoPb.Todo, t time.Time) {
+	tenant, _ := tenantFromContext(ctx)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+
+	h.seq++
+	e := &todoEvent{
+		seq:      h.seq,
+		tenant:   tenant,
+		typ:      typ,
+		todo:     todo,
+		time:     t,
+		producer: trace.SpanContextFromContext(ctx),
+	}
+	h.history = append(h.history, e)
+	if len(h.history) > h.historySize {
+		h.history = h.history[len(h.history)-h.historySize:]
+	}
+	h.events.Add(ctx, 1, metric.WithAttributes(attribute.String("type", typ.String()), tenantAttribute(ctx)))
+
+	for w := range h.watchers {
+		if w.tenant != tenant {
+			continue
+		}
+		select {
+		case w.ch <- e:
+		default:
+			h.drop(ctx, w, errWatcherTooSlow, reasonWatcherTooSlow)
+		}
+	}
+}
+
+// subscribe afterより後のイベントを受け取る。afterがnilなら今より後だけ
+// 履歴から送るイベントも返すので、見落としも重複もない。どちらもctxのテナントのものだけ
+func (h *watchHub) subscribe(ctx context.Context, after *uint64) (*watcher, []*todoEvent, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, nil, errWatchHubClosed
+	}
+
+	var backlog []*todoEvent
+	if after != nil {
+		// 次に送るイベントが履歴にないなら、間が抜けてしまう
+		next := *after + 1
+		switch {
+		case *after > h.seq:
+			return nil, nil, errResumeTokenExpired
+		case next <= h.seq && (len(h.history) == 0 || h.history[0].seq > next):
+			return nil, nil, errResumeTokenExpired
+		}
+		for _, e := range h.history {
+			if e.seq >= next && e.tenant == tenant {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	w := &watcher{tenant: tenant, ch: make(chan *todoEvent, h.bufferSize), done: make(chan struct{})}
+	h.watchers[w] = struct{}{}
+	h.watchersGauge.Add(ctx, 1)
+	return w, backlog, nil
+}
+
+func (h *watchHub) unsubscribe(ctx context.Context, w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.watchers[w]; ok {
+		delete(h.watchers, w)
+		h.watchersGauge.Add(ctx, -1)
+	}
+}
+
+// drop wを切る。h.muを持って呼ぶ
+func (h *watchHub) drop(ctx context.Context, w *watcher, err error, reason string) {
+	delete(h.watchers, w)
+	h.watchersGauge.Add(ctx, -1)
+	h.disconnects.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", reason)))
+	w.err = err
+	close(w.done)
+}
+
+// close 止めるときに全員を切る。GracefulStopが終わらないストリームを待ち続けないようにする
+func (h *watchHub) close(ctx context.Context) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for w := range h.watchers {
+		h.drop(ctx, w, errWatchHubClosed, "shutdown")
+	}
+}
+
+func (s *todoServer) WatchTodos(req *todoPb.WatchTodosRequest, stream todoPb.TodoApi_WatchTodosServer) error {
+	ctx := stream.Context()
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Bool("todo.watch.resume", req.GetResumeToken() != ""))
+
+	var after *uint64
+	if token := req.GetResumeToken(); token != "" {
+		seq, err := s.watch.decodeResumeToken(token)
+		if err != nil {
+			return s.watchError(ctx, err)
+		}
+		after = &seq
+	}
+
+	w, backlog, err := s.watch.subscribe(ctx, after)
+	if err != nil {
+		return s.watchError(ctx, err)
+	}
+	defer s.watch.unsubscribe(ctx, w)
+	span.SetAttributes(attribute.Int("todo.watch.backlog", len(backlog)))
+
+	// 見始めたことをすぐ知らせる。受け取る側は最初のメッセージでエラーでないことがわかる
+	if err := sendHeartbeat(stream, time.Now()); err != nil {
+		return err
+	}
+	for _, e := range backlog {
+		if err := s.sendEvent(ctx, stream, e); err != nil {
+			return err
+		}
+	}
+
+	heartbeat := time.NewTicker(s.watch.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-w.done:
+			return s.watchError(ctx, w.err)
+		case e := <-w.ch:
+			if err := s.sendEvent(ctx, stream, e); err != nil {
+				return err
+			}
+			heartbeat.Reset(s.watch.heartbeat)
+		case t := <-heartbeat.C:
+			if err := sendHeartbeat(stream, t); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func sendHeartbeat(stream todoPb.TodoApi_WatchTodosServer, t time.Time) error {
+	return stream.Send(&todoPb.WatchTodosResponse{
+		Kind: &todoPb.WatchTodosResponse_Heartbeat{Heartbeat: timestamppb.New(t)},
+	})
+}
+
+// sendEvent イベントごとにspanを作り、メッセージを処理したspanにリンクする。そのspanは変更したRPCと同じトレースにある
+// WatchTodosのspanは長く続くので、どの変更をいつ送ったかはこのspanで追う
+func (s *todoServer) sendEvent(ctx context.Context, stream todoPb.TodoApi_WatchTodosServer, e *todoEvent) error {
+	var opts []trace.SpanStartOption
+	if e.producer.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: e.producer}))
+	}
+	opts = append(opts, trace.WithAttributes(
+		attribute.String("todo.event.type", e.typ.String()),
+		attribute.String("todo.id", e.todo.GetId()),
+		attribute.Int64("todo.event.sequence", int64(e.seq)),
+		attribute.Float64("todo.event.delay_ms", float64(time.Since(e.time).Microseconds())/1000),
+	))
+	_, span := otelapi.Tracer("todo").Start(ctx, "todo.watch.send", opts...)
+	defer span.End()
+
+	err := stream.Send(&todoPb.WatchTodosResponse{Kind: &todoPb.WatchTodosResponse_Event{Event: &todoPb.TodoEvent{
+		Type:        e.typ,
+		Todo:        e.todo,
+		EventTime:   timestamppb.New(e.time),
+		ResumeToken: s.watch.encodeResumeToken(e.seq),
+	}}})
+	if err != nil {
+		span.RecordError(err)
+	}
+	return err
+}
+
+func (s *todoServer) watchError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(err, errInvalidResumeToken):
+		return invalidArgument(ctx, err)
+	case errors.Is(err, errResumeTokenExpired):
+		return todoError(ctx, grpcCodes.FailedPrecondition, reasonResumeTokenExpired,
+			"resume token has expired, list the todos again and watch without a resume token")
+	case errors.Is(err, errWatcherTooSlow):
+		return todoError(ctx, grpcCodes.ResourceExhausted, reasonWatcherTooSlow,
+			"watcher could not keep up with the events, watch again with the last resume token")
+	case errors.Is(err, errWatchHubClosed):
+		return status.Error(grpcCodes.Unavailable, err.Error())
+	}
+	return err
+}
+
+// resumeToken resume_tokenの中身。page_tokenと同じくJSONをbase64にして中を見せない
+type resumeToken struct {
+	Epoch string `json:"e"`
+	Seq   uint64 `json:"s"`
+}
+
+func (h *watchHub) encodeResumeToken(seq uint64) string {
+	b, _ := json.Marshal(resumeToken{Epoch: h.epoch, Seq: seq})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeResumeToken 別のプロセスのトークンは続きを送れないので期限切れにする
+func (h *watchHub) decodeResumeToken(s string) (uint64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return 0, errInvalidResumeToken
+	}
+	var t resumeToken
+	if err := json.Unmarshal(b, &t); err != nil || t.Epoch == "" {
+		return 0, errInvalidResumeToken
+	}
+	if t.Epoch != h.epoch {
+		return 0, errResumeTokenExpired
+	}
+	return t.Seq, nil
+}
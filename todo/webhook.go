@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	todoPb "gen/go/todo"
+	"net/url"
+	"pkg/broker"
+	"slices"
+	"time"
+
+	otelapi "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Webhook
+// 登録されたWebhookごとに、todo.eventsのイベントを配信として保存し、webhookWorkerがPOSTする。
+// 配信は保存してから送るので、送り先が止まっていてもやり直せる。送った結果は配信の記録に残す
+
+const (
+	maxWebhookURLLength    = 2048
+	maxWebhookSecretLength = 256
+)
+
+var errWebhookNotFound = errors.New("webhook not found")
+
+// webhookDelivery 保存する配信。公開するフィールドはWebhookDeliveryに入れる
+type webhookDelivery struct {
+	*todoPb.WebhookDelivery
+	// ブローカーのメッセージのID。同じメッセージから2回配信を作らない
+	messageID string
+	// POSTする本文。TodoEventのJSON
+	payload []byte
+	// 配信のspanの親にするトレースコンテキスト
+	headers map[string]string
+
+	// 送るときに使う送り先。dueで返すときだけ入れる
+	url, secret string
+}
+
+// deliveryQuery ListWebhookDeliveriesの条件。新しい順に返す
+type deliveryQuery struct {
+	webhookID string
+	// STATE_UNSPECIFIEDならすべて
+	state todoPb.WebhookDelivery_State
+	// nilなら先頭から返す
+	after *deliveryCursor
+	limit int
+}
+
+// deliveryCursor 前のページの最後の配信
+type deliveryCursor struct {
+	CreateTime time.Time
+	ID         string
+}
+
+// webhookStore Webhookの読み書きはcontextのテナントの中だけで行う。配信を送るdueとupdateDeliveryはテナントを問わない
+type webhookStore interface {
+	// createWebhook secretも保存する
+	createWebhook(ctx context.Context, w *todoPb.Webhook) error
+	// getWebhook 見つからなければerrWebhookNotFound。別のテナントのものも見つからないものとして扱う
+	getWebhook(ctx context.Context, id string) (*todoPb.Webhook, error)
+	// listWebhooks 作成順に返す
+	listWebhooks(ctx context.Context) ([]*todoPb.Webhook, error)
+	// deleteWebhook 配信の記録も消す。見つからなければerrWebhookNotFound
+	deleteWebhook(ctx context.Context, id string) error
+
+	// enqueue 配信を作る。同じWebhookとメッセージの配信があれば作らない
+	// 消されたWebhookへの配信も作らない
+	enqueue(ctx context.Context, deliveries []*webhookDelivery) error
+	// due next_attempt_timeがnowまでのPENDINGの配信を、早い順にlimit件まで返す
+	due(ctx context.Context, now time.Time, limit int) ([]*webhookDelivery, error)
+	// updateDelivery 送った結果を保存する
+	updateDelivery(ctx context.Context, d *webhookDelivery) error
+	listDeliveries(ctx context.Context, query deliveryQuery) ([]*todoPb.WebhookDelivery, error)
+	// notified 配信が作られると受け取れる
+	notified() <-chan struct{}
+}
+
+func (s *todoServer) CreateWebhook(ctx context.Context, req *todoPb.CreateWebhookRequest) (*todoPb.Webhook, error) {
+	if err := validateWebhook(req.GetWebhook(), s.webhookAddrs); err != nil {
+		return nil, invalidArgument(ctx, err)
+	}
+
+	w := &todoPb.Webhook{
+		Id:         newTodoID(),
+		Url:        req.GetWebhook().GetUrl(),
+		Secret:     req.GetWebhook().GetSecret(),
+		EventTypes: req.GetWebhook().GetEventTypes(),
+		CreateTime: timestamppb.Now(),
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("webhook.id", w.GetId()))
+
+	if err := s.webhooks.createWebhook(ctx, w); err != nil {
+		return nil, storeError(ctx, err)
+	}
+	return withoutSecret(w), nil
+}
+
+func (s *todoServer) GetWebhook(ctx context.Context, req *todoPb.GetWebhookRequest) (*todoPb.Webhook, error) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("webhook.id", req.GetId()))
+
+	w, err := s.webhooks.getWebhook(ctx, req.GetId())
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+	return withoutSecret(w), nil
+}
+
+func (s *todoServer) ListWebhooks(ctx context.Context, _ *todoPb.ListWebhooksRequest) (*todoPb.ListWebhooksResponse, error) {
+	webhooks, err := s.webhooks.listWebhooks(ctx)
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+	for i, w := range webhooks {
+		webhooks[i] = withoutSecret(w)
+	}
+	return &todoPb.ListWebhooksResponse{Webhooks: webhooks}, nil
+}
+
+func (s *todoServer) DeleteWebhook(ctx context.Context, req *todoPb.DeleteWebhookRequest) (*emptypb.Empty, error) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("webhook.id", req.GetId()))
+
+	if err := s.webhooks.deleteWebhook(ctx, req.GetId()); err != nil {
+		return nil, storeError(ctx, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *todoServer) ListWebhookDeliveries(ctx context.Context, req *todoPb.ListWebhookDeliveriesRequest) (*todoPb.ListWebhookDeliveriesResponse, error) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("webhook.id", req.GetWebhookId()))
+
+	query := deliveryQuery{webhookID: req.GetWebhookId(), state: req.GetState()}
+	switch size := req.GetPageSize(); {
+	case size < 0:
+		return nil, invalidArgument(ctx, errors.New("page_size must not be negative"))
+	case size == 0:
+		query.limit = defaultPageSize
+	default:
+		query.limit = int(min(size, maxPageSize))
+	}
+	if _, ok := todoPb.WebhookDelivery_State_name[int32(query.state)]; !ok {
+		return nil, invalidArgument(ctx, fmt.Errorf("state: unknown value %d", query.state))
+	}
+	if token := req.GetPageToken(); token != "" {
+		cursor, err := decodeDeliveryPageToken(req, token)
+		if err != nil {
+			return nil, invalidArgument(ctx, err)
+		}
+		query.after = cursor
+	}
+
+	// 消されたWebhookの配信は残らないので、見つからないことをはっきり返す
+	if _, err := s.webhooks.getWebhook(ctx, req.GetWebhookId()); err != nil {
+		return nil, storeError(ctx, err)
+	}
+
+	// 1件多く取り、次のページがあるかを調べる
+	limit := query.limit
+	query.limit++
+	deliveries, err := s.webhooks.listDeliveries(ctx, query)
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+
+	res := &todoPb.ListWebhookDeliveriesResponse{Deliveries: deliveries}
+	if len(deliveries) > limit {
+		res.Deliveries = deliveries[:limit]
+		res.NextPageToken = encodeDeliveryPageToken(req, res.Deliveries[limit-1])
+	}
+	span.SetAttributes(attribute.Int("webhook.delivery.count", len(res.Deliveries)))
+	return res, nil
+}
+
+func validateWebhook(w *todoPb.Webhook, addrs *webhookAddressPolicy) error {
+	if len(w.GetUrl()) > maxWebhookURLLength {
+		return fmt.Errorf("url must be at most %d bytes", maxWebhookURLLength)
+	}
+	u, err := url.Parse(w.GetUrl())
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	if err := addrs.checkURL(u); err != nil {
+		return err
+	}
+	switch secret := w.GetSecret(); {
+	case secret == "":
+		return errors.New("secret is required")
+	case len(secret) > maxWebhookSecretLength:
+		return fmt.Errorf("secret must be at most %d bytes", maxWebhookSecretLength)
+	}
+	for _, t := range w.GetEventTypes() {
+		if _, ok := todoPb.TodoEvent_Type_name[int32(t)]; !ok || t == todoPb.TodoEvent_TYPE_UNSPECIFIED {
+			return fmt.Errorf("event_types: unknown type %v", t)
+		}
+	}
+	return nil
+}
+
+func withoutSecret(w *todoPb.Webhook) *todoPb.Webhook {
+	w = proto.Clone(w).(*todoPb.Webhook)
+	w.Secret = ""
+	return w
+}
+
+// subscribes wがtypのイベントを受け取るか
+func subscribes(w *todoPb.Webhook, typ todoPb.TodoEvent_Type) bool {
+	return len(w.GetEventTypes()) == 0 || slices.Contains(w.GetEventTypes(), typ)
+}
+
+// deliveryPageToken next_page_tokenの中身。別のWebhookの続きには使えない
+type deliveryPageToken struct {
+	WebhookID  string                       `json:"w"`
+	State      todoPb.WebhookDelivery_State `json:"s,omitempty"`
+	CreateTime int64                        `json:"t"`
+	ID         string                       `json:"i"`
+}
+
+func encodeDeliveryPageToken(req *todoPb.ListWebhookDeliveriesRequest, last *todoPb.WebhookDelivery) string {
+	b, _ := json.Marshal(deliveryPageToken{
+		WebhookID:  req.GetWebhookId(),
+		State:      req.GetState(),
+		CreateTime: last.GetCreateTime().AsTime().UnixNano(),
+		ID:         last.GetId(),
+	})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeDeliveryPageToken(req *todoPb.ListWebhookDeliveriesRequest, s string) (*deliveryCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidPageToken
+	}
+	var t deliveryPageToken
+	if err := json.Unmarshal(b, &t); err != nil || t.ID == "" || t.WebhookID != req.GetWebhookId() || t.State != req.GetState() {
+		return nil, errInvalidPageToken
+	}
+	return &deliveryCursor{CreateTime: time.Unix(0, t.CreateTime), ID: t.ID}, nil
+}
+
+// webhookDispatcher todo.eventsを購読し、イベントを受け取るWebhookごとに配信を作る
+type webhookDispatcher struct {
+	store webhookStore
+}
+
+func (d *webhookDispatcher) consume(ctx context.Context, m *broker.Message) error {
+	var e todoPb.TodoEvent
+	if err := proto.Unmarshal(m.Payload, &e); err != nil {
+		return broker.Permanent(fmt.Errorf("unmarshal todo event %s: %w", m.ID, err))
+	}
+	// イベントと同じテナントのWebhookにだけ配る
+	ctx, err := withMessageTenant(ctx, m)
+	if err != nil {
+		return err
+	}
+	webhooks, err := d.store.listWebhooks(ctx)
+	if err != nil {
+		return err
+	}
+
+	payload, err := protojson.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	// 配信のspanはこのメッセージを処理したspanの子にする
+	headers := broker.HeaderCarrier{}
+	otelapi.GetTextMapPropagator().Inject(ctx, headers)
+
+	now := timestamppb.Now()
+	var deliveries []*webhookDelivery
+	for _, w := range webhooks {
+		if !subscribes(w, e.GetType()) {
+			continue
+		}
+		deliveries = append(deliveries, &webhookDelivery{
+			WebhookDelivery: &todoPb.WebhookDelivery{
+				Id:              newTodoID(),
+				WebhookId:       w.GetId(),
+				EventType:       e.GetType(),
+				TodoId:          e.GetTodo().GetId(),
+				State:           todoPb.WebhookDelivery_PENDING,
+				NextAttemptTime: now,
+				CreateTime:      now,
+				UpdateTime:      now,
+			},
+			messageID: m.ID,
+			payload:   payload,
+			headers:   headers,
+		})
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("webhook.delivery.count", len(deliveries)))
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return d.store.enqueue(ctx, deliveries)
+}
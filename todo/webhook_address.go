@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Webhookの送り先の制限
+// 登録したURLにtodoから署名付きでPOSTするので、greetやメトリクスのポート、クラウドのメタデータのような
+// 内部のアドレスに送らせないようにする。ループバック、プライベート、リンクローカルなどのアドレスには送らない。
+//   - 登録するときに、URLのホストがIPアドレスかlocalhostならその場で断る
+//   - 送るときは、名前を解決した後の接続先をnet.DialerのControlで調べる。
+//     登録した後で名前の向き先を変えられても(DNS rebinding)内部には届かない
+//
+// 手元で試すときなど、内部に送りたい場合はTODO_WEBHOOK_ALLOWED_NETWORKSにCIDRをカンマ区切りで並べる
+
+const webhookAllowedNetworksEnv = "TODO_WEBHOOK_ALLOWED_NETWORKS"
+
+var errWebhookAddressNotAllowed = errors.New("webhook address is not allowed")
+
+// プライベートとして扱う範囲のうち、netip.Addrのメソッドで判定できないもの
+var webhookDeniedPrefixes = []netip.Prefix{
+	// キャリアグレードNAT
+	netip.MustParsePrefix("100.64.0.0/10"),
+	// 現在のネットワーク
+	netip.MustParsePrefix("0.0.0.0/8"),
+	// ベンチマーク用
+	netip.MustParsePrefix("198.18.0.0/15"),
+}
+
+type webhookAddressPolicy struct {
+	// 制限していても送ってよい範囲
+	allowed []netip.Prefix
+}
+
+func newWebhookAddressPolicy() (*webhookAddressPolicy, error) {
+	p := &webhookAddressPolicy{}
+	for _, s := range strings.Split(os.Getenv(webhookAllowedNetworksEnv), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", webhookAllowedNetworksEnv, err)
+		}
+		p.allowed = append(p.allowed, prefix.Masked())
+	}
+	return p, nil
+}
+
+// allow 送ってよいアドレスか
+func (p *webhookAddressPolicy) allow(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p.allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+		return false
+	}
+	for _, prefix := range webhookDeniedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkURL 登録するときに分かる範囲で調べる。名前は解決しない
+func (p *webhookAddressPolicy) checkURL(u *url.URL) error {
+	host := u.Hostname()
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !p.allow(addr) {
+			return fmt.Errorf("url: %w: %s", errWebhookAddressNotAllowed, host)
+		}
+		return nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if (host == "localhost" || strings.HasSuffix(host, ".localhost")) && !p.allow(netip.AddrFrom4([4]byte{127, 0, 0, 1})) {
+		return fmt.Errorf("url: %w: %s", errWebhookAddressNotAllowed, host)
+	}
+	return nil
+}
+
+// control 名前を解決した後の接続先を調べる
+func (p *webhookAddressPolicy) control(_, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errWebhookAddressNotAllowed, address)
+	}
+	if !p.allow(ap.Addr()) {
+		return fmt.Errorf("%w: %s", errWebhookAddressNotAllowed, ap.Addr())
+	}
+	return nil
+}
+
+// transport 接続先を制限したTransport
+// プロキシを通すと接続先がプロキシになって調べられないので、環境変数のプロキシは使わない
+func (p *webhookAddressPolicy) transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: p.control}).DialContext
+	return t
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	todoPb "gen/go/todo"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// memoryWebhookStore プロセスのメモリに保存する。再起動すると消える
+type memoryWebhookStore struct {
+	mu sync.Mutex
+	// 作成順
+	webhooks []*todoPb.Webhook
+	// Webhookのテナント
+	tenants    map[string]string
+	deliveries []*webhookDelivery
+	notifier
+}
+
+func newMemoryWebhookStore() *memoryWebhookStore {
+	return &memoryWebhookStore{tenants: map[string]string{}, notifier: newNotifier()}
+}
+
+func (s *memoryWebhookStore) createWebhook(ctx context.Context, w *todoPb.Webhook) error {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.webhooks = append(s.webhooks, proto.Clone(w).(*todoPb.Webhook))
+	s.tenants[w.GetId()] = tenant
+	return nil
+}
+
+func (s *memoryWebhookStore) getWebhook(ctx context.Context, id string) (*todoPb.Webhook, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := s.find(id)
+	if w == nil || s.tenants[id] != tenant {
+		return nil, errWebhookNotFound
+	}
+	return proto.Clone(w).(*todoPb.Webhook), nil
+}
+
+// find s.muを持って呼ぶ
+func (s *memoryWebhookStore) find(id string) *todoPb.Webhook {
+	for _, w := range s.webhooks {
+		if w.GetId() == id {
+			return w
+		}
+	}
+	return nil
+}
+
+func (s *memoryWebhookStore) listWebhooks(ctx context.Context) ([]*todoPb.Webhook, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var webhooks []*todoPb.Webhook
+	for _, w := range s.webhooks {
+		if s.tenants[w.GetId()] == tenant {
+			webhooks = append(webhooks, proto.Clone(w).(*todoPb.Webhook))
+		}
+	}
+	return webhooks, nil
+}
+
+func (s *memoryWebhookStore) deleteWebhook(ctx context.Context, id string) error {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.find(id) == nil || s.tenants[id] != tenant {
+		return errWebhookNotFound
+	}
+	delete(s.tenants, id)
+	s.webhooks = slices.DeleteFunc(s.webhooks, func(w *todoPb.Webhook) bool { return w.GetId() == id })
+	s.deliveries = slices.DeleteFunc(s.deliveries, func(d *webhookDelivery) bool { return d.GetWebhookId() == id })
+	return nil
+}
+
+func (s *memoryWebhookStore) enqueue(_ context.Context, deliveries []*webhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range deliveries {
+		if s.find(d.GetWebhookId()) == nil {
+			continue
+		}
+		if slices.ContainsFunc(s.deliveries, func(e *webhookDelivery) bool {
+			return e.GetWebhookId() == d.GetWebhookId() && e.messageID == d.messageID
+		}) {
+			continue
+		}
+		s.deliveries = append(s.deliveries, cloneDelivery(d))
+	}
+	s.notify()
+	return nil
+}
+
+func (s *memoryWebhookStore) due(_ context.Context, now time.Time, limit int) ([]*webhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deliveries []*webhookDelivery
+	for _, d := range s.deliveries {
+		if d.GetState() == todoPb.WebhookDelivery_PENDING && !d.GetNextAttemptTime().AsTime().After(now) {
+			w := s.find(d.GetWebhookId())
+			d := cloneDelivery(d)
+			d.url, d.secret = w.GetUrl(), w.GetSecret()
+			deliveries = append(deliveries, d)
+		}
+	}
+	slices.SortStableFunc(deliveries, func(a, b *webhookDelivery) int {
+		return a.GetNextAttemptTime().AsTime().Compare(b.GetNextAttemptTime().AsTime())
+	})
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+func (s *memoryWebhookStore) updateDelivery(_ context.Context, d *webhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 送っている間にWebhookが消されていれば、記録も残さない
+	for i, e := range s.deliveries {
+		if e.GetId() == d.GetId() {
+			s.deliveries[i] = cloneDelivery(d)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memoryWebhookStore) listDeliveries(ctx context.Context, query deliveryQuery) ([]*todoPb.WebhookDelivery, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deliveries []*todoPb.WebhookDelivery
+	for _, d := range s.deliveries {
+		if d.GetWebhookId() != query.webhookID || s.tenants[d.GetWebhookId()] != tenant {
+			continue
+		}
+		if query.state != todoPb.WebhookDelivery_STATE_UNSPECIFIED && d.GetState() != query.state {
+			continue
+		}
+		if c := query.after; c != nil && compareDelivery(d.WebhookDelivery, c) >= 0 {
+			continue
+		}
+		deliveries = append(deliveries, proto.Clone(d.WebhookDelivery).(*todoPb.WebhookDelivery))
+	}
+	// 新しい順
+	slices.SortFunc(deliveries, func(a, b *todoPb.WebhookDelivery) int {
+		return -compareDelivery(a, &deliveryCursor{CreateTime: b.GetCreateTime().AsTime(), ID: b.GetId()})
+	})
+	if len(deliveries) > query.limit {
+		deliveries = deliveries[:query.limit]
+	}
+	return deliveries, nil
+}
+
+// compareDelivery (create_time, id)の組でdがcより前なら負、後ろなら正を返す
+func compareDelivery(d *todoPb.WebhookDelivery, c *deliveryCursor) int {
+	if n := d.GetCreateTime().AsTime().Compare(c.CreateTime); n != 0 {
+		return n
+	}
+	return strings.Compare(d.GetId(), c.ID)
+}
+
+func cloneDelivery(d *webhookDelivery) *webhookDelivery {
+	c := *d
+	c.WebhookDelivery = proto.Clone(d.WebhookDelivery).(*todoPb.WebhookDelivery)
+	return &c
+}
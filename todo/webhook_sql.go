@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	todoPb "gen/go/todo"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// sqlWebhookStore todoと同じSQLiteのwebhooksとwebhook_deliveriesに保存する
+// Webhookはテナントごとに分ける。配信はWebhookに付くので、送るときはテナントを問わず早い順に送る
+type sqlWebhookStore struct {
+	db *sqlDB
+	notifier
+}
+
+func newSQLWebhookStore(db *sqlDB) *sqlWebhookStore {
+	return &sqlWebhookStore{db: db, notifier: newNotifier()}
+}
+
+const webhookColumns = `id, url, secret, event_types, create_time`
+
+func (s *sqlWebhookStore) createWebhook(ctx context.Context, w *todoPb.Webhook) error {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	eventTypes, err := json.Marshal(w.GetEventTypes())
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO webhooks (tenant_id, `+webhookColumns+`) VALUES (?, ?, ?, ?, ?, ?)`,
+		tenant, w.GetId(), w.GetUrl(), w.GetSecret(), string(eventTypes), w.GetCreateTime().AsTime().UnixNano(),
+	)
+	return err
+}
+
+func (s *sqlWebhookStore) getWebhook(ctx context.Context, id string) (*todoPb.Webhook, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	row := s.db.QueryRowContext(ctx,
+		`SELECT `+webhookColumns+` FROM webhooks WHERE tenant_id = ? AND id = ?`, tenant, id)
+	w, err := scanWebhook(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errWebhookNotFound
+	}
+	return w, err
+}
+
+func (s *sqlWebhookStore) listWebhooks(ctx context.Context) ([]*todoPb.Webhook, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+webhookColumns+` FROM webhooks WHERE tenant_id = ? ORDER BY create_time, id`, tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []*todoPb.Webhook
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, rows.Err()
+}
+
+func (s *sqlWebhookStore) deleteWebhook(ctx context.Context, id string) error {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	// 配信はON DELETE CASCADEで消える
+	res, err := s.db.ExecContext(ctx, `DELETE FROM webhooks WHERE tenant_id = ? AND id = ?`, tenant, id)
+	if err := notFoundIfNoRows(res, err); errors.Is(err, ErrNotFound) {
+		return errWebhookNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func scanWebhook(s scanner) (*todoPb.Webhook, error) {
+	var (
+		w          todoPb.Webhook
+		eventTypes string
+		createTime int64
+	)
+	if err := s.Scan(&w.Id, &w.Url, &w.Secret, &eventTypes, &createTime); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(eventTypes), &w.EventTypes); err != nil {
+		return nil, err
+	}
+	w.CreateTime = timestamppb.New(time.Unix(0, createTime))
+	return &w, nil
+}
+
+const deliveryColumns = `d.id, d.webhook_id, d.event_type, d.todo_id, d.state, d.attempts,
+	d.last_status_code, d.last_error, d.next_attempt_time, d.create_time, d.update_time`
+
+// webhook_deliveries_dueは部分インデックスなので、使われるようにPENDINGの値はクエリに直接書く
+var pendingState = strconv.Itoa(int(todoPb.WebhookDelivery_PENDING))
+
+func (s *sqlWebhookStore) enqueue(ctx context.Context, deliveries []*webhookDelivery) error {
+	err := s.db.InTx(ctx, func(ctx context.Context, tx *sqlTx) error {
+		for _, d := range deliveries {
+			headers, err := json.Marshal(d.headers)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx,
+				`INSERT INTO webhook_deliveries (id, webhook_id, message_id, event_type, todo_id, payload, headers,
+					state, next_attempt_time, create_time, update_time)
+				SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM webhooks WHERE id = ?)
+				ON CONFLICT (webhook_id, message_id) DO NOTHING`,
+				d.GetId(), d.GetWebhookId(), d.messageID, d.GetEventType(), d.GetTodoId(), d.payload, string(headers),
+				d.GetState(), d.GetNextAttemptTime().AsTime().UnixNano(),
+				d.GetCreateTime().AsTime().UnixNano(), d.GetUpdateTime().AsTime().UnixNano(),
+				d.GetWebhookId(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+func (s *sqlWebhookStore) due(ctx context.Context, now time.Time, limit int) ([]*webhookDelivery, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+deliveryColumns+`, d.payload, d.headers, w.url, w.secret
+		FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.state = `+pendingState+` AND d.next_attempt_time <= ?
+		ORDER BY d.next_attempt_time LIMIT ?`,
+		now.UnixNano(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*webhookDelivery
+	for rows.Next() {
+		var (
+			d       webhookDelivery
+			headers string
+		)
+		d.WebhookDelivery, err = scanDelivery(rows, &d.payload, &headers, &d.url, &d.secret)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(headers), &d.headers); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *sqlWebhookStore) updateDelivery(ctx context.Context, d *webhookDelivery) error {
+	var next sql.NullInt64
+	if t := d.GetNextAttemptTime(); t != nil {
+		next = sql.NullInt64{Int64: t.AsTime().UnixNano(), Valid: true}
+	}
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE webhook_deliveries SET state = ?, attempts = ?, last_status_code = ?, last_error = ?,
+			next_attempt_time = ?, update_time = ?
+		WHERE id = ?`,
+		d.GetState(), d.GetAttempts(), d.GetLastStatusCode(), d.GetLastError(),
+		next, d.GetUpdateTime().AsTime().UnixNano(), d.GetId(),
+	)
+	return err
+}
+
+func (s *sqlWebhookStore) listDeliveries(ctx context.Context, query deliveryQuery) ([]*todoPb.WebhookDelivery, error) {
+	tenant, err := tenantFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	where := []string{`d.webhook_id = ?`, `w.tenant_id = ?`}
+	args := []any{query.webhookID, tenant}
+	if query.state != todoPb.WebhookDelivery_STATE_UNSPECIFIED {
+		where = append(where, `d.state = ?`)
+		args = append(args, query.state)
+	}
+	if c := query.after; c != nil {
+		where = append(where, `(d.create_time, d.id) < (?, ?)`)
+		args = append(args, c.CreateTime.UnixNano(), c.ID)
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+deliveryColumns+` FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id`+whereClause(where)+
+			` ORDER BY d.create_time DESC, d.id DESC LIMIT ?`,
+		append(args, query.limit)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*todoPb.WebhookDelivery
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// scanDelivery deliveryColumnsを読む。extraはその後ろに続く列
+func scanDelivery(s scanner, extra ...any) (*todoPb.WebhookDelivery, error) {
+	var (
+		d                      todoPb.WebhookDelivery
+		next                   sql.NullInt64
+		createTime, updateTime int64
+	)
+	dest := append([]any{
+		&d.Id, &d.WebhookId, &d.EventType, &d.TodoId, &d.State, &d.Attempts,
+		&d.LastStatusCode, &d.LastError, &next, &createTime, &updateTime,
+	}, extra...)
+	if err := s.Scan(dest...); err != nil {
+		return nil, err
+	}
+	if next.Valid {
+		d.NextAttemptTime = timestamppb.New(time.Unix(0, next.Int64))
+	}
+	d.CreateTime = timestamppb.New(time.Unix(0, createTime))
+	d.UpdateTime = timestamppb.New(time.Unix(0, updateTime))
+	return &d, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	todoPb "gen/go/todo"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"pkg/broker"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	otelapi "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Webhookの配信
+// 送る時刻になった配信をPOSTし、2xxが返れば成功にする。
+// 失敗したら指数的に間隔を空け、揺らぎを足してやり直す。送り先が戻ったときに一斉に送らないようにするため。
+// TODO_WEBHOOK_MAX_ATTEMPTS回失敗したらDEAD_LETTERにして、もう送らない。
+// 送り先が内部のアドレスだった場合は、やり直しても変わらないのですぐにDEAD_LETTERにする
+//
+// 本文はHMAC-SHA256で署名する。受け取る側は同じsecretで次の値を計算し、署名ヘッダーと比べる
+//
+//	hex(HMAC-SHA256(secret, タイムスタンプヘッダーの値 + "." + 本文))
+//
+// HTTPクライアントはotelhttpで計装するので、traceparentヘッダーがつき、受け取る側のspanも同じトレースに入る
+
+const (
+	webhookMaxAttemptsEnv  = "TODO_WEBHOOK_MAX_ATTEMPTS"
+	webhookBackoffBaseEnv  = "TODO_WEBHOOK_BACKOFF_BASE"
+	webhookBackoffMaxEnv   = "TODO_WEBHOOK_BACKOFF_MAX"
+	webhookTimeoutEnv      = "TODO_WEBHOOK_TIMEOUT"
+	webhookConcurrencyEnv  = "TODO_WEBHOOK_CONCURRENCY"
+	webhookPollIntervalEnv = "TODO_WEBHOOK_POLL_INTERVAL"
+
+	defaultWebhookMaxAttempts  = 8
+	defaultWebhookBackoffBase  = time.Second
+	defaultWebhookBackoffMax   = 10 * time.Minute
+	defaultWebhookTimeout      = 10 * time.Second
+	defaultWebhookConcurrency  = 4
+	defaultWebhookPollInterval = time.Second
+
+	// 1回に読む配信の数
+	webhookBatchSize = 100
+	// 読み捨てるレスポンスの本文の上限。これより長ければ接続を使い回さない
+	maxWebhookResponseBody = 64 << 10
+)
+
+const (
+	webhookIDHeader        = "X-Todo-Webhook-Id"
+	webhookDeliveryHeader  = "X-Todo-Delivery-Id"
+	webhookAttemptHeader   = "X-Todo-Delivery-Attempt"
+	webhookEventHeader     = "X-Todo-Event"
+	webhookTimestampHeader = "X-Todo-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Todo-Webhook-Signature"
+)
+
+// 配信の結果。spanの属性とメトリクスに使う
+const (
+	webhookSucceeded  = "succeeded"
+	webhookRetry      = "retry"
+	webhookDeadLetter = "dead_letter"
+)
+
+type webhookWorker struct {
+	store       webhookStore
+	client      *http.Client
+	maxAttempts int
+	backoffBase time.Duration
+	backoffMax  time.Duration
+	timeout     time.Duration
+	concurrency int
+	interval    time.Duration
+	tracer      trace.Tracer
+
+	deliveries metric.Int64Counter
+}
+
+// newWebhookWorker addrsで許したアドレスにだけ送る
+func newWebhookWorker(store webhookStore, addrs *webhookAddressPolicy) (*webhookWorker, error) {
+	w := &webhookWorker{store: store, tracer: otelapi.Tracer("todo")}
+	var err error
+	if w.maxAttempts, err = intFromEnv(webhookMaxAttemptsEnv, defaultWebhookMaxAttempts); err != nil {
+		return nil, err
+	}
+	if w.backoffBase, err = millisFromEnv(webhookBackoffBaseEnv, defaultWebhookBackoffBase); err != nil {
+		return nil, err
+	}
+	if w.backoffMax, err = millisFromEnv(webhookBackoffMaxEnv, defaultWebhookBackoffMax); err != nil {
+		return nil, err
+	}
+	if w.timeout, err = millisFromEnv(webhookTimeoutEnv, defaultWebhookTimeout); err != nil {
+		return nil, err
+	}
+	if w.concurrency, err = intFromEnv(webhookConcurrencyEnv, defaultWebhookConcurrency); err != nil {
+		return nil, err
+	}
+	if w.interval, err = millisFromEnv(webhookPollIntervalEnv, defaultWebhookPollInterval); err != nil {
+		return nil, err
+	}
+	if w.maxAttempts <= 0 || w.timeout <= 0 || w.concurrency <= 0 || w.interval <= 0 {
+		return nil, errors.New(webhookMaxAttemptsEnv + ", " + webhookTimeoutEnv + ", " +
+			webhookConcurrencyEnv + " and " + webhookPollIntervalEnv + " must be positive")
+	}
+
+	w.client = &http.Client{
+		Transport: otelhttp.NewTransport(addrs.transport()),
+		// リダイレクト先には署名した本文を送らない。3xxは失敗として扱う
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	if w.deliveries, err = otelapi.Meter("todo").Int64Counter("todo.webhook.deliveries",
+		metric.WithDescription("Number of webhook delivery attempts by result"),
+		metric.WithUnit("{attempt}"),
+	); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// run ctxが終わるまで配信を送り続ける。送っている途中のものは終わるまで待つ
+func (w *webhookWorker) run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		if err := w.deliverDue(ctx); err != nil {
+			log.Printf("failed to deliver webhooks: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.store.notified():
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverDue 送る時刻になった配信がなくなるまで送る
+func (w *webhookWorker) deliverDue(ctx context.Context) error {
+	// 送る配信を探すクエリはトレースに入れない。途中で止めても、送り始めたものは最後まで記録する
+	storeCtx := context.WithoutCancel(ctx)
+	for ctx.Err() == nil {
+		deliveries, err := w.store.due(storeCtx, time.Now(), webhookBatchSize)
+		if err != nil {
+			return err
+		}
+
+		var g errgroup.Group
+		g.SetLimit(w.concurrency)
+		for _, d := range deliveries {
+			if ctx.Err() != nil {
+				break
+			}
+			g.Go(func() error { return w.deliver(storeCtx, d) })
+		}
+		if err := g.Wait(); err != nil {
+			return err
+		}
+		if len(deliveries) < webhookBatchSize {
+			return nil
+		}
+	}
+	return nil
+}
+
+// deliver 1回送り、結果を保存する
+func (w *webhookWorker) deliver(ctx context.Context, d *webhookDelivery) error {
+	ctx = otelapi.GetTextMapPropagator().Extract(ctx, broker.HeaderCarrier(d.headers))
+	ctx, span := w.tracer.Start(ctx, "webhook.deliver", trace.WithAttributes(
+		attribute.String("webhook.id", d.GetWebhookId()),
+		attribute.String("webhook.delivery.id", d.GetId()),
+		attribute.Int("webhook.delivery.attempt", int(d.GetAttempts())+1),
+		attribute.String("todo.event.type", d.GetEventType().String()),
+		attribute.String("todo.id", d.GetTodoId()),
+	))
+	defer span.End()
+
+	code, err := w.send(ctx, d)
+	now := time.Now()
+	d.Attempts++
+	d.LastStatusCode = int32(code)
+	d.UpdateTime = timestamppb.New(now)
+
+	var result string
+	switch {
+	case err == nil:
+		result = webhookSucceeded
+		d.State = todoPb.WebhookDelivery_SUCCEEDED
+		d.LastError = ""
+		d.NextAttemptTime = nil
+	case int(d.GetAttempts()) >= w.maxAttempts, errors.Is(err, errWebhookAddressNotAllowed):
+		result = webhookDeadLetter
+		d.State = todoPb.WebhookDelivery_DEAD_LETTER
+		d.LastError = err.Error()
+		d.NextAttemptTime = nil
+	default:
+		result = webhookRetry
+		d.LastError = err.Error()
+		d.NextAttemptTime = timestamppb.New(now.Add(w.backoff(int(d.GetAttempts()))))
+	}
+	span.SetAttributes(attribute.String("webhook.delivery.result", result))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	w.deliveries.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result), tenantAttribute(ctx)))
+
+	if err := w.store.updateDelivery(ctx, d); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("save webhook delivery %s: %w", d.GetId(), err)
+	}
+	return nil
+}
+
+// send 署名した本文をPOSTし、レスポンスのステータスコードを返す。2xx以外はエラーにする
+func (w *webhookWorker) send(ctx context.Context, d *webhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(d.payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "todo-webhook")
+	req.Header.Set(webhookIDHeader, d.GetWebhookId())
+	req.Header.Set(webhookDeliveryHeader, d.GetId())
+	req.Header.Set(webhookAttemptHeader, strconv.Itoa(int(d.GetAttempts())+1))
+	req.Header.Set(webhookEventHeader, d.GetEventType().String())
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(d.secret, timestamp, d.payload))
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, maxWebhookResponseBody))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook responded with %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// signWebhook タイムスタンプも署名に含め、古い本文を送り直されても受け取る側で見分けられるようにする
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff attempts回失敗した後に待つ時間
+// base * 2^(attempts-1)をbackoffMaxで抑え、その半分から全部の間で揺らす
+func (w *webhookWorker) backoff(attempts int) time.Duration {
+	d := w.backoffBase
+	for i := 1; i < attempts && d < w.backoffMax; i++ {
+		d *= 2
+	}
+	d = min(d, w.backoffMax)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}